@@ -2,8 +2,10 @@ package chatlog
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/sjzar/chatlog/internal/chatlog"
+	"github.com/sjzar/chatlog/internal/chatlog/wechat"
 
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
@@ -16,14 +18,18 @@ func init() {
 	decryptCmd.Flags().StringVarP(&decryptDataDir, "data-dir", "d", "", "data dir")
 	decryptCmd.Flags().StringVarP(&decryptDatakey, "data-key", "k", "", "data key")
 	decryptCmd.Flags().StringVarP(&decryptWorkDir, "work-dir", "w", "", "work dir")
+	decryptCmd.Flags().StringVarP(&decryptWorkDirKey, "work-dir-key", "", "", "work dir passphrase, databases in work dir are stored encrypted")
+	decryptCmd.Flags().IntVarP(&decryptWorkers, "workers", "j", 0, "decrypt workers, default is the number of CPUs")
 }
 
 var (
-	decryptPlatform string
-	decryptVer      int
-	decryptDataDir  string
-	decryptDatakey  string
-	decryptWorkDir  string
+	decryptPlatform   string
+	decryptVer        int
+	decryptDataDir    string
+	decryptDatakey    string
+	decryptWorkDir    string
+	decryptWorkDirKey string
+	decryptWorkers    int
 )
 
 var decryptCmd = &cobra.Command{
@@ -34,10 +40,28 @@ var decryptCmd = &cobra.Command{
 		cmdConf := getDecryptConfig()
 
 		m := chatlog.New()
-		if err := m.CommandDecrypt("", cmdConf); err != nil {
+		var last *wechat.DecryptProgress
+		err := m.CommandDecrypt("", cmdConf, func(p *wechat.DecryptProgress) {
+			if p.Status == wechat.ProgressIdle {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "\r%s %s", p.Bar(30), p)
+			last = p
+		})
+		if last != nil {
+			fmt.Fprintln(os.Stderr)
+		}
+		if err != nil {
 			log.Err(err).Msg("failed to decrypt")
 			return
 		}
+		if failed := last.Failed(); len(failed) > 0 {
+			fmt.Printf("decrypt finished, %d of %d files failed:\n", len(failed), last.TotalFiles)
+			for _, f := range failed {
+				fmt.Printf("  %s: %s\n", f.Path, f.Error)
+			}
+			return
+		}
 		fmt.Println("decrypt success")
 	},
 }
@@ -53,11 +77,17 @@ func getDecryptConfig() map[string]any {
 	if len(decryptWorkDir) != 0 {
 		cmdConf["work_dir"] = decryptWorkDir
 	}
+	if len(decryptWorkDirKey) != 0 {
+		cmdConf["work_dir_key"] = decryptWorkDirKey
+	}
 	if len(decryptPlatform) != 0 {
 		cmdConf["platform"] = decryptPlatform
 	}
 	if decryptVer != 0 {
 		cmdConf["version"] = decryptVer
 	}
+	if decryptWorkers != 0 {
+		cmdConf["decrypt_workers"] = decryptWorkers
+	}
 	return cmdConf
 }
@@ -0,0 +1,78 @@
+package chatlog
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/sjzar/chatlog/internal/chatlog"
+)
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVarP(&exportTalker, "talker", "t", "", "talker")
+	exportCmd.Flags().StringVarP(&exportTime, "time", "", "all", "time range")
+	exportCmd.Flags().StringVarP(&exportFormat, "format", "f", "html", "export format: html, markdown, jsonl")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "output dir, or zip file if ends with .zip")
+	exportCmd.Flags().StringVarP(&exportPlatform, "platform", "p", "", "platform")
+	exportCmd.Flags().IntVarP(&exportVer, "version", "v", 0, "version")
+	exportCmd.Flags().StringVarP(&exportDataDir, "data-dir", "d", "", "data dir")
+	exportCmd.Flags().StringVarP(&exportImgKey, "img-key", "i", "", "img key")
+	exportCmd.Flags().StringVarP(&exportWorkDir, "work-dir", "w", "", "work dir")
+	exportCmd.Flags().StringVarP(&exportWorkDirKey, "work-dir-key", "", "", "work dir passphrase, databases in work dir are stored encrypted")
+	exportCmd.MarkFlagRequired("talker")
+	exportCmd.MarkFlagRequired("output")
+}
+
+var (
+	exportTalker     string
+	exportTime       string
+	exportFormat     string
+	exportOutput     string
+	exportPlatform   string
+	exportVer        int
+	exportDataDir    string
+	exportImgKey     string
+	exportWorkDir    string
+	exportWorkDirKey string
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export chat history of a talker",
+	Run: func(cmd *cobra.Command, args []string) {
+
+		cmdConf := getExportConfig()
+
+		m := chatlog.New()
+		if err := m.CommandExport("", cmdConf, exportTalker, exportTime, exportFormat, exportOutput); err != nil {
+			log.Err(err).Msg("failed to export")
+			return
+		}
+		fmt.Println("export success")
+	},
+}
+
+func getExportConfig() map[string]any {
+	cmdConf := make(map[string]any)
+	if len(exportDataDir) != 0 {
+		cmdConf["data_dir"] = exportDataDir
+	}
+	if len(exportImgKey) != 0 {
+		cmdConf["img_key"] = exportImgKey
+	}
+	if len(exportWorkDir) != 0 {
+		cmdConf["work_dir"] = exportWorkDir
+	}
+	if len(exportWorkDirKey) != 0 {
+		cmdConf["work_dir_key"] = exportWorkDirKey
+	}
+	if len(exportPlatform) != 0 {
+		cmdConf["platform"] = exportPlatform
+	}
+	if exportVer != 0 {
+		cmdConf["version"] = exportVer
+	}
+	return cmdConf
+}
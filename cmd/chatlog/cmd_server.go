@@ -18,6 +18,7 @@ func init() {
 	serverCmd.Flags().StringVarP(&serverDataKey, "data-key", "k", "", "data key")
 	serverCmd.Flags().StringVarP(&serverImgKey, "img-key", "i", "", "img key")
 	serverCmd.Flags().StringVarP(&serverWorkDir, "work-dir", "w", "", "work dir")
+	serverCmd.Flags().StringVarP(&serverWorkDirKey, "work-dir-key", "", "", "work dir passphrase, databases in work dir are stored encrypted")
 	serverCmd.Flags().BoolVarP(&serverAutoDecrypt, "auto-decrypt", "", false, "auto decrypt")
 }
 
@@ -27,6 +28,7 @@ var (
 	serverDataKey     string
 	serverImgKey      string
 	serverWorkDir     string
+	serverWorkDirKey  string
 	serverPlatform    string
 	serverVer         int
 	serverAutoDecrypt bool
@@ -65,6 +67,9 @@ func getServerConfig() map[string]any {
 	if len(serverWorkDir) != 0 {
 		cmdConf["work_dir"] = serverWorkDir
 	}
+	if len(serverWorkDirKey) != 0 {
+		cmdConf["work_dir_key"] = serverWorkDirKey
+	}
 	if len(serverPlatform) != 0 {
 		cmdConf["platform"] = serverPlatform
 	}
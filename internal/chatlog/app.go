@@ -4,15 +4,17 @@ import (
 	"fmt"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/sjzar/chatlog/internal/chatlog/ctx"
+	"github.com/sjzar/chatlog/internal/chatlog/wechat"
 	"github.com/sjzar/chatlog/internal/ui/footer"
 	"github.com/sjzar/chatlog/internal/ui/form"
 	"github.com/sjzar/chatlog/internal/ui/help"
 	"github.com/sjzar/chatlog/internal/ui/infobar"
 	"github.com/sjzar/chatlog/internal/ui/menu"
-	"github.com/sjzar/chatlog/internal/wechat"
+	iwechat "github.com/sjzar/chatlog/internal/wechat"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
@@ -20,6 +22,9 @@ import (
 
 const (
 	RefreshInterval = 1000 * time.Millisecond
+
+	// MaxFailedShown 解密完成后最多显示的失败文件数
+	MaxFailedShown = 5
 )
 
 type App struct {
@@ -250,16 +255,44 @@ func (a *App) initMenu() {
 			a.mainPages.AddPage("modal", modal, true, true)
 			a.SetFocus(modal)
 
+			// 定期刷新解密进度
+			done, stopped := make(chan struct{}), make(chan struct{})
+			go func() {
+				defer close(stopped)
+				tick := time.NewTicker(ProgressInterval)
+				defer tick.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case <-tick.C:
+						p := a.m.GetDecryptProgress()
+						if p.Status != wechat.ProgressRunning {
+							continue
+						}
+						a.QueueUpdateDraw(func() {
+							modal.SetText(decryptProgressText(p))
+						})
+					}
+				}
+			}()
+
 			// 在后台执行解密操作
 			go func() {
 				// 执行解密
 				err := a.m.DecryptDBFiles()
+				// 等待刷新进度的协程退出，避免进度覆盖最终结果
+				close(done)
+				<-stopped
 
 				// 在主线程中更新UI
 				a.QueueUpdateDraw(func() {
 					if err != nil {
 						// 解密失败
 						modal.SetText("解密失败: " + err.Error())
+					} else if failed := a.m.GetDecryptProgress().Failed(); len(failed) > 0 {
+						// 部分文件解密失败
+						modal.SetText(decryptFailedText(failed))
 					} else {
 						// 解密成功
 						modal.SetText("解密数据成功")
@@ -685,7 +718,7 @@ func (a *App) selectAccountSelected(i *menu.Item) {
 				Name:        name,
 				Description: description,
 				Hidden:      false,
-				Selected: func(instance *wechat.Account) func(*menu.Item) {
+				Selected: func(instance *iwechat.Account) func(*menu.Item) {
 					return func(*menu.Item) {
 						// 如果是当前账号，则无需切换
 						if a.ctx.Current != nil && a.ctx.Current.PID == instance.PID {
@@ -840,3 +873,28 @@ func (a *App) showInfo(text string) {
 		a.mainPages.RemovePage("modal")
 	})
 }
+
+// decryptProgressText 解密进度的显示内容
+func decryptProgressText(p *wechat.DecryptProgress) string {
+	current := make([]string, 0, len(p.Current))
+	for _, path := range p.Current {
+		current = append(current, filepath.Base(path))
+	}
+	return fmt.Sprintf("解密中 %d/%d 个文件\n%s %.1f%%\n%d/%d 页，剩余 %s\n%s",
+		p.DoneFiles, p.TotalFiles, tview.Escape(p.Bar(20)), p.Percent(),
+		p.DonePages, p.TotalPages, p.Remaining(), strings.Join(current, ", "))
+}
+
+// decryptFailedText 解密失败文件的汇总，最多显示 MaxFailedShown 个文件
+func decryptFailedText(failed []*wechat.FileProgress) string {
+	buf := &strings.Builder{}
+	fmt.Fprintf(buf, "解密数据完成，%d 个文件解密失败：\n", len(failed))
+	for i, f := range failed {
+		if i == MaxFailedShown {
+			fmt.Fprintf(buf, "...\n")
+			break
+		}
+		fmt.Fprintf(buf, "%s: %s\n", filepath.Base(f.Path), tview.Escape(f.Error))
+	}
+	return buf.String()
+}
@@ -0,0 +1,540 @@
+package changelog
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/internal/wechatdb"
+	"github.com/sjzar/chatlog/pkg/util"
+)
+
+// File 保存在工作目录中的变更日志
+const File = "chatlog_changes.db"
+
+const (
+	KindMessage  = "message"
+	KindContact  = "contact"
+	KindChatRoom = "chatroom"
+
+	OpUpsert = "upsert"
+	OpDelete = "delete"
+)
+
+const (
+	// DefaultLimit 单次获取变更的默认数量
+	DefaultLimit = 1000
+
+	// MaxLimit 单次获取变更的最大数量
+	MaxLimit = 10000
+
+	// BatchSize 每个会话单次查询的消息数量
+	BatchSize = 1000
+
+	// SyncDelay 收到数据库变更通知后延迟同步，等待联系人、群聊缓存刷新
+	SyncDelay = 2 * time.Second
+
+	// SettleTime 会话最后一条消息写入超过该时间后，认为消息数据库已同步
+	SettleTime = time.Minute
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS changes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind TEXT NOT NULL,
+	op TEXT NOT NULL,
+	key TEXT NOT NULL,
+	time INTEGER NOT NULL,
+	data TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS changes_message ON changes(key) WHERE kind = 'message';
+CREATE TABLE IF NOT EXISTS state (
+	kind TEXT NOT NULL,
+	key TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	PRIMARY KEY(kind, key)
+);
+CREATE TABLE IF NOT EXISTS message_watermark (
+	talker TEXT PRIMARY KEY,
+	seq INTEGER NOT NULL,
+	user_name TEXT NOT NULL,
+	time INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS meta (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+`
+
+// Change 一条变更记录
+type Change struct {
+	ID   int64           `json:"id"`
+	Kind string          `json:"kind"` // message, contact, chatroom
+	Op   string          `json:"op"`   // upsert, delete
+	Key  string          `json:"key"`  // 消息为 talker:seq，联系人与群聊为 ID
+	Time time.Time       `json:"time"` // 记录变更的时间
+	Data json.RawMessage `json:"data"` // 变更后的消息、联系人或群聊，删除时为 null
+}
+
+// Talker 返回变更所属的会话
+func (c *Change) Talker() string {
+	if c.Kind == KindMessage {
+		if i := strings.LastIndex(c.Key, ":"); i >= 0 {
+			return c.Key[:i]
+		}
+	}
+	return c.Key
+}
+
+type ChangesResp struct {
+	Items   []*Change `json:"items"`
+	Next    string    `json:"next"` // 下一次请求使用的 since
+	HasMore bool      `json:"hasMore"`
+}
+
+type Config interface {
+	GetWorkDir() string
+	GetWorkDirKey() string
+}
+
+// Service 根据消息、联系人、群聊数据库的变更通知维护持久化的变更日志
+// 每条变更有递增的 ID，客户端记录最后处理的 ID 即可增量同步，消息按 (talker, seq) 去重只记录一次
+type Service struct {
+	conf Config
+
+	mutex  sync.Mutex
+	db     *sql.DB
+	wdb    *wechatdb.DB
+	since  time.Time
+	state  map[string]map[string]string
+	cancel context.CancelFunc
+	notify chan struct{}
+}
+
+func New(conf Config) *Service {
+	return &Service{
+		conf: conf,
+	}
+}
+
+// Start 打开变更日志并开始监听数据库变更
+// 变更日志保存了消息明文，设置工作目录口令时不记录，并删除之前遗留的变更日志
+func (s *Service) Start(wdb *wechatdb.DB) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conf.GetWorkDirKey() != "" {
+		return util.RemoveSQLite(filepath.Join(s.conf.GetWorkDir(), File))
+	}
+
+	if err := s.open(); err != nil {
+		return err
+	}
+	s.wdb = wdb
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.notify = make(chan struct{}, 1)
+	for _, group := range []string{"message", "contact", "chatroom"} {
+		if err := wdb.SetCallback(group, s.callback); err != nil {
+			log.Error().Err(err).Msgf("set %s callback failed", group)
+		}
+	}
+	go s.loop(ctx, s.notify)
+
+	return nil
+}
+
+// Stop 停止监听并关闭变更日志
+func (s *Service) Stop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	if s.db != nil {
+		err := s.db.Close()
+		s.db = nil
+		s.wdb = nil
+		return err
+	}
+	return nil
+}
+
+// open 打开变更日志，读取起始时间与联系人、群聊的快照
+func (s *Service) open() error {
+	path := filepath.Join(s.conf.GetWorkDir(), File)
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return errors.DBConnectFailed(path, err)
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return errors.QueryFailed(schema, err)
+	}
+
+	s.db = db
+	if err := s.load(); err != nil {
+		db.Close()
+		s.db = nil
+		return err
+	}
+	return nil
+}
+
+func (s *Service) load() error {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if _, err := s.db.Exec("INSERT OR IGNORE INTO meta (key, value) VALUES ('since', ?)", now); err != nil {
+		return errors.QueryFailed("INSERT meta", err)
+	}
+	var since string
+	if err := s.db.QueryRow("SELECT value FROM meta WHERE key = 'since'").Scan(&since); err != nil {
+		return errors.QueryFailed("SELECT meta", err)
+	}
+	ms, _ := strconv.ParseInt(since, 10, 64)
+	s.since = time.UnixMilli(ms)
+
+	rows, err := s.db.Query("SELECT kind, key, hash FROM state")
+	if err != nil {
+		return errors.QueryFailed("SELECT state", err)
+	}
+	defer rows.Close()
+
+	s.state = map[string]map[string]string{
+		KindContact:  {},
+		KindChatRoom: {},
+	}
+	for rows.Next() {
+		var kind, key, hash string
+		if err := rows.Scan(&kind, &key, &hash); err != nil {
+			return errors.ScanRowFailed(err)
+		}
+		if s.state[kind] != nil {
+			s.state[kind][key] = hash
+		}
+	}
+	return rows.Err()
+}
+
+func (s *Service) callback(event fsnotify.Event) error {
+	// skip remove event
+	if !event.Op.Has(fsnotify.Create) {
+		return nil
+	}
+	s.mutex.Lock()
+	notify := s.notify
+	s.mutex.Unlock()
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (s *Service) loop(ctx context.Context, notify chan struct{}) {
+	// 启动时同步一次，记录停止期间的变更
+	s.sync()
+	for {
+		select {
+		case <-notify:
+			time.Sleep(SyncDelay)
+			s.sync()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sync 对比联系人、群聊快照并读取新消息，将变更写入日志
+func (s *Service) sync() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.db == nil {
+		return
+	}
+
+	if err := s.syncContacts(); err != nil {
+		log.Error().Err(err).Msg("sync contact changes failed")
+	}
+	if err := s.syncChatRooms(); err != nil {
+		log.Error().Err(err).Msg("sync chatroom changes failed")
+	}
+	if err := s.syncMessages(); err != nil {
+		log.Error().Err(err).Msg("sync message changes failed")
+	}
+}
+
+func (s *Service) syncContacts() error {
+	resp, err := s.wdb.GetContacts(context.Background(), "", 0, 0)
+	if err != nil {
+		return err
+	}
+	items := make(map[string]any, len(resp.Items))
+	for _, contact := range resp.Items {
+		items[contact.UserName] = contact
+	}
+	return s.diff(KindContact, items)
+}
+
+func (s *Service) syncChatRooms() error {
+	resp, err := s.wdb.GetChatRooms(context.Background(), "", 0, 0)
+	if err != nil {
+		return err
+	}
+	items := make(map[string]any, len(resp.Items))
+	for _, chatRoom := range resp.Items {
+		items[chatRoom.Name] = chatRoom
+	}
+	return s.diff(KindChatRoom, items)
+}
+
+// diff 对比快照，记录新增、修改和删除的联系人或群聊
+func (s *Service) diff(kind string, items map[string]any) error {
+	state := s.state[kind]
+	// 数据库重新加载期间可能读到空列表，避免误记录全部删除
+	if len(items) == 0 && len(state) > 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.QueryFailed("BEGIN", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixMilli()
+	next := make(map[string]string, len(items))
+	for key, item := range items {
+		b, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		h := sha1.Sum(b)
+		hash := hex.EncodeToString(h[:])
+		next[key] = hash
+		if state[key] == hash {
+			continue
+		}
+		if err := insertChange(tx, kind, OpUpsert, key, now, string(b)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO state (kind, key, hash) VALUES (?, ?, ?)", kind, key, hash); err != nil {
+			return errors.QueryFailed("INSERT state", err)
+		}
+	}
+	for key := range state {
+		if _, ok := next[key]; ok {
+			continue
+		}
+		if err := insertChange(tx, kind, OpDelete, key, now, "null"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM state WHERE kind = ? AND key = ?", kind, key); err != nil {
+			return errors.QueryFailed("DELETE state", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.QueryFailed("COMMIT", err)
+	}
+	s.state[kind] = next
+	return nil
+}
+
+type watermark struct {
+	seq      int64
+	userName string
+	time     time.Time
+}
+
+// syncMessages 从会话列表中找到有新消息的会话，记录各会话位置之后的消息
+func (s *Service) syncMessages() error {
+	marks, err := s.watermarks()
+	if err != nil {
+		return err
+	}
+
+	sessions, err := s.wdb.GetSessions(context.Background(), "", 0, 0)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, session := range sessions.Items {
+		if session.UserName == "" {
+			continue
+		}
+		mark, ok := marks[session.UserName]
+		if !ok {
+			mark = &watermark{time: s.since}
+		}
+		if session.NTime.Before(mark.time) {
+			continue
+		}
+
+		for {
+			cursor := &model.Cursor{Seq: mark.seq, Talker: mark.userName}
+			resp, err := s.wdb.GetMessagesByCursor(context.Background(), mark.time, now.Add(time.Minute*10), session.UserName, "", "", cursor, BatchSize)
+			if err != nil {
+				log.Debug().Err(err).Msgf("get messages of %s failed", session.UserName)
+				break
+			}
+			if len(resp.Items) > 0 {
+				last := resp.Items[len(resp.Items)-1]
+				mark.seq, mark.userName, mark.time = last.Seq, last.Talker, last.Time
+			}
+			// 会话列表中的最后一条消息已写入一段时间，之前的消息已全部记录，下次从之后开始查询
+			if !resp.HasMore && now.Sub(session.NTime) > SettleTime && session.NTime.Add(time.Second).After(mark.time) {
+				mark.time = session.NTime.Add(time.Second)
+			}
+			if err := s.appendMessages(session.UserName, resp.Items, mark); err != nil {
+				return err
+			}
+			if !resp.HasMore {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) watermarks() (map[string]*watermark, error) {
+	rows, err := s.db.Query("SELECT talker, seq, user_name, time FROM message_watermark")
+	if err != nil {
+		return nil, errors.QueryFailed("SELECT message_watermark", err)
+	}
+	defer rows.Close()
+
+	marks := make(map[string]*watermark)
+	for rows.Next() {
+		var talker string
+		var mark watermark
+		var t int64
+		if err := rows.Scan(&talker, &mark.seq, &mark.userName, &t); err != nil {
+			return nil, errors.ScanRowFailed(err)
+		}
+		mark.time = time.UnixMilli(t)
+		marks[talker] = &mark
+	}
+	return marks, rows.Err()
+}
+
+// appendMessages 在同一事务中记录消息并推进会话位置
+func (s *Service) appendMessages(talker string, messages []*model.Message, mark *watermark) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.QueryFailed("BEGIN", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixMilli()
+	for _, m := range messages {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if err := insertChange(tx, KindMessage, OpUpsert, m.Talker+":"+strconv.FormatInt(m.Seq, 10), now, string(b)); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO message_watermark (talker, seq, user_name, time) VALUES (?, ?, ?, ?)",
+		talker, mark.seq, mark.userName, mark.time.UnixMilli()); err != nil {
+		return errors.QueryFailed("INSERT message_watermark", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.QueryFailed("COMMIT", err)
+	}
+	return nil
+}
+
+func insertChange(tx *sql.Tx, kind, op, key string, t int64, data string) error {
+	query := "INSERT INTO changes (kind, op, key, time, data) VALUES (?, ?, ?, ?, ?)"
+	if kind == KindMessage {
+		// 同一条消息只记录一次
+		query = "INSERT OR IGNORE INTO changes (kind, op, key, time, data) VALUES (?, ?, ?, ?, ?)"
+	}
+	if _, err := tx.Exec(query, kind, op, key, t, data); err != nil {
+		return errors.QueryFailed("INSERT changes", err)
+	}
+	return nil
+}
+
+// GetChanges 获取 since 之后的变更，since 为空时从头开始
+func (s *Service) GetChanges(since string, limit int) (*ChangesResp, error) {
+	var id int64
+	if since != "" {
+		var err error
+		id, err = strconv.ParseInt(since, 10, 64)
+		if err != nil || id < 0 {
+			return nil, errors.InvalidArg("since")
+		}
+	}
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+
+	if s.conf.GetWorkDirKey() != "" {
+		return nil, errors.ErrChangelogDisabled
+	}
+	s.mutex.Lock()
+	db := s.db
+	s.mutex.Unlock()
+	if db == nil {
+		return nil, errors.ErrChangelogNotReady
+	}
+
+	// 多取一条用于判断是否还有更多变更
+	query := "SELECT id, kind, op, key, time, data FROM changes WHERE id > ? ORDER BY id LIMIT ?"
+	rows, err := db.Query(query, id, limit+1)
+	if err != nil {
+		return nil, errors.QueryFailed(query, err)
+	}
+	defer rows.Close()
+
+	resp := &ChangesResp{
+		Items: make([]*Change, 0),
+		Next:  strconv.FormatInt(id, 10),
+	}
+	for rows.Next() {
+		var c Change
+		var t int64
+		var data string
+		if err := rows.Scan(&c.ID, &c.Kind, &c.Op, &c.Key, &t, &data); err != nil {
+			return nil, errors.ScanRowFailed(err)
+		}
+		c.Time = time.UnixMilli(t)
+		c.Data = json.RawMessage(data)
+		resp.Items = append(resp.Items, &c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.QueryFailed(query, err)
+	}
+
+	if len(resp.Items) > limit {
+		resp.Items = resp.Items[:limit]
+		resp.HasMore = true
+	}
+	if len(resp.Items) > 0 {
+		resp.Next = strconv.FormatInt(resp.Items[len(resp.Items)-1].ID, 10)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,84 @@
+package changelog
+
+import (
+	"testing"
+
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+type testConfig struct {
+	dir string
+}
+
+func (c *testConfig) GetWorkDir() string {
+	return c.dir
+}
+
+func (c *testConfig) GetWorkDirKey() string {
+	return ""
+}
+
+func TestDiff(t *testing.T) {
+	s := New(&testConfig{dir: t.TempDir()})
+	if err := s.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	a := &model.Contact{UserName: "a", NickName: "A"}
+	b := &model.Contact{UserName: "b", NickName: "B"}
+	if err := s.diff(KindContact, map[string]any{"a": a, "b": b}); err != nil {
+		t.Fatal(err)
+	}
+	// 未变化时不记录
+	if err := s.diff(KindContact, map[string]any{"a": a, "b": b}); err != nil {
+		t.Fatal(err)
+	}
+	a2 := &model.Contact{UserName: "a", NickName: "A2"}
+	if err := s.diff(KindContact, map[string]any{"a": a2}); err != nil {
+		t.Fatal(err)
+	}
+	// 空列表不记录删除
+	if err := s.diff(KindContact, map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := s.GetChanges("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 4 || resp.HasMore {
+		t.Fatalf("got %d changes, hasMore %v", len(resp.Items), resp.HasMore)
+	}
+	if resp.Items[2].Op != OpUpsert || resp.Items[2].Key != "a" || resp.Items[3].Op != OpDelete || resp.Items[3].Key != "b" {
+		t.Fatalf("unexpected changes %+v %+v", resp.Items[2], resp.Items[3])
+	}
+
+	resp, err = s.GetChanges("1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 2 || !resp.HasMore || resp.Next != "3" {
+		t.Fatalf("got %d changes, hasMore %v, next %s", len(resp.Items), resp.HasMore, resp.Next)
+	}
+
+	// 重新打开后快照保留
+	s.Stop()
+	if err := s.open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.diff(KindContact, map[string]any{"a": a2}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = s.GetChanges("4", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 0 || resp.Next != "4" {
+		t.Fatalf("got %d changes, next %s", len(resp.Items), resp.Next)
+	}
+
+	if _, err := s.GetChanges("x", 0); err == nil {
+		t.Fatal("expected invalid since")
+	}
+}
@@ -0,0 +1,27 @@
+package conf
+
+type Auth struct {
+	Tokens      []*AuthToken `mapstructure:"tokens" json:"-"`
+	CORSOrigins []string     `mapstructure:"cors_origins" json:"cors_origins"` // 允许跨域访问的来源，为空时允许所有来源
+}
+
+type AuthToken struct {
+	Name   string   `mapstructure:"name"`
+	Token  string   `mapstructure:"token"`
+	Scopes []string `mapstructure:"scopes"` // 可访问的范围，为空时可访问全部
+	Allow  []string `mapstructure:"allow"`  // 允许访问的会话，支持联系人 ID、群聊 ID 和 "label:标签名"（仅 Windows 3.x），为空时允许全部
+	Deny   []string `mapstructure:"deny"`   // 禁止访问的会话，优先于 allow
+}
+
+type Redact struct {
+	Enabled      bool             `mapstructure:"enabled" json:"enabled"`
+	Detectors    []string         `mapstructure:"detectors" json:"detectors"`       // 启用的内置规则：phone, idcard, bankcard, email, address，为空时全部启用
+	Patterns     []*RedactPattern `mapstructure:"patterns" json:"patterns"`         // 自定义规则
+	Pseudonymize bool             `mapstructure:"pseudonymize" json:"pseudonymize"` // 使用化名替换发送者，同一响应中保持一致
+}
+
+type RedactPattern struct {
+	Name    string `mapstructure:"name" json:"name"`
+	Pattern string `mapstructure:"pattern" json:"pattern"` // 正则表达式
+	Replace string `mapstructure:"replace" json:"replace"` // 替换内容，默认为 [已隐藏]
+}
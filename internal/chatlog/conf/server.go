@@ -1,21 +1,29 @@
 package conf
 
+import "runtime"
+
 const (
 	DefalutHTTPAddr = "0.0.0.0:5030"
 )
 
 type ServerConfig struct {
-	Type        string   `mapstructure:"type"`
-	Platform    string   `mapstructure:"platform"`
-	Version     int      `mapstructure:"version"`
-	FullVersion string   `mapstructure:"full_version"`
-	DataDir     string   `mapstructure:"data_dir"`
-	DataKey     string   `mapstructure:"data_key"`
-	ImgKey      string   `mapstructure:"img_key"`
-	WorkDir     string   `mapstructure:"work_dir"`
-	HTTPAddr    string   `mapstructure:"http_addr"`
-	AutoDecrypt bool     `mapstructure:"auto_decrypt"`
-	Webhook     *Webhook `mapstructure:"webhook"`
+	Type           string   `mapstructure:"type"`
+	Platform       string   `mapstructure:"platform"`
+	Version        int      `mapstructure:"version"`
+	FullVersion    string   `mapstructure:"full_version"`
+	DataDir        string   `mapstructure:"data_dir"`
+	DataKey        string   `mapstructure:"data_key"`
+	ImgKey         string   `mapstructure:"img_key"`
+	WorkDir        string   `mapstructure:"work_dir"`
+	WorkDirKey     string   `mapstructure:"work_dir_key"` // 工作目录加密口令，设置后解密的数据库加密保存
+	HTTPAddr       string   `mapstructure:"http_addr"`    // 以 unix: 开头时监听 Unix domain socket，如 unix:/run/chatlog.sock
+	HTTPTLS        *TLS     `mapstructure:"http_tls"`
+	HTTPSocketMode string   `mapstructure:"http_socket_mode"` // Unix domain socket 文件权限，默认 0600
+	AutoDecrypt    bool     `mapstructure:"auto_decrypt"`
+	DecryptWorkers int      `mapstructure:"decrypt_workers"` // 解密并发数，默认为 CPU 核数
+	Webhook        *Webhook `mapstructure:"webhook"`
+	Auth           *Auth    `mapstructure:"auth"`
+	Redact         *Redact  `mapstructure:"redact"`
 }
 
 var ServerDefaults = map[string]any{}
@@ -28,6 +36,10 @@ func (c *ServerConfig) GetWorkDir() string {
 	return c.WorkDir
 }
 
+func (c *ServerConfig) GetWorkDirKey() string {
+	return c.WorkDirKey
+}
+
 func (c *ServerConfig) GetPlatform() string {
 	return c.Platform
 }
@@ -48,6 +60,18 @@ func (c *ServerConfig) GetAutoDecrypt() bool {
 	return c.AutoDecrypt
 }
 
+func (c *ServerConfig) GetDecryptWorkers() int {
+	return DecryptWorkers(c.DecryptWorkers)
+}
+
+// DecryptWorkers 返回解密并发数，未配置时使用 CPU 核数
+func DecryptWorkers(n int) int {
+	if n <= 0 {
+		return runtime.NumCPU()
+	}
+	return n
+}
+
 func (c *ServerConfig) GetHTTPAddr() string {
 	if c.HTTPAddr == "" {
 		c.HTTPAddr = DefalutHTTPAddr
@@ -55,6 +79,25 @@ func (c *ServerConfig) GetHTTPAddr() string {
 	return c.HTTPAddr
 }
 
+func (c *ServerConfig) GetHTTPTLS() *TLS {
+	return c.HTTPTLS
+}
+
+func (c *ServerConfig) GetHTTPSocketMode() string {
+	if c.HTTPSocketMode == "" {
+		return DefaultHTTPSocketMode
+	}
+	return c.HTTPSocketMode
+}
+
 func (c *ServerConfig) GetWebhook() *Webhook {
 	return c.Webhook
 }
+
+func (c *ServerConfig) GetAuth() *Auth {
+	return c.Auth
+}
+
+func (c *ServerConfig) GetRedact() *Redact {
+	return c.Redact
+}
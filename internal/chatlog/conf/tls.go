@@ -0,0 +1,17 @@
+package conf
+
+const (
+	// DefaultHTTPSocketMode Unix domain socket 文件的默认权限
+	DefaultHTTPSocketMode = "0600"
+)
+
+type TLS struct {
+	CertFile   string `mapstructure:"cert_file" json:"cert_file"`
+	KeyFile    string `mapstructure:"key_file" json:"key_file"`
+	SelfSigned bool   `mapstructure:"self_signed" json:"self_signed"` // 未配置证书时在工作目录中生成自签名证书
+}
+
+// Enabled 配置了证书或开启自签名证书时使用 HTTPS
+func (t *TLS) Enabled() bool {
+	return t != nil && (t.SelfSigned || (t.CertFile != "" && t.KeyFile != ""))
+}
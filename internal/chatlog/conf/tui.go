@@ -1,10 +1,16 @@
 package conf
 
 type TUIConfig struct {
-	ConfigDir   string          `mapstructure:"-" json:"config_dir"`
-	LastAccount string          `mapstructure:"last_account" json:"last_account"`
-	History     []ProcessConfig `mapstructure:"history" json:"history"`
-	Webhook     *Webhook        `mapstructure:"webhook" json:"webhook"`
+	ConfigDir      string          `mapstructure:"-" json:"config_dir"`
+	LastAccount    string          `mapstructure:"last_account" json:"last_account"`
+	History        []ProcessConfig `mapstructure:"history" json:"history"`
+	Webhook        *Webhook        `mapstructure:"webhook" json:"webhook"`
+	HTTPTLS        *TLS            `mapstructure:"http_tls" json:"http_tls"`
+	HTTPSocketMode string          `mapstructure:"http_socket_mode" json:"http_socket_mode"`
+	DecryptWorkers int             `mapstructure:"decrypt_workers" json:"decrypt_workers"`
+	WorkDirKey     string          `mapstructure:"work_dir_key" json:"work_dir_key"`
+	Auth           *Auth           `mapstructure:"auth" json:"auth"`
+	Redact         *Redact         `mapstructure:"redact" json:"redact"`
 }
 
 var TUIDefaults = map[string]any{}
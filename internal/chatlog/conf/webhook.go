@@ -1,16 +1,24 @@
 package conf
 
 type Webhook struct {
-	Host    string         `mapstructure:"host"`
-	DelayMs int64          `mapstructure:"delay_ms"`
-	Items   []*WebhookItem `mapstructure:"items"`
+	Host         string         `mapstructure:"host"`
+	DelayMs      int64          `mapstructure:"delay_ms"`
+	MaxRetries   int            `mapstructure:"max_retries"`     // 发送失败后的最大重试次数，超过后转为死信
+	RetryBaseMs  int64          `mapstructure:"retry_base_ms"`   // 首次重试间隔，之后按指数增长
+	RetryMaxMs   int64          `mapstructure:"retry_max_ms"`    // 最大重试间隔
+	MaxCatchUpMs int64          `mapstructure:"max_catch_up_ms"` // 重启后最多补发的消息时间范围，小于 0 时不限制
+	Items        []*WebhookItem `mapstructure:"items"`
 }
 
 type WebhookItem struct {
-	Type     string `mapstructure:"type"`
-	URL      string `mapstructure:"url"`
-	Talker   string `mapstructure:"talker"`
-	Sender   string `mapstructure:"sender"`
-	Keyword  string `mapstructure:"keyword"`
-	Disabled bool   `mapstructure:"disabled"`
+	Type        string            `mapstructure:"type"`
+	URL         string            `mapstructure:"url"`
+	Talker      string            `mapstructure:"talker"`
+	Sender      string            `mapstructure:"sender"`
+	Keyword     string            `mapstructure:"keyword"`
+	Disabled    bool              `mapstructure:"disabled"`
+	Secret      string            `mapstructure:"secret"`       // 设置后对请求进行 HMAC-SHA256 签名
+	Headers     map[string]string `mapstructure:"headers"`      // 自定义请求头
+	Template    string            `mapstructure:"template"`     // 请求体模板，使用 Go text/template 语法，为空时发送默认 JSON
+	ContentType string            `mapstructure:"content_type"` // 请求体类型，默认 application/json
 }
@@ -162,6 +162,10 @@ func (c *Context) GetWorkDir() string {
 	return c.WorkDir
 }
 
+func (c *Context) GetWorkDirKey() string {
+	return c.conf.WorkDirKey
+}
+
 func (c *Context) GetPlatform() string {
 	return c.Platform
 }
@@ -181,10 +185,33 @@ func (c *Context) GetHTTPAddr() string {
 	return c.HTTPAddr
 }
 
+func (c *Context) GetHTTPTLS() *conf.TLS {
+	return c.conf.HTTPTLS
+}
+
+func (c *Context) GetHTTPSocketMode() string {
+	if c.conf.HTTPSocketMode == "" {
+		return conf.DefaultHTTPSocketMode
+	}
+	return c.conf.HTTPSocketMode
+}
+
+func (c *Context) GetDecryptWorkers() int {
+	return conf.DecryptWorkers(c.conf.DecryptWorkers)
+}
+
 func (c *Context) GetWebhook() *conf.Webhook {
 	return c.conf.Webhook
 }
 
+func (c *Context) GetAuth() *conf.Auth {
+	return c.conf.Auth
+}
+
+func (c *Context) GetRedact() *conf.Redact {
+	return c.conf.Redact
+}
+
 func (c *Context) SetHTTPEnabled(enabled bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -2,11 +2,18 @@ package database
 
 import (
 	"context"
+	"encoding/json"
+	"iter"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog/log"
 
+	"github.com/sjzar/chatlog/internal/chatlog/changelog"
 	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/chatlog/redact"
 	"github.com/sjzar/chatlog/internal/chatlog/webhook"
 	"github.com/sjzar/chatlog/internal/model"
 	"github.com/sjzar/chatlog/internal/wechatdb"
@@ -19,6 +26,14 @@ const (
 	StateError
 )
 
+// StateNames 状态名称，用于状态接口与监控指标
+var StateNames = map[int]string{
+	StateInit:       "init",
+	StateDecrypting: "decrypting",
+	StateReady:      "ready",
+	StateError:      "error",
+}
+
 type Service struct {
 	State         int
 	StateMsg      string
@@ -26,34 +41,52 @@ type Service struct {
 	db            *wechatdb.DB
 	webhook       *webhook.Service
 	webhookCancel context.CancelFunc
+	changelog     *changelog.Service
+	redactor      *redact.Redactor
+
+	subMutex    sync.Mutex
+	subscribers map[chan struct{}]struct{}
 }
 
 type Config interface {
 	GetWorkDir() string
+	GetWorkDirKey() string
+	GetDecryptWorkers() int
 	GetPlatform() string
 	GetVersion() int
 	GetWebhook() *conf.Webhook
+	GetRedact() *conf.Redact
 }
 
 func NewService(conf Config) *Service {
 	return &Service{
-		conf:    conf,
-		webhook: webhook.New(conf),
+		conf:        conf,
+		webhook:     webhook.New(conf),
+		changelog:   changelog.New(conf),
+		redactor:    redact.New(conf.GetRedact()),
+		subscribers: make(map[chan struct{}]struct{}),
 	}
 }
 
 func (s *Service) Start() error {
-	db, err := wechatdb.New(s.conf.GetWorkDir(), s.conf.GetPlatform(), s.conf.GetVersion())
+	db, err := wechatdb.New(s.conf.GetWorkDir(), s.conf.GetPlatform(), s.conf.GetVersion(), s.conf.GetWorkDirKey(), s.conf.GetDecryptWorkers())
 	if err != nil {
 		return err
 	}
 	s.SetReady()
 	s.db = db
 	s.initWebhook()
+	if err := s.db.SetCallback("message", s.notify); err != nil {
+		log.Error().Err(err).Msg("set message callback failed")
+	}
+	if err := s.changelog.Start(s.db); err != nil {
+		log.Error().Err(err).Msg("start changelog failed")
+	}
 	return nil
 }
 
 func (s *Service) Stop() error {
+	s.changelog.Stop()
 	if s.db != nil {
 		s.db.Close()
 	}
@@ -87,25 +120,238 @@ func (s *Service) GetDB() *wechatdb.DB {
 	return s.db
 }
 
-func (s *Service) GetMessages(start, end time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
-	return s.db.GetMessages(start, end, talker, sender, keyword, limit, offset)
+// Notify 通知工作目录中的数据库文件已在原位置修改，服务未启动时忽略
+func (s *Service) Notify(path string) {
+	if db := s.db; db != nil {
+		db.Notify(path)
+	}
+}
+
+// WithRedactScope 返回携带脱敏范围的 context，同一 context 中的多次查询使用相同的化名
+// 未开启脱敏时返回 ctx
+func (s *Service) WithRedactScope(ctx context.Context) context.Context {
+	return redact.NewContext(ctx, s.redactor.NewScope())
+}
+
+// redactScope 获取 ctx 中的脱敏范围，不存在时为本次查询新建
+func (s *Service) redactScope(ctx context.Context) *redact.Scope {
+	if scope := redact.FromContext(ctx); scope != nil {
+		return scope
+	}
+	return s.redactor.NewScope()
+}
+
+// 以下查询返回的消息、会话与统计均已按配置脱敏
+
+func (s *Service) GetMessages(ctx context.Context, start, end time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	messages, err := s.db.GetMessages(ctx, start, end, talker, sender, keyword, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	scope := s.redactScope(ctx)
+	for _, m := range messages {
+		scope.Message(m)
+	}
+	return messages, nil
+}
+
+func (s *Service) IterMessages(ctx context.Context, start, end time.Time, talker string, sender string, keyword string) (iter.Seq2[*model.Message, error], error) {
+	seq, err := s.db.IterMessages(ctx, start, end, talker, sender, keyword)
+	if err != nil {
+		return nil, err
+	}
+	scope := s.redactScope(ctx)
+	if scope == nil {
+		return seq, nil
+	}
+	return func(yield func(*model.Message, error) bool) {
+		for m, err := range seq {
+			if err == nil {
+				scope.Message(m)
+			}
+			if !yield(m, err) || err != nil {
+				return
+			}
+		}
+	}, nil
+}
+
+// GetMessagesByCursor 按游标分页获取消息，返回的游标在脱敏前生成，开启化名时仍可用于翻页
+func (s *Service) GetMessagesByCursor(ctx context.Context, start, end time.Time, talker string, sender string, keyword string, cursor *model.Cursor, limit int) (*wechatdb.GetMessagesPageResp, error) {
+	resp, err := s.db.GetMessagesByCursor(ctx, start, end, talker, sender, keyword, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	scope := s.redactScope(ctx)
+	for _, m := range resp.Items {
+		scope.Message(m)
+	}
+	return resp, nil
 }
 
-func (s *Service) GetContacts(key string, limit, offset int) (*wechatdb.GetContactsResp, error) {
-	return s.db.GetContacts(key, limit, offset)
+func (s *Service) GetMessageContext(ctx context.Context, talker string, seq int64, before, after int) ([]*model.Message, error) {
+	messages, err := s.db.GetMessageContext(ctx, talker, seq, before, after)
+	if err != nil {
+		return nil, err
+	}
+	scope := s.redactScope(ctx)
+	for _, m := range messages {
+		scope.Message(m)
+	}
+	return messages, nil
 }
 
-func (s *Service) GetChatRooms(key string, limit, offset int) (*wechatdb.GetChatRoomsResp, error) {
-	return s.db.GetChatRooms(key, limit, offset)
+func (s *Service) GetMessageStats(ctx context.Context, start, end time.Time, talker string) (*wechatdb.MessageStats, error) {
+	stats, err := s.db.GetMessageStats(ctx, start, end, talker)
+	if err != nil {
+		return nil, err
+	}
+	s.redactScope(ctx).Stats(stats)
+	return stats, nil
+}
+
+// SearchMessages 搜索消息，在生成命中片段前对消息脱敏，避免片段中的高亮标记打断敏感内容
+func (s *Service) SearchMessages(ctx context.Context, start, end time.Time, talker string, sender string, keyword string, limit, offset int) (*wechatdb.SearchMessagesResp, error) {
+	var prepare func(m *model.Message)
+	if scope := s.redactScope(ctx); scope != nil {
+		prepare = scope.Message
+	}
+	return s.db.SearchMessages(ctx, start, end, talker, sender, keyword, limit, offset, prepare)
+}
+
+func (s *Service) GetContacts(ctx context.Context, key string, limit, offset int) (*wechatdb.GetContactsResp, error) {
+	return s.db.GetContacts(ctx, key, limit, offset)
+}
+
+func (s *Service) GetChatRooms(ctx context.Context, key string, limit, offset int) (*wechatdb.GetChatRoomsResp, error) {
+	return s.db.GetChatRooms(ctx, key, limit, offset)
 }
 
 // GetSession retrieves session information
-func (s *Service) GetSessions(key string, limit, offset int) (*wechatdb.GetSessionsResp, error) {
-	return s.db.GetSessions(key, limit, offset)
+func (s *Service) GetSessions(ctx context.Context, key string, limit, offset int) (*wechatdb.GetSessionsResp, error) {
+	resp, err := s.db.GetSessions(ctx, key, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	scope := s.redactScope(ctx)
+	for _, session := range resp.Items {
+		scope.Session(session)
+	}
+	return resp, nil
 }
 
-func (s *Service) GetMedia(_type string, key string) (*model.Media, error) {
-	return s.db.GetMedia(_type, key)
+func (s *Service) GetMedia(ctx context.Context, _type string, key string) (*model.Media, error) {
+	return s.db.GetMedia(ctx, _type, key)
+}
+
+func (s *Service) AllowedMediaPath(ctx context.Context, path string) bool {
+	return s.db.AllowedMediaPath(ctx, path)
+}
+
+func (s *Service) GetWebhookDeadLetters(limit, offset int) ([]*webhook.Entry, error) {
+	return s.webhook.GetDeadLetters(limit, offset)
+}
+
+func (s *Service) RetryWebhookDeadLetter(id int64) error {
+	return s.webhook.RetryDeadLetter(id)
+}
+
+func (s *Service) DeleteWebhookDeadLetter(id int64) error {
+	return s.webhook.DeleteDeadLetter(id)
+}
+
+// GetChanges 获取 since 之后的消息、联系人与群聊变更，按 ctx 中的访问策略过滤，消息变更按配置脱敏
+func (s *Service) GetChanges(ctx context.Context, since string, limit int) (*changelog.ChangesResp, error) {
+	resp, err := s.changelog.GetChanges(since, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := s.redactScope(ctx)
+	items := resp.Items[:0]
+	for _, item := range resp.Items {
+		if !s.db.AllowedTalker(ctx, item.Talker()) {
+			continue
+		}
+		if scope != nil && item.Kind == changelog.KindMessage && item.Op == changelog.OpUpsert {
+			if err := redactChange(scope, item); err != nil {
+				log.Debug().Err(err).Msgf("redact change %d failed", item.ID)
+				continue
+			}
+		}
+		items = append(items, item)
+	}
+	resp.Items = items
+	return resp, nil
+}
+
+// redactChange 对消息变更中的消息进行脱敏，开启化名时 Key 中的会话对象同样替换
+func redactChange(scope *redact.Scope, item *changelog.Change) error {
+	var m model.Message
+	if err := json.Unmarshal(item.Data, &m); err != nil {
+		return err
+	}
+	// 解码后引用消息与聊天记录为 map，还原为原始类型后才能完整脱敏
+	if refer, ok := m.Contents["refer"]; ok {
+		var v model.Message
+		if retype(refer, &v) == nil {
+			m.Contents["refer"] = &v
+		}
+	}
+	if info, ok := m.Contents["recordInfo"]; ok {
+		var v model.RecordInfo
+		if retype(info, &v) == nil {
+			m.Contents["recordInfo"] = &v
+		}
+	}
+	scope.Message(&m)
+	data, err := json.Marshal(&m)
+	if err != nil {
+		return err
+	}
+	item.Data = data
+	item.Key = m.Talker + ":" + strconv.FormatInt(m.Seq, 10)
+	return nil
+}
+
+func retype(in interface{}, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// Subscribe 订阅消息数据库变更，数据库有新消息写入时通知
+// 通知会合并，订阅方收到通知后应查询上次位置之后的所有消息，返回的函数用于取消订阅
+func (s *Service) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	s.subMutex.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.subMutex.Unlock()
+
+	return ch, func() {
+		s.subMutex.Lock()
+		delete(s.subscribers, ch)
+		s.subMutex.Unlock()
+	}
+}
+
+func (s *Service) notify(event fsnotify.Event) error {
+	// skip remove event
+	if !event.Op.Has(fsnotify.Create) {
+		return nil
+	}
+
+	s.subMutex.Lock()
+	defer s.subMutex.Unlock()
+	for ch := range s.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	return nil
 }
 
 func (s *Service) initWebhook() error {
@@ -114,7 +360,11 @@ func (s *Service) initWebhook() error {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	s.webhookCancel = cancel
-	hooks := s.webhook.GetHooks(ctx, s.db)
+	hooks, err := s.webhook.GetHooks(ctx, s.db)
+	if err != nil {
+		log.Error().Err(err).Msg("init webhook failed")
+		return err
+	}
 	for _, hook := range hooks {
 		log.Info().Msgf("set callback %#v", hook)
 		if err := s.db.SetCallback(hook.Group(), hook.Callback); err != nil {
@@ -128,6 +378,7 @@ func (s *Service) initWebhook() error {
 // Close closes the database connection
 func (s *Service) Close() {
 	// Add cleanup code if needed
+	s.changelog.Stop()
 	s.db.Close()
 	if s.webhookCancel != nil {
 		s.webhookCancel()
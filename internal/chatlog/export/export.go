@@ -0,0 +1,262 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+const (
+	FormatHTML     = "html"
+	FormatMarkdown = "markdown"
+	FormatJSONL    = "jsonl"
+)
+
+type Config interface {
+	GetDataDir() string
+}
+
+// Source 导出使用的数据源
+type Source interface {
+	IterMessages(ctx context.Context, start, end time.Time, talker string, sender string, keyword string) (iter.Seq2[*model.Message, error], error)
+	GetMedia(ctx context.Context, _type string, key string) (*model.Media, error)
+}
+
+// Exporter 将单个会话的聊天记录导出为可离线查看的归档
+type Exporter struct {
+	conf Config
+	src  Source
+}
+
+func New(conf Config, src Source) *Exporter {
+	return &Exporter{
+		conf: conf,
+		src:  src,
+	}
+}
+
+// Export 导出 talker 在时间范围内的聊天记录，归档中的文件通过 w 写出
+// 消息逐条读取并直接写入归档，不在内存中保留全部消息
+func (e *Exporter) Export(ctx context.Context, w Writer, talker string, start, end time.Time, format string) error {
+	if talker == "" {
+		return errors.ErrTalkerEmpty
+	}
+	if strings.Contains(talker, ",") {
+		return errors.InvalidArg("talker")
+	}
+
+	switch strings.ToLower(format) {
+	case "", FormatHTML:
+		return e.exportHTML(ctx, w, talker, start, end)
+	case FormatMarkdown, "md":
+		return e.exportMarkdown(ctx, w, talker, start, end)
+	case FormatJSONL:
+		return e.exportJSONL(ctx, w, talker, start, end)
+	default:
+		return errors.InvalidArg("format")
+	}
+}
+
+// exportIndex 第一遍读取消息时记录的信息
+// zip 归档同一时间只能写入一个文件，先写入全部媒体文件，再单独写入对话文件
+type exportIndex struct {
+	media   map[int64]*mediaFile // 消息 Seq 对应的媒体文件
+	count   int
+	first   *model.Message
+	lastSeq int64
+	last    time.Time
+}
+
+// writeAllMedia 读取全部消息，将其中的媒体文件写入归档
+func (e *Exporter) writeAllMedia(ctx context.Context, w Writer, talker string, start, end time.Time) (*exportIndex, error) {
+	messages, err := e.src.IterMessages(ctx, start, end, talker, "", "")
+	if err != nil {
+		return nil, err
+	}
+	idx := &exportIndex{media: make(map[int64]*mediaFile)}
+	for m, err := range messages {
+		if err != nil {
+			return nil, err
+		}
+		media, err := e.writeMedia(ctx, w, m)
+		if err != nil {
+			return nil, err
+		}
+		if media != nil {
+			idx.media[m.Seq] = media
+		}
+		if idx.first == nil {
+			idx.first = m
+		}
+		idx.count++
+		idx.lastSeq, idx.last = m.Seq, m.Time
+	}
+	return idx, nil
+}
+
+// eachMessage 再次读取第一遍读取过的消息，忽略之后新增的消息
+func (e *Exporter) eachMessage(ctx context.Context, idx *exportIndex, talker string, start, end time.Time, fn func(m *model.Message, media *mediaFile) error) error {
+	if idx.count == 0 {
+		return nil
+	}
+	messages, err := e.src.IterMessages(ctx, start, end, talker, "", "")
+	if err != nil {
+		return err
+	}
+	for m, err := range messages {
+		if err != nil {
+			return err
+		}
+		if m.Seq > idx.lastSeq {
+			break
+		}
+		if err := fn(m, idx.media[m.Seq]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportMarkdown 导出 Markdown 对话，媒体文件与 index.md 一同写入归档
+func (e *Exporter) exportMarkdown(ctx context.Context, w Writer, talker string, start, end time.Time) error {
+	idx, err := e.writeAllMedia(ctx, w, talker, start, end)
+	if err != nil {
+		return err
+	}
+	return writeFile(w, "index.md", func(f io.Writer) error {
+		enc := NewMarkdownEncoder(f, "", "", false)
+		return e.eachMessage(ctx, idx, talker, start, end, enc.encode)
+	})
+}
+
+// exportJSONL 导出 JSON Lines，每行一条消息
+func (e *Exporter) exportJSONL(ctx context.Context, w Writer, talker string, start, end time.Time) error {
+	messages, err := e.src.IterMessages(ctx, start, end, talker, "", "")
+	if err != nil {
+		return err
+	}
+	return writeFile(w, "messages.jsonl", func(f io.Writer) error {
+		enc := json.NewEncoder(f)
+		for m, err := range messages {
+			if err != nil {
+				return err
+			}
+			if err := enc.Encode(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeFile 创建归档中的文件，通过缓冲写入 fn 输出的内容
+func writeFile(w Writer, name string, fn func(f io.Writer) error) error {
+	f, err := w.Create(name)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	if err := fn(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Writer 归档写入接口
+type Writer interface {
+	// Write 写入归档中的文件，name 为使用 "/" 分隔的相对路径
+	Write(name string, r io.Reader) error
+	// Create 创建归档中的文件，关闭前不能再写入其他文件
+	Create(name string) (io.WriteCloser, error)
+	Close() error
+}
+
+// DirWriter 将归档写入目录
+type DirWriter struct {
+	dir string
+}
+
+func NewDirWriter(dir string) (*DirWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirWriter{dir: dir}, nil
+}
+
+func (d *DirWriter) Write(name string, r io.Reader) error {
+	f, err := d.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (d *DirWriter) Create(name string) (io.WriteCloser, error) {
+	path := filepath.Join(d.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+func (d *DirWriter) Close() error {
+	return nil
+}
+
+// ZipWriter 将归档写入 zip 文件
+type ZipWriter struct {
+	zw *zip.Writer
+}
+
+func NewZipWriter(w io.Writer) *ZipWriter {
+	return &ZipWriter{zw: zip.NewWriter(w)}
+}
+
+func (z *ZipWriter) Write(name string, r io.Reader) error {
+	f, err := z.zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (z *ZipWriter) Create(name string) (io.WriteCloser, error) {
+	f, err := z.zw.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{f}, nil
+}
+
+func (z *ZipWriter) Close() error {
+	return z.zw.Close()
+}
+
+// nopCloser zip 中的文件在创建下一个文件或关闭归档时结束
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
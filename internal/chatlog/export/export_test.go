@@ -0,0 +1,153 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+type testConf struct{}
+
+func (testConf) GetDataDir() string { return "" }
+
+type testSource struct {
+	messages []*model.Message
+}
+
+func (s *testSource) IterMessages(ctx context.Context, start, end time.Time, talker string, sender string, keyword string) (iter.Seq2[*model.Message, error], error) {
+	return func(yield func(*model.Message, error) bool) {
+		for _, m := range s.messages {
+			if !yield(m, nil) {
+				return
+			}
+		}
+	}, nil
+}
+
+func (s *testSource) GetMedia(ctx context.Context, _type string, key string) (*model.Media, error) {
+	return nil, errors.ErrMediaNotFound
+}
+
+func TestExportHTML(t *testing.T) {
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	src := &testSource{messages: []*model.Message{
+		{Seq: 1, Time: base, Talker: "a@chatroom", TalkerName: "测试群", IsChatRoom: true, Sender: "wxid_a", SenderName: "张三", Type: model.MessageTypeText, Content: "<script>alert(1)</script>"},
+		{Seq: 2, Time: base.Add(time.Minute), Talker: "a@chatroom", IsChatRoom: true, Sender: "wxid_self", IsSelf: true, Type: model.MessageTypeImage, Contents: map[string]interface{}{"md5": "abc"}},
+		{Seq: 3, Time: base.Add(24 * time.Hour), Talker: "a@chatroom", IsChatRoom: true, Type: model.MessageTypeSystem, Content: "张三撤回了一条消息"},
+	}}
+
+	buf := &bytes.Buffer{}
+	w := NewZipWriter(buf)
+	if err := New(testConf{}, src).Export(context.Background(), w, "a@chatroom", base, base.Add(48*time.Hour), FormatHTML); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != "index.html" {
+		t.Fatalf("unexpected archive files: %v", zr.File)
+	}
+	f, _ := zr.File[0].Open()
+	b, _ := io.ReadAll(f)
+	f.Close()
+	page := string(b)
+
+	for _, want := range []string{
+		"<title>测试群 - 聊天记录</title>",
+		"&lt;script&gt;alert(1)&lt;/script&gt;",
+		`<div class="msg self" id="m2">`,
+		"[图片]",
+		"2024-01-02",
+		"张三撤回了一条消息",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page missing %q", want)
+		}
+	}
+}
+
+func TestExportInvalidArgs(t *testing.T) {
+	e := New(testConf{}, &testSource{})
+	w := NewZipWriter(io.Discard)
+	if err := e.Export(context.Background(), w, "", time.Time{}, time.Now(), FormatHTML); err == nil {
+		t.Error("expected error for empty talker")
+	}
+	if err := e.Export(context.Background(), w, "a,b", time.Time{}, time.Now(), FormatHTML); err == nil {
+		t.Error("expected error for multiple talkers")
+	}
+	if err := e.Export(context.Background(), w, "a", time.Time{}, time.Now(), "pdf"); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
+
+func TestMarkdownEncoder(t *testing.T) {
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	messages := []*model.Message{
+		{Time: base, Talker: "wxid_b", TalkerName: "李四", Sender: "wxid_b", SenderName: "李四", Type: model.MessageTypeText, Content: "第一行\n第二行"},
+		{Time: base.Add(time.Minute), Talker: "wxid_b", Sender: "wxid_self", IsSelf: true, Type: model.MessageTypeShare, SubType: model.MessageSubTypeQuote, Content: "收到",
+			Contents: map[string]interface{}{"refer": &model.Message{Sender: "wxid_b", SenderName: "李四", Type: model.MessageTypeText, Content: "明天开会"}}},
+		{Time: base.Add(24 * time.Hour), Talker: "wxid_b", Sender: "wxid_b", SenderName: "李四", Type: model.MessageTypeShare, SubType: model.MessageSubTypeLink,
+			Contents: map[string]interface{}{"title": "项目文档", "url": "https://example.com/doc"}},
+		{Time: base.Add(25 * time.Hour), Talker: "wxid_b", Sender: "wxid_b", SenderName: "李四", Type: model.MessageTypeImage,
+			Contents: map[string]interface{}{"md5": "abc"}},
+	}
+
+	buf := &bytes.Buffer{}
+	enc := NewMarkdownEncoder(buf, "", "127.0.0.1:5030", false)
+	for _, m := range messages {
+		if err := enc.Encode(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := "# 李四\n\n" +
+		"## 2024-01-01\n\n" +
+		"**李四** 10:00:00\n\n第一行  \n第二行\n\n" +
+		"**我** 10:01:00\n\n> **李四**: 明天开会\n\n收到\n\n" +
+		"## 2024-01-02\n\n" +
+		"**李四** 10:00:00\n\n[项目文档](https://example.com/doc)\n\n" +
+		"**李四** 11:00:00\n\n![图片](http://127.0.0.1:5030/image/abc)\n\n"
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected markdown:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExportJSONL(t *testing.T) {
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	src := &testSource{messages: []*model.Message{
+		{Seq: 1, Time: base, Talker: "wxid_b", Sender: "wxid_b", Type: model.MessageTypeText, Content: "你好"},
+		{Seq: 2, Time: base.Add(time.Minute), Talker: "wxid_b", IsSelf: true, Type: model.MessageTypeText, Content: "在吗"},
+	}}
+
+	dir := t.TempDir()
+	w, err := NewDirWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := New(testConf{}, src).Export(context.Background(), w, "wxid_b", base, base.Add(time.Hour), FormatJSONL); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "messages.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "你好") || !strings.Contains(lines[1], "在吗") {
+		t.Errorf("unexpected jsonl:\n%s", b)
+	}
+}
@@ -0,0 +1,153 @@
+package export
+
+import (
+	"context"
+	_ "embed"
+	"hash/fnv"
+	"html/template"
+	"io"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+//go:embed html.tmpl
+var htmlTemplate string
+
+var htmlTmpl = template.Must(template.New("export").Parse(htmlTemplate))
+
+// avatarColors 头像背景色，按发送者 ID 选取
+var avatarColors = []string{
+	"#f56a00", "#7265e6", "#ffbf00", "#00a2ae", "#1890ff",
+	"#52c41a", "#eb2f96", "#fa541c", "#13c2c2", "#722ed1",
+}
+
+type htmlPage struct {
+	Title      string
+	Talker     string
+	TimeRange  string
+	ExportTime string
+	Count      int
+}
+
+type htmlMessage struct {
+	Seq      int64
+	Date     string // 与上一条消息不在同一天时显示日期分隔
+	Time     string
+	Name     string
+	ShowName bool // 群聊中显示发送者名称
+	Sender   string
+	IsSelf   bool
+	IsSystem bool
+	Avatar   string
+	Color    string
+	Text     string
+	Image    string
+	Video    string
+	Voice    string
+	File     string
+	FileName string
+}
+
+// exportHTML 导出 HTML 页面，媒体文件写入归档后逐条写入消息
+func (e *Exporter) exportHTML(ctx context.Context, w Writer, talker string, start, end time.Time) error {
+	idx, err := e.writeAllMedia(ctx, w, talker, start, end)
+	if err != nil {
+		return err
+	}
+
+	page := &htmlPage{
+		Title:      talker,
+		Talker:     talker,
+		TimeRange:  start.Format("2006-01-02") + " ~ " + end.Format("2006-01-02"),
+		ExportTime: time.Now().Format("2006-01-02 15:04:05"),
+		Count:      idx.count,
+	}
+	if idx.first != nil {
+		if idx.first.TalkerName != "" {
+			page.Title = idx.first.TalkerName
+		}
+		page.TimeRange = idx.first.Time.Format("2006-01-02") + " ~ " + idx.last.Format("2006-01-02")
+	}
+
+	return writeFile(w, "index.html", func(f io.Writer) error {
+		if err := htmlTmpl.ExecuteTemplate(f, "header", page); err != nil {
+			return err
+		}
+		lastDate := ""
+		err := e.eachMessage(ctx, idx, talker, start, end, func(m *model.Message, media *mediaFile) error {
+			hm := htmlMessageOf(m, media)
+			if date := m.Time.Format("2006-01-02"); date != lastDate {
+				hm.Date = date
+				lastDate = date
+			}
+			return htmlTmpl.ExecuteTemplate(f, "message", hm)
+		})
+		if err != nil {
+			return err
+		}
+		return htmlTmpl.ExecuteTemplate(f, "footer", nil)
+	})
+}
+
+// htmlMessageOf 转换消息，media 为已写入归档的图片、语音、视频或文件
+// 媒体文件缺失或无法解码时，仅保留文字描述
+func htmlMessageOf(m *model.Message, media *mediaFile) *htmlMessage {
+	hm := &htmlMessage{
+		Seq:      m.Seq,
+		Time:     m.Time.Format("15:04:05"),
+		Name:     m.SenderName,
+		ShowName: m.IsChatRoom,
+		Sender:   m.Sender,
+		IsSelf:   m.IsSelf,
+		IsSystem: m.Type == model.MessageTypeSystem,
+	}
+	if hm.Name == "" {
+		hm.Name = m.Sender
+		if m.IsSelf {
+			hm.Name = "我"
+		}
+	}
+	hm.Avatar, hm.Color = avatarOf(hm.Name, m.Sender)
+
+	if media != nil {
+		switch media.Type {
+		case "image":
+			hm.Image = media.Path
+		case "video":
+			hm.Video = media.Path
+		case "voice":
+			hm.Voice = media.Path
+		case "file":
+			hm.File, hm.FileName = media.Path, media.Name
+		}
+	}
+
+	switch {
+	case m.Type == model.MessageTypeImage:
+		hm.Text = "[图片]"
+	case m.Type == model.MessageTypeVideo:
+		hm.Text = "[视频]"
+	case m.Type == model.MessageTypeVoice:
+		hm.Text = "[语音]"
+	case m.Type == model.MessageTypeShare && m.SubType == model.MessageSubTypeFile:
+		hm.Text = "[文件|" + contentString(m, "title") + "]"
+	default:
+		m.SetContent("host", "")
+		hm.Text = m.PlainTextContent()
+	}
+
+	return hm
+}
+
+// avatarOf 使用名称首字作为头像，背景色由发送者 ID 决定
+func avatarOf(name, sender string) (string, string) {
+	avatar := "?"
+	for _, r := range name {
+		avatar = string(r)
+		break
+	}
+	h := fnv.New32a()
+	h.Write([]byte(sender))
+	return avatar, avatarColors[h.Sum32()%uint32(len(avatarColors))]
+}
@@ -0,0 +1,171 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+// MarkdownEncoder 将消息流式编码为 Markdown 对话
+// 写入第一条消息前输出会话标题，消息日期变化时输出日期标题
+type MarkdownEncoder struct {
+	w          io.Writer
+	title      string
+	host       string
+	showTalker bool
+	started    bool
+	lastDate   string
+}
+
+// NewMarkdownEncoder 创建 Markdown 编码器
+// title 为空时使用第一条消息的会话名称，host 用于生成图片、语音等媒体的 HTTP 链接，为空时只输出文字描述
+func NewMarkdownEncoder(w io.Writer, title string, host string, showTalker bool) *MarkdownEncoder {
+	return &MarkdownEncoder{
+		w:          w,
+		title:      title,
+		host:       host,
+		showTalker: showTalker,
+	}
+}
+
+// Encode 写入一条消息
+func (e *MarkdownEncoder) Encode(m *model.Message) error {
+	return e.encode(m, nil)
+}
+
+// encode 写入一条消息，media 不为空时使用归档中的媒体文件
+func (e *MarkdownEncoder) encode(m *model.Message, media *mediaFile) error {
+	buf := strings.Builder{}
+
+	if !e.started {
+		e.started = true
+		title := e.title
+		if title == "" {
+			title = m.TalkerName
+			if title == "" {
+				title = m.Talker
+			}
+		}
+		buf.WriteString("# " + title + "\n\n")
+	}
+
+	if date := m.Time.Format("2006-01-02"); date != e.lastDate {
+		e.lastDate = date
+		buf.WriteString("## " + date + "\n\n")
+	}
+
+	name := m.SenderName
+	if name == "" {
+		name = m.Sender
+		if m.IsSelf {
+			name = "我"
+		}
+	}
+	if m.Type != model.MessageTypeSystem {
+		buf.WriteString("**" + name + "**")
+		if e.showTalker {
+			talker := m.TalkerName
+			if talker == "" {
+				talker = m.Talker
+			}
+			buf.WriteString(" [" + talker + "]")
+		}
+		buf.WriteString(" " + m.Time.Format("15:04:05") + "\n\n")
+	}
+
+	buf.WriteString(markdownContent(m, e.host, media))
+	buf.WriteString("\n\n")
+
+	_, err := io.WriteString(e.w, buf.String())
+	return err
+}
+
+// markdownContent 返回消息内容的 Markdown 表示
+func markdownContent(m *model.Message, host string, media *mediaFile) string {
+	m.SetContent("host", host)
+
+	switch m.Type {
+	case model.MessageTypeText:
+		return hardBreaks(m.Content)
+	case model.MessageTypeImage:
+		if media != nil {
+			return fmt.Sprintf("![图片](%s)", media.Path)
+		}
+		if host == "" {
+			return "[图片]"
+		}
+	case model.MessageTypeVideo:
+		if media != nil {
+			if media.Type == "image" {
+				return fmt.Sprintf("![视频](%s)", media.Path)
+			}
+			return fmt.Sprintf("[视频](%s)", media.Path)
+		}
+		if host == "" {
+			return "[视频]"
+		}
+	case model.MessageTypeVoice:
+		if media != nil {
+			return fmt.Sprintf("[语音](%s)", media.Path)
+		}
+		if host == "" {
+			return "[语音]"
+		}
+	case model.MessageTypeSystem:
+		return "*" + m.Content + "*"
+	case model.MessageTypeShare:
+		switch m.SubType {
+		case model.MessageSubTypeFile:
+			if media != nil {
+				return fmt.Sprintf("[文件|%s](%s)", media.Name, media.Path)
+			}
+			if host == "" {
+				return fmt.Sprintf("[文件|%s]", contentString(m, "title"))
+			}
+		case model.MessageSubTypeQuote:
+			return quoteContent(m, host)
+		case model.MessageSubTypeLink, model.MessageSubTypeLink2, model.MessageSubTypeMusic,
+			model.MessageSubTypeMiniProgram, model.MessageSubTypeMiniProgram2, model.MessageSubTypeChannel:
+			title, url := contentString(m, "title"), contentString(m, "url")
+			if title != "" && url != "" {
+				return fmt.Sprintf("[%s](%s)", title, url)
+			}
+		}
+	}
+
+	return hardBreaks(m.PlainTextContent())
+}
+
+// quoteContent 将引用消息输出为 Markdown 引用块，随后是回复内容
+func quoteContent(m *model.Message, host string) string {
+	refer, ok := m.Contents["refer"].(*model.Message)
+	if !ok {
+		return "> [引用]\n\n" + hardBreaks(m.Content)
+	}
+
+	name := refer.SenderName
+	if name == "" {
+		name = refer.Sender
+	}
+
+	buf := strings.Builder{}
+	lines := strings.Split(strings.TrimRight(markdownContent(refer, host, nil), "\n"), "\n")
+	for i, line := range lines {
+		buf.WriteString("> ")
+		if i == 0 && name != "" {
+			buf.WriteString("**" + name + "**: ")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	buf.WriteString(hardBreaks(m.Content))
+	return buf.String()
+}
+
+// hardBreaks 保留消息中的换行
+func hardBreaks(s string) string {
+	return strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "  \n")
+}
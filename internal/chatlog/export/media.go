@@ -0,0 +1,223 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/pkg/util/dat2img"
+	"github.com/sjzar/chatlog/pkg/util/silk"
+)
+
+// mediaFile 写入归档的媒体文件
+type mediaFile struct {
+	Type string // image, video, voice, file
+	Path string // 归档中的相对路径
+	Name string // 文件的原始名称
+}
+
+// writeMedia 将消息中的图片、语音、视频和文件写入归档
+// 消息不包含媒体，或媒体文件缺失、无法解码时返回 nil
+func (e *Exporter) writeMedia(ctx context.Context, w Writer, m *model.Message) (*mediaFile, error) {
+	var media *mediaFile
+	var path string
+	var err error
+	switch {
+	case m.Type == model.MessageTypeImage:
+		path, err = e.writeImage(ctx, w, m)
+		media = &mediaFile{Type: "image", Path: path}
+	case m.Type == model.MessageTypeVideo:
+		var video, thumb string
+		video, thumb, err = e.writeVideo(ctx, w, m)
+		media = &mediaFile{Type: "video", Path: video}
+		if thumb != "" {
+			media = &mediaFile{Type: "image", Path: thumb}
+		}
+	case m.Type == model.MessageTypeVoice:
+		path, err = e.writeVoice(ctx, w, m)
+		media = &mediaFile{Type: "voice", Path: path}
+	case m.Type == model.MessageTypeShare && m.SubType == model.MessageSubTypeFile:
+		name := contentString(m, "title")
+		path, err = e.writeFile(ctx, w, m, name)
+		media = &mediaFile{Type: "file", Path: path, Name: name}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if media == nil || media.Path == "" {
+		return nil, nil
+	}
+	return media, nil
+}
+
+func (e *Exporter) writeImage(ctx context.Context, w Writer, m *model.Message) (string, error) {
+	path := e.mediaPath(ctx, "image", contentStrings(m, "md5", "path", "thumbpath"))
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Debug().Err(err).Msgf("read image %s failed", path)
+		return "", nil
+	}
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	if ext == "dat" {
+		out, _ext, err := dat2img.Dat2Image(data)
+		if err != nil {
+			log.Debug().Err(err).Msgf("decode image %s failed", path)
+			return "", nil
+		}
+		data, ext = out, _ext
+	}
+
+	name := fmt.Sprintf("media/image/%d.%s", m.Seq, ext)
+	if err := w.Write(name, bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// writeVideo 写入视频文件，只找到视频封面时返回封面图片
+func (e *Exporter) writeVideo(ctx context.Context, w Writer, m *model.Message) (video string, thumb string, err error) {
+	path := e.mediaPath(ctx, "video", contentStrings(m, "md5", "rawmd5", "path"))
+	if path == "" {
+		return "", "", nil
+	}
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	name := fmt.Sprintf("media/video/%d.%s", m.Seq, ext)
+	if err := e.copyFile(w, name, path); err != nil {
+		return "", "", err
+	}
+	if ext == "mp4" {
+		return name, "", nil
+	}
+	return "", name, nil
+}
+
+func (e *Exporter) writeVoice(ctx context.Context, w Writer, m *model.Message) (string, error) {
+	key := contentString(m, "voice")
+	if key == "" {
+		return "", nil
+	}
+	media, err := e.src.GetMedia(ctx, "voice", key)
+	if err != nil || len(media.Data) == 0 {
+		return "", nil
+	}
+	out, err := silk.Silk2MP3(media.Data)
+	if err != nil {
+		log.Debug().Err(err).Msgf("convert voice %s failed", key)
+		return "", nil
+	}
+
+	name := fmt.Sprintf("media/voice/%d.mp3", m.Seq)
+	if err := w.Write(name, bytes.NewReader(out)); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (e *Exporter) writeFile(ctx context.Context, w Writer, m *model.Message, title string) (string, error) {
+	path := e.mediaPath(ctx, "file", contentStrings(m, "md5"))
+	if path == "" {
+		return "", nil
+	}
+	if title == "" {
+		title = filepath.Base(path)
+	}
+	name := fmt.Sprintf("files/%d_%s", m.Seq, sanitizeName(title))
+	if err := e.copyFile(w, name, path); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (e *Exporter) copyFile(w Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return w.Write(name, f)
+}
+
+// mediaPath 按 key 依次查找媒体文件，返回数据目录中的绝对路径
+// 查找规则与 HTTP 服务的媒体路由一致
+func (e *Exporter) mediaPath(ctx context.Context, _type string, keys []string) string {
+	dataDir := e.conf.GetDataDir()
+	if dataDir == "" {
+		return ""
+	}
+	for _, k := range keys {
+		if strings.Contains(k, "/") {
+			if path, ok := findPath(dataDir, _type, k); ok {
+				return path
+			}
+		}
+		media, err := e.src.GetMedia(ctx, _type, k)
+		if err != nil || media.Path == "" {
+			continue
+		}
+		path := filepath.Join(dataDir, media.Path)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func findPath(dataDir, _type, key string) (string, bool) {
+	absolutePath := filepath.Join(dataDir, key)
+	if _, err := os.Stat(absolutePath); err == nil {
+		return absolutePath, true
+	}
+	var suffixes []string
+	switch _type {
+	case "image":
+		suffixes = []string{"_h.dat", ".dat", "_t.dat"}
+	case "video":
+		suffixes = []string{".mp4", "_thumb.jpg"}
+	}
+	for _, suffix := range suffixes {
+		if _, err := os.Stat(absolutePath + suffix); err == nil {
+			return absolutePath + suffix, true
+		}
+	}
+	return "", false
+}
+
+func contentString(m *model.Message, key string) string {
+	if v, ok := m.Contents[key].(string); ok {
+		return v
+	}
+	return ""
+}
+
+func contentStrings(m *model.Message, keys ...string) []string {
+	values := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if v := contentString(m, key); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// sanitizeName 替换文件名中不能使用的字符
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		if r < 0x20 {
+			return '_'
+		}
+		return r
+	}, name)
+}
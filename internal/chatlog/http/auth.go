@@ -0,0 +1,134 @@
+package http
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/wechatdb"
+)
+
+// 访问范围
+const (
+	ScopeAll     = "*"
+	ScopeRead    = "read"    // 查询接口，包括聊天记录、联系人、会话、导出、推送与增量同步
+	ScopeMedia   = "media"   // 图片、视频、语音、文件等多媒体内容
+	ScopeMCP     = "mcp"     // MCP 服务
+	ScopeAdmin   = "admin"   // 管理接口，如 Webhook 死信处理
+	ScopeMetrics = "metrics" // Prometheus 指标
+)
+
+const (
+	// TokenQuery 通过查询参数携带 Token，用于无法设置请求头的场景，如 EventSource 和多媒体链接
+	TokenQuery = "token"
+
+	// ContextToken 认证通过后保存在请求上下文中的 Token
+	ContextToken = "chatlog_token"
+)
+
+// authMiddleware 校验请求携带的 Token 是否有权访问 scope
+// 未配置 Token 时不校验，保持与之前版本一致
+func (s *Service) authMiddleware(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth := s.conf.GetAuth()
+		if auth == nil || len(auth.Tokens) == 0 {
+			c.Next()
+			return
+		}
+
+		token := findToken(auth.Tokens, requestToken(c))
+		if token == nil {
+			c.Header("WWW-Authenticate", `Bearer realm="chatlog"`)
+			errors.Err(c, errors.Unauthorized())
+			c.Abort()
+			return
+		}
+		if !HasScope(token, scope) {
+			errors.Err(c, errors.Forbidden(scope))
+			c.Abort()
+			return
+		}
+
+		c.Set(ContextToken, token)
+		if len(token.Allow) > 0 || len(token.Deny) > 0 {
+			// 会话访问策略通过 context 传递到 repository 统一过滤
+			ctx := wechatdb.WithPolicy(c.Request.Context(), &wechatdb.Policy{Allow: token.Allow, Deny: token.Deny})
+			c.Request = c.Request.WithContext(ctx)
+		}
+		c.Next()
+	}
+}
+
+// CheckAuthPolicy 检查 Token 的会话规则，数据源不支持联系人标签时不允许使用标签规则，避免 allow 规则静默拒绝所有会话
+func CheckAuthPolicy(auth *conf.Auth, platform string, version int) error {
+	if auth == nil || wechatdb.SupportsLabels(platform, version) {
+		return nil
+	}
+	for _, token := range auth.Tokens {
+		for _, rule := range slices.Concat(token.Allow, token.Deny) {
+			if strings.HasPrefix(rule, wechatdb.LabelPrefix) {
+				return fmt.Errorf("auth token %q: rule %q is not supported on %s v%d, label rules require WeChat for Windows 3.x", token.Name, rule, platform, version)
+			}
+		}
+	}
+	return nil
+}
+
+// requestToken 从 Authorization 请求头或 token 查询参数中获取 Token
+func requestToken(c *gin.Context) string {
+	if h := c.GetHeader("Authorization"); h != "" {
+		if token, ok := strings.CutPrefix(h, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return c.Query(TokenQuery)
+}
+
+func findToken(tokens []*conf.AuthToken, value string) *conf.AuthToken {
+	if value == "" {
+		return nil
+	}
+	var found *conf.AuthToken
+	for _, token := range tokens {
+		if token.Token == "" {
+			continue
+		}
+		// 逐个使用常量时间比较，避免通过响应时间猜测 Token
+		if subtle.ConstantTimeCompare([]byte(token.Token), []byte(value)) == 1 && found == nil {
+			found = token
+		}
+	}
+	return found
+}
+
+// HasScope 判断 Token 是否有权访问 scope，未配置范围时可访问全部
+func HasScope(token *conf.AuthToken, scope string) bool {
+	if len(token.Scopes) == 0 {
+		return true
+	}
+	return slices.Contains(token.Scopes, ScopeAll) || slices.Contains(token.Scopes, scope)
+}
+
+// checkAuthConfig 监听非本机地址且未配置 Token 时提示风险
+func (s *Service) checkAuthConfig() {
+	auth := s.conf.GetAuth()
+	if auth != nil && len(auth.Tokens) > 0 {
+		return
+	}
+	host, _, err := net.SplitHostPort(s.conf.GetHTTPAddr())
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return
+	}
+	log.Warn().Msgf("HTTP server listens on %s without auth tokens, chat history is accessible to anyone on the network", s.conf.GetHTTPAddr())
+}
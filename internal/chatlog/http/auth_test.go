@@ -0,0 +1,124 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+)
+
+type testConfig struct {
+	auth *conf.Auth
+}
+
+func (c *testConfig) GetHTTPAddr() string       { return "127.0.0.1:5030" }
+func (c *testConfig) GetDataDir() string        { return "" }
+func (c *testConfig) GetAuth() *conf.Auth       { return c.auth }
+func (c *testConfig) GetRedact() *conf.Redact   { return nil }
+func (c *testConfig) GetHTTPTLS() *conf.TLS     { return nil }
+func (c *testConfig) GetHTTPSocketMode() string { return conf.DefaultHTTPSocketMode }
+func (c *testConfig) GetWorkDir() string        { return "" }
+
+func TestAuthMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := &Service{conf: &testConfig{auth: &conf.Auth{
+		Tokens: []*conf.AuthToken{
+			{Name: "dashboard", Token: "read-token", Scopes: []string{ScopeRead}},
+			{Name: "admin", Token: "admin-token"},
+		},
+		CORSOrigins: []string{"https://example.com"},
+	}}}
+
+	router := gin.New()
+	router.Use(s.corsMiddleware())
+	router.GET("/api", s.authMiddleware(ScopeRead), func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/mcp", s.authMiddleware(ScopeMCP), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		path   string
+		header string
+		origin string
+		code   int
+		cors   string
+	}{
+		{"/api", "", "", http.StatusUnauthorized, ""},
+		{"/api", "Bearer wrong", "", http.StatusUnauthorized, ""},
+		{"/api", "Bearer read-token", "https://example.com", http.StatusOK, "https://example.com"},
+		{"/api?token=read-token", "", "https://evil.com", http.StatusOK, ""},
+		{"/mcp", "Bearer read-token", "", http.StatusForbidden, ""},
+		{"/mcp", "Bearer admin-token", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.code {
+			t.Errorf("%s %q: got %d, want %d", tt.path, tt.header, w.Code, tt.code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.cors {
+			t.Errorf("%s %q: got allow origin %q, want %q", tt.path, tt.header, got, tt.cors)
+		}
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := &Service{conf: &testConfig{auth: &conf.Auth{CORSOrigins: []string{"https://example.com", "*"}}}}
+	router := gin.New()
+	router.Use(s.corsMiddleware())
+	router.GET("/api", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	req := httptest.NewRequest(http.MethodGet, "/api", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("got allow origin %q, want *", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("wildcard origin should not allow credentials, got %q", got)
+	}
+}
+
+func TestMaskQueryToken(t *testing.T) {
+	for path, want := range map[string]string{
+		"/api/v1/session":                      "/api/v1/session",
+		"/api/v1/stream?token=secret":          "/api/v1/stream?token=***",
+		"/image/abc?info=1&token=secret&x=2":   "/image/abc?info=1&token=***&x=2",
+		"/api/v1/chatlog?tokens=a&talker=wxid": "/api/v1/chatlog?tokens=a&talker=wxid",
+	} {
+		if got := maskQueryToken(path); got != want {
+			t.Errorf("maskQueryToken(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestCheckAuthPolicy(t *testing.T) {
+	auth := &conf.Auth{Tokens: []*conf.AuthToken{
+		{Name: "bot", Token: "a", Deny: []string{"wxid_a"}},
+		{Name: "family", Token: "b", Allow: []string{"label:家人"}},
+	}}
+	if err := CheckAuthPolicy(auth, "windows", 3); err != nil {
+		t.Errorf("label rules should be accepted on windows v3: %v", err)
+	}
+	for _, v := range []struct {
+		platform string
+		version  int
+	}{{"windows", 4}, {"darwin", 3}, {"darwin", 4}} {
+		if err := CheckAuthPolicy(auth, v.platform, v.version); err == nil {
+			t.Errorf("expected label rules to be rejected on %s v%d", v.platform, v.version)
+		}
+	}
+	if err := CheckAuthPolicy(&conf.Auth{Tokens: auth.Tokens[:1]}, "darwin", 4); err != nil {
+		t.Errorf("unexpected error without label rules: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+)
+
+const (
+	// UnixPrefix 监听地址以该前缀开头时使用 Unix domain socket
+	UnixPrefix = "unix:"
+
+	// SelfSignedCertFile 自签名证书保存在工作目录中的文件名
+	SelfSignedCertFile = "chatlog_cert.pem"
+	SelfSignedKeyFile  = "chatlog_key.pem"
+
+	// SelfSignedValidity 自签名证书有效期，过期后重新生成
+	SelfSignedValidity = 365 * 24 * time.Hour
+)
+
+// listen 根据监听地址创建 TCP 或 Unix domain socket 监听
+func (s *Service) listen() (net.Listener, error) {
+	addr := s.conf.GetHTTPAddr()
+	path, ok := strings.CutPrefix(addr, UnixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	path = strings.TrimPrefix(path, "//")
+	mode, err := strconv.ParseUint(s.conf.GetHTTPSocketMode(), 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http socket mode %q: %w", s.conf.GetHTTPSocketMode(), err)
+	}
+
+	// 清理上次未正常退出时残留的 socket 文件，仍有进程监听时不覆盖
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+
+	// 先在权限为 0700 的临时目录中创建 socket 并设置权限，再移动到监听路径，
+	// 避免 socket 在设置权限前被其他用户连接
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".chatlog-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmpPath := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &unixListener{Listener: ln, path: path}, nil
+}
+
+// unixListener 关闭时删除 socket 文件
+type unixListener struct {
+	net.Listener
+	path string
+	once sync.Once
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// tlsFiles 返回 HTTPS 使用的证书与私钥文件，未开启 HTTPS 时返回空
+func (s *Service) tlsFiles() (certFile, keyFile string, err error) {
+	tlsConf := s.conf.GetHTTPTLS()
+	if !tlsConf.Enabled() {
+		return "", "", nil
+	}
+	if tlsConf.CertFile != "" && tlsConf.KeyFile != "" {
+		return tlsConf.CertFile, tlsConf.KeyFile, nil
+	}
+
+	workDir := s.conf.GetWorkDir()
+	if workDir == "" {
+		return "", "", fmt.Errorf("work dir is required for self-signed certificate")
+	}
+	certFile = filepath.Join(workDir, SelfSignedCertFile)
+	keyFile = filepath.Join(workDir, SelfSignedKeyFile)
+	if validCert(certFile, keyFile) {
+		return certFile, keyFile, nil
+	}
+
+	log.Info().Msgf("generate self-signed certificate %s", certFile)
+	if err := GenerateSelfSigned(certFile, keyFile, certHosts(s.conf.GetHTTPAddr())); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// validCert 判断证书是否存在且仍在有效期内
+func validCert(certFile, keyFile string) bool {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return false
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	return time.Now().Add(24 * time.Hour).Before(leaf.NotAfter)
+}
+
+// certHosts 返回自签名证书包含的主机名与 IP
+func certHosts(addr string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// GenerateSelfSigned 生成 ECDSA P-256 自签名证书，私钥文件权限为 0600
+func GenerateSelfSigned(certFile, keyFile string, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{conf.AppName}, CommonName: conf.AppName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(SelfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
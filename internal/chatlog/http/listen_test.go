@@ -0,0 +1,127 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+)
+
+type listenConfig struct {
+	testConfig
+	addr    string
+	tls     *conf.TLS
+	workDir string
+}
+
+func (c *listenConfig) GetHTTPAddr() string   { return c.addr }
+func (c *listenConfig) GetHTTPTLS() *conf.TLS { return c.tls }
+func (c *listenConfig) GetWorkDir() string    { return c.workDir }
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chatlog.sock")
+	s := &Service{conf: &listenConfig{addr: UnixPrefix + path}}
+
+	ln, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("got mode %o, want 0600", fi.Mode().Perm())
+	}
+
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://chatlog/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %d, want 200", resp.StatusCode)
+	}
+
+	// 正在使用的 socket 不会被覆盖
+	if ln2, err := s.listen(); err == nil {
+		ln2.Close()
+		t.Error("expected error when socket is in use")
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("unexpected files left in socket dir: %v", entries)
+	}
+
+	// 关闭后删除 socket 文件
+	ln.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed after close: %v", err)
+	}
+}
+
+func TestSelfSignedTLSFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := &Service{conf: &listenConfig{addr: "127.0.0.1:5030", tls: &conf.TLS{SelfSigned: true}, workDir: dir}}
+
+	certFile, keyFile, err := s.tlsFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validCert(certFile, keyFile) {
+		t.Fatal("generated certificate is invalid")
+	}
+	fi, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("got key mode %o, want 0600", fi.Mode().Perm())
+	}
+
+	// 证书有效时复用
+	before, _ := os.ReadFile(certFile)
+	if _, _, err := s.tlsFiles(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.ReadFile(certFile)
+	if string(before) != string(after) {
+		t.Error("valid certificate was regenerated")
+	}
+}
+
+func TestListenUnixStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chatlog.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := &Service{conf: &listenConfig{addr: UnixPrefix + path}}
+	ln, err := s.listen()
+	if err != nil {
+		t.Fatalf("stale socket should be replaced: %v", err)
+	}
+	ln.Close()
+
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := s.listen(); err == nil {
+		ln.Close()
+		t.Error("expected error when path is a regular file")
+	}
+}
@@ -18,11 +18,14 @@ import (
 )
 
 func (s *Service) initMCPServer() {
-	s.mcpServer = server.NewMCPServer(conf.AppName, version.Version)
+	s.mcpServer = server.NewMCPServer(conf.AppName, version.Version, server.WithToolHandlerMiddleware(mcpMetricsMiddleware))
 	s.mcpServer.AddTool(ContactTool, s.handleMCPContact)
 	s.mcpServer.AddTool(ChatRoomTool, s.handleMCPChatRoom)
 	s.mcpServer.AddTool(RecentChatTool, s.handleMCPRecentChat)
 	s.mcpServer.AddTool(ChatLogTool, s.handleMCPChatLog)
+	s.mcpServer.AddTool(SearchChatLogTool, s.handleMCPSearchChatLog)
+	s.mcpServer.AddTool(ChatContextTool, s.handleMCPChatContext)
+	s.mcpServer.AddTool(ChatStatsTool, s.handleMCPChatStats)
 	s.mcpServer.AddTool(CurrentTimeTool, s.handleMCPCurrentTime)
 	s.mcpSSEServer = server.NewSSEServer(s.mcpServer)
 	s.mcpStreamableServer = server.NewStreamableHTTPServer(s.mcpServer)
@@ -63,6 +66,7 @@ var ChatLogTool = mcp.NewTool(
 - 每次独立查询必须移除sender参数
 - 每次独立查询使用"Tn前后15-30分钟"的窄范围
 - 每次独立查询仅保留talker参数
+- 如果已知消息序号(seq)，可以改用 query_chat_context 工具直接获取该消息前后的上下文
 
 步骤3: 【必须执行】综合分析所有上下文
 - 必须等待所有步骤2的查询结果返回后再进行分析
@@ -143,6 +147,37 @@ var ChatLogTool = mcp.NewTool(
 4. 正确示例：对每个时间点T分别执行查询"T前后15-30分钟"（不带keyword）`)),
 )
 
+var SearchChatLogTool = mcp.NewTool(
+	"search_chat_log",
+	mcp.WithDescription(`在所有会话中搜索包含关键词的聊天记录，无需指定对话方。当用户询问"谁提到过某事"、"哪个群讨论过某个话题"等不确定具体对话方的问题时使用此工具。
+返回结果按会话分组，包含命中总数、每个会话的命中数量，以及每条命中消息的发送者、时间、序号(seq)和内容片段，命中内容使用<em></em>标记。
+如需了解命中消息的上下文，可以使用 query_chat_context 工具，指定对应的 talker 和命中消息的 seq 进行查询。`),
+	mcp.WithString("time", mcp.Description(`指定查询的时间范围，格式与 query_chat_log 工具相同，如"2023-04-01~2023-04-30"、"last-30d"。查询所有时间使用"all"`), mcp.Required()),
+	mcp.WithString("keyword", mcp.Description(`搜索内容中的关键词，支持正则表达式匹配`), mcp.Required()),
+	mcp.WithString("talker", mcp.Description(`可选，限定搜索的对话方，多个对话方用","分隔。为空时搜索所有会话`)),
+	mcp.WithString("sender", mcp.Description(`可选，限定消息发送者，多个发送者用","分隔`)),
+	mcp.WithNumber("limit", mcp.Description(`可选，返回的命中消息数量，默认为 50`)),
+	mcp.WithNumber("offset", mcp.Description(`可选，分页偏移量，用于获取后续结果`)),
+)
+
+var ChatContextTool = mcp.NewTool(
+	"query_chat_context",
+	mcp.WithDescription(`获取指定消息前后的上下文聊天记录，不受消息之间时间间隔的限制。当通过 search_chat_log 工具找到命中消息后，需要了解完整对话时使用此工具。
+返回指定消息之前 before 条、之后 after 条消息（包含指定消息本身），按时间顺序排列，指定消息使用">>>"标记。`),
+	mcp.WithString("talker", mcp.Description(`消息所在的对话方（联系人或群组），可使用ID、昵称或备注名，只能指定一个对话方`), mcp.Required()),
+	mcp.WithNumber("seq", mcp.Description(`消息序号，即 search_chat_log 工具返回结果中的 seq`), mcp.Required()),
+	mcp.WithNumber("before", mcp.Description(`可选，获取指定消息之前的消息数量，默认为 10`)),
+	mcp.WithNumber("after", mcp.Description(`可选，获取指定消息之后的消息数量，默认为 10`)),
+)
+
+var ChatStatsTool = mcp.NewTool(
+	"query_chat_stats",
+	mcp.WithDescription(`统计指定对话方在时间范围内的聊天记录，返回消息总数、首条和末条消息时间、每个发送者的消息数量、各消息类型数量、图片视频等媒体数量、按小时的时段分布以及每日消息数量。
+当用户询问"群里谁最活跃"、"这个群什么时候最热闹"、"我们聊了多少条消息"等统计类问题时使用此工具，无需逐条查询聊天记录。`),
+	mcp.WithString("talker", mcp.Description(`指定对话方（联系人或群组），可使用ID、昵称或备注名`), mcp.Required()),
+	mcp.WithString("time", mcp.Description(`可选，统计的时间范围，格式与 query_chat_log 工具相同，如"2023-04-01~2023-04-30"、"last-30d"，默认统计所有时间`)),
+)
+
 var CurrentTimeTool = mcp.NewTool(
 	"current_time",
 	mcp.WithDescription(`获取当前系统时间，返回RFC3339格式的时间字符串（包含用户本地时区信息）。
@@ -168,7 +203,7 @@ func (s *Service) handleMCPContact(ctx context.Context, request mcp.CallToolRequ
 		return errors.ErrMCPTool(err), nil
 	}
 
-	list, err := s.db.GetContacts(req.Keyword, req.Limit, req.Offset)
+	list, err := s.db.GetContacts(ctx, req.Keyword, req.Limit, req.Offset)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get contacts")
 		return errors.ErrMCPTool(err), nil
@@ -203,7 +238,7 @@ func (s *Service) handleMCPChatRoom(ctx context.Context, request mcp.CallToolReq
 		return errors.ErrMCPTool(err), nil
 	}
 
-	list, err := s.db.GetChatRooms(req.Keyword, req.Limit, req.Offset)
+	list, err := s.db.GetChatRooms(ctx, req.Keyword, req.Limit, req.Offset)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get chat rooms")
 		return errors.ErrMCPTool(err), nil
@@ -238,7 +273,7 @@ func (s *Service) handleMCPRecentChat(ctx context.Context, request mcp.CallToolR
 		return errors.ErrMCPTool(err), nil
 	}
 
-	data, err := s.db.GetSessions(req.Keyword, req.Limit, req.Offset)
+	data, err := s.db.GetSessions(ctx, req.Keyword, req.Limit, req.Offset)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get sessions")
 		return errors.ErrMCPTool(err), nil
@@ -291,7 +326,7 @@ func (s *Service) handleMCPChatLog(ctx context.Context, request mcp.CallToolRequ
 		req.Offset = 0
 	}
 
-	messages, err := s.db.GetMessages(start, end, req.Talker, req.Sender, req.Keyword, req.Limit, req.Offset)
+	messages, err := s.db.GetMessages(ctx, start, end, req.Talker, req.Sender, req.Keyword, req.Limit, req.Offset)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to get messages")
 		return errors.ErrMCPTool(err), nil
@@ -316,6 +351,144 @@ func (s *Service) handleMCPChatLog(ctx context.Context, request mcp.CallToolRequ
 	}, nil
 }
 
+type SearchChatLogRequest struct {
+	Time    string `json:"time"`
+	Talker  string `json:"talker"`
+	Sender  string `json:"sender"`
+	Keyword string `json:"keyword"`
+	Limit   int    `json:"limit"`
+	Offset  int    `json:"offset"`
+}
+
+func (s *Service) handleMCPSearchChatLog(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+
+	var req SearchChatLogRequest
+	if err := request.BindArguments(&req); err != nil {
+		log.Error().Err(err).Msg("Failed to bind arguments")
+		log.Error().Interface("request", request.GetRawArguments()).Msg("Failed to bind arguments")
+		return errors.ErrMCPTool(err), nil
+	}
+
+	start, end, ok := util.TimeRangeOf(req.Time)
+	if !ok {
+		return errors.ErrMCPTool(errors.InvalidArg("time")), nil
+	}
+	if req.Limit <= 0 {
+		req.Limit = 50
+	}
+
+	if req.Offset < 0 {
+		req.Offset = 0
+	}
+
+	resp, err := s.db.SearchMessages(ctx, start, end, req.Talker, req.Sender, req.Keyword, req.Limit, req.Offset)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to search messages")
+		return errors.ErrMCPTool(err), nil
+	}
+
+	text := "未找到符合查询条件的聊天记录"
+	if resp.Total > 0 {
+		text = resp.PlainText(util.PerfectTimeFormat(start, end))
+	}
+
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{
+			mcp.TextContent{
+				Type: "text",
+				Text: text,
+			},
+		},
+	}, nil
+}
+
+type ChatContextRequest struct {
+	Talker string `json:"talker"`
+	Seq    int64  `json:"seq"`
+	Before *int   `json:"before"`
+	After  *int   `json:"after"`
+}
+
+func (s *Service) handleMCPChatContext(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+
+	var req ChatContextRequest
+	if err := request.BindArguments(&req); err != nil {
+		log.Error().Err(err).Msg("Failed to bind arguments")
+		log.Error().Interface("request", request.GetRawArguments()).Msg("Failed to bind arguments")
+		return errors.ErrMCPTool(err), nil
+	}
+
+	before, after := DefaultContextSize, DefaultContextSize
+	if req.Before != nil {
+		before = max(0, min(*req.Before, MaxContextSize))
+	}
+	if req.After != nil {
+		after = max(0, min(*req.After, MaxContextSize))
+	}
+
+	messages, err := s.db.GetMessageContext(ctx, req.Talker, req.Seq, before, after)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get message context")
+		return errors.ErrMCPTool(err), nil
+	}
+
+	buf := &bytes.Buffer{}
+	for _, m := range messages {
+		if m.Seq == req.Seq {
+			buf.WriteString(">>> ")
+		}
+		buf.WriteString(m.PlainText(false, "2006-01-02 15:04:05", ""))
+		buf.WriteString("\n")
+	}
+
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{
+			mcp.TextContent{
+				Type: "text",
+				Text: buf.String(),
+			},
+		},
+	}, nil
+}
+
+type ChatStatsRequest struct {
+	Talker string `json:"talker"`
+	Time   string `json:"time"`
+}
+
+func (s *Service) handleMCPChatStats(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+
+	var req ChatStatsRequest
+	if err := request.BindArguments(&req); err != nil {
+		log.Error().Err(err).Msg("Failed to bind arguments")
+		log.Error().Interface("request", request.GetRawArguments()).Msg("Failed to bind arguments")
+		return errors.ErrMCPTool(err), nil
+	}
+
+	if req.Time == "" {
+		req.Time = "all"
+	}
+	start, end, ok := util.TimeRangeOf(req.Time)
+	if !ok {
+		return errors.ErrMCPTool(errors.InvalidArg("time")), nil
+	}
+
+	stats, err := s.db.GetMessageStats(ctx, start, end, req.Talker)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get message stats")
+		return errors.ErrMCPTool(err), nil
+	}
+
+	return &mcp.CallToolResult{
+		Content: []mcp.Content{
+			mcp.TextContent{
+				Type: "text",
+				Text: stats.PlainText(),
+			},
+		},
+	}, nil
+}
+
 func (s *Service) handleMCPCurrentTime(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 	return &mcp.CallToolResult{
 		Content: []mcp.Content{
@@ -0,0 +1,65 @@
+package http
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+
+	"github.com/sjzar/chatlog/internal/chatlog/database"
+	"github.com/sjzar/chatlog/pkg/metrics"
+)
+
+var (
+	httpRequests = metrics.NewCounter("chatlog_http_requests_total", "HTTP requests by route, method and status code.", "route", "method", "code")
+	httpDuration = metrics.NewHistogram("chatlog_http_request_duration_seconds", "HTTP request latency by route.", nil, "route")
+	mcpCalls     = metrics.NewCounter("chatlog_mcp_tool_calls_total", "MCP tool calls by tool and status.", "tool", "status")
+	mcpDuration  = metrics.NewHistogram("chatlog_mcp_tool_duration_seconds", "MCP tool call latency by tool.", nil, "tool")
+	dbState      = metrics.NewGauge("chatlog_database_state", "Current database service state, 1 for the active state.", "state")
+)
+
+// metricsMiddleware 记录各接口的请求数与耗时，使用路由模板作为标签避免路径参数导致指标过多
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.With(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.With(route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// mcpMetricsMiddleware 记录各 MCP 工具的调用次数与耗时
+func mcpMetricsMiddleware(next server.ToolHandlerFunc) server.ToolHandlerFunc {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		start := time.Now()
+		result, err := next(ctx, request)
+
+		status := "success"
+		if err != nil || (result != nil && result.IsError) {
+			status = "error"
+		}
+		mcpCalls.With(request.Params.Name, status).Inc()
+		mcpDuration.With(request.Params.Name).Observe(time.Since(start).Seconds())
+		return result, err
+	}
+}
+
+// handleMetrics 以 Prometheus 文本格式输出指标
+func (s *Service) handleMetrics(c *gin.Context) {
+	for state, name := range database.StateNames {
+		value := 0.0
+		if s.db.State == state {
+			value = 1
+		}
+		dbState.With(name).Set(value)
+	}
+	metrics.Handler().ServeHTTP(c.Writer, c.Request)
+}
@@ -1,18 +1,46 @@
 package http
 
 import (
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sjzar/chatlog/internal/chatlog/database"
 )
 
-func corsMiddleware() gin.HandlerFunc {
+// corsOrigins 返回允许跨域访问的来源，为空时允许所有来源
+func (s *Service) corsOrigins() []string {
+	if auth := s.conf.GetAuth(); auth != nil {
+		return auth.CORSOrigins
+	}
+	return nil
+}
+
+// originAllowed 判断来源是否允许跨域访问
+func (s *Service) originAllowed(origin string) bool {
+	origins := s.corsOrigins()
+	return len(origins) == 0 || slices.Contains(origins, "*") || slices.Contains(origins, origin)
+}
+
+// corsMiddleware 设置跨域访问响应头，未配置允许的来源时允许所有来源
+func (s *Service) corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+		origins := s.corsOrigins()
+		if len(origins) == 0 || slices.Contains(origins, "*") {
+			// 允许所有来源时不允许携带凭据
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Writer.Header().Add("Vary", "Origin")
+			origin := c.GetHeader("Origin")
+			if origin != "" && slices.Contains(origins, origin) {
+				c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+				c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, X-CSRF-Token")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, X-CSRF-Token, Last-Event-ID, Mcp-Session-Id")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -43,3 +71,31 @@ func (s *Service) checkDBStateMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// logFormatter 与 gin 默认日志格式一致，查询参数中的 Token 替换为 ***
+func logFormatter(p gin.LogFormatterParams) string {
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		p.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		p.StatusCode,
+		p.Latency,
+		p.ClientIP,
+		p.Method,
+		maskQueryToken(p.Path),
+		p.ErrorMessage,
+	)
+}
+
+// maskQueryToken 隐藏请求路径中 token 查询参数的值
+func maskQueryToken(path string) string {
+	base, query, ok := strings.Cut(path, "?")
+	if !ok {
+		return path
+	}
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		if key, _, _ := strings.Cut(param, "="); key == TokenQuery {
+			params[i] = TokenQuery + "=***"
+		}
+	}
+	return base + "?" + strings.Join(params, "&")
+}
@@ -3,16 +3,25 @@ package http
 import (
 	"embed"
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io/fs"
+	"iter"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
 
+	"github.com/sjzar/chatlog/internal/chatlog/database"
+	"github.com/sjzar/chatlog/internal/chatlog/export"
 	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
 	"github.com/sjzar/chatlog/pkg/util"
 	"github.com/sjzar/chatlog/pkg/util/dat2img"
 	"github.com/sjzar/chatlog/pkg/util/silk"
@@ -41,37 +50,65 @@ func (s *Service) initBaseRouter() {
 		ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
 
+	s.router.GET("/metrics", s.authMiddleware(ScopeMetrics), s.handleMetrics)
+
 	s.router.NoRoute(s.NoRoute)
 }
 
 func (s *Service) initMediaRouter() {
-	s.router.GET("/image/*key", func(c *gin.Context) { s.handleMedia(c, "image") })
-	s.router.GET("/video/*key", func(c *gin.Context) { s.handleMedia(c, "video") })
-	s.router.GET("/file/*key", func(c *gin.Context) { s.handleMedia(c, "file") })
-	s.router.GET("/voice/*key", func(c *gin.Context) { s.handleMedia(c, "voice") })
-	s.router.GET("/data/*path", s.handleMediaData)
+	media := s.router.Group("", s.authMiddleware(ScopeMedia))
+	{
+		media.GET("/image/*key", func(c *gin.Context) { s.handleMedia(c, "image") })
+		media.GET("/video/*key", func(c *gin.Context) { s.handleMedia(c, "video") })
+		media.GET("/file/*key", func(c *gin.Context) { s.handleMedia(c, "file") })
+		media.GET("/voice/*key", func(c *gin.Context) { s.handleMedia(c, "voice") })
+		media.GET("/data/*path", s.handleMediaData)
+	}
 }
 
 func (s *Service) initAPIRouter() {
-	api := s.router.Group("/api/v1", s.checkDBStateMiddleware())
+	api := s.router.Group("/api/v1", s.authMiddleware(ScopeRead), s.checkDBStateMiddleware())
 	{
 		api.GET("/chatlog", s.handleChatlog)
+		api.GET("/chatlog/context", s.handleChatlogContext)
+		api.GET("/search", s.handleSearch)
+		api.GET("/export", s.handleExport)
+		api.GET("/stats", s.handleStats)
 		api.GET("/contact", s.handleContacts)
 		api.GET("/chatroom", s.handleChatRooms)
 		api.GET("/session", s.handleSessions)
+		api.GET("/stream", s.handleStream)
+		api.GET("/stream/ws", s.handleStreamWebSocket)
+		api.GET("/changes", s.handleChanges)
+	}
+
+	// 状态接口在解密期间也可访问，不检查数据库状态
+	status := s.router.Group("/api/v1", s.authMiddleware(ScopeRead))
+	{
+		status.GET("/status", s.handleStatus)
+	}
+
+	admin := s.router.Group("/api/v1", s.authMiddleware(ScopeAdmin), s.checkDBStateMiddleware())
+	{
+		admin.GET("/webhook/deadletter", s.handleWebhookDeadLetters)
+		admin.POST("/webhook/deadletter/:id/retry", s.handleRetryWebhookDeadLetter)
+		admin.DELETE("/webhook/deadletter/:id", s.handleDeleteWebhookDeadLetter)
 	}
 }
 
 func (s *Service) initMCPRouter() {
-	s.router.Any("/mcp", func(c *gin.Context) {
-		s.mcpStreamableServer.ServeHTTP(c.Writer, c.Request)
-	})
-	s.router.Any("/sse", func(c *gin.Context) {
-		s.mcpSSEServer.ServeHTTP(c.Writer, c.Request)
-	})
-	s.router.Any("/message", func(c *gin.Context) {
-		s.mcpSSEServer.ServeHTTP(c.Writer, c.Request)
-	})
+	mcp := s.router.Group("", s.authMiddleware(ScopeMCP))
+	{
+		mcp.Any("/mcp", func(c *gin.Context) {
+			s.mcpStreamableServer.ServeHTTP(c.Writer, c.Request)
+		})
+		mcp.Any("/sse", func(c *gin.Context) {
+			s.mcpSSEServer.ServeHTTP(c.Writer, c.Request)
+		})
+		mcp.Any("/message", func(c *gin.Context) {
+			s.mcpSSEServer.ServeHTTP(c.Writer, c.Request)
+		})
+	}
 }
 
 // NoRoute handles 404 Not Found errors. If the request URL starts with "/api"
@@ -90,13 +127,15 @@ func (s *Service) NoRoute(c *gin.Context) {
 func (s *Service) handleChatlog(c *gin.Context) {
 
 	q := struct {
-		Time    string `form:"time"`
-		Talker  string `form:"talker"`
-		Sender  string `form:"sender"`
-		Keyword string `form:"keyword"`
-		Limit   int    `form:"limit"`
-		Offset  int    `form:"offset"`
-		Format  string `form:"format"`
+		Time      string `form:"time"`
+		Talker    string `form:"talker"`
+		Sender    string `form:"sender"`
+		Keyword   string `form:"keyword"`
+		Limit     int    `form:"limit"`
+		Offset    int    `form:"offset"`
+		Cursor    string `form:"cursor"`
+		Direction string `form:"direction"`
+		Format    string `form:"format"`
 	}{}
 
 	if err := c.BindQuery(&q); err != nil {
@@ -108,6 +147,7 @@ func (s *Service) handleChatlog(c *gin.Context) {
 	start, end, ok := util.TimeRangeOf(q.Time)
 	if !ok {
 		errors.Err(c, errors.InvalidArg("time"))
+		return
 	}
 	if q.Limit < 0 {
 		q.Limit = 0
@@ -117,7 +157,172 @@ func (s *Service) handleChatlog(c *gin.Context) {
 		q.Offset = 0
 	}
 
-	messages, err := s.db.GetMessages(start, end, q.Talker, q.Sender, q.Keyword, q.Limit, q.Offset)
+	// 传入 cursor 或 direction 参数时使用游标分页
+	_, useCursor := c.GetQuery("cursor")
+	if useCursor || q.Direction != "" {
+		s.handleChatlogByCursor(c, start, end, q.Talker, q.Sender, q.Keyword, q.Cursor, q.Direction, q.Limit, q.Format)
+		return
+	}
+
+	if strings.ToLower(q.Format) == "json" {
+		messages, err := s.db.GetMessages(c.Request.Context(), start, end, q.Talker, q.Sender, q.Keyword, q.Limit, q.Offset)
+		if err != nil {
+			errors.Err(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, messages)
+		return
+	}
+
+	// 其他格式流式输出，不在内存中保留全部消息
+	messages, err := s.db.IterMessages(c.Request.Context(), start, end, q.Talker, q.Sender, q.Keyword)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	s.writeMessages(c, q.Format, q.Talker, start, end, model.LimitMessages(messages, q.Limit, q.Offset))
+}
+
+// writeMessages 按 format 逐条输出消息，支持 csv、jsonl、markdown 和纯文本
+func (s *Service) writeMessages(c *gin.Context, format string, talker string, start, end time.Time, messages iter.Seq2[*model.Message, error]) {
+	showTalker := strings.Contains(talker, ",")
+
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+
+	var write func(m *model.Message) error
+	switch strings.ToLower(format) {
+	case "csv":
+		c.Writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		c.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s_%s_%s.csv", talker, start.Format("2006-01-02"), end.Format("2006-01-02")))
+
+		csvWriter := csv.NewWriter(c.Writer)
+		csvWriter.Write([]string{"Time", "SenderName", "Sender", "TalkerName", "Talker", "Content"})
+		write = func(m *model.Message) error {
+			csvWriter.Write(m.CSV(c.Request.Host))
+			csvWriter.Flush()
+			return csvWriter.Error()
+		}
+	case "jsonl":
+		c.Writer.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+
+		enc := json.NewEncoder(c.Writer)
+		write = func(m *model.Message) error {
+			return enc.Encode(m)
+		}
+	case "markdown", "md":
+		// 多个会话时在消息中标注会话名称
+		c.Writer.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+
+		title := ""
+		if showTalker {
+			title = "聊天记录"
+		}
+		enc := export.NewMarkdownEncoder(c.Writer, title, c.Request.Host, showTalker)
+		write = enc.Encode
+	default:
+		// plain text
+		c.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		timeFormat := util.PerfectTimeFormat(start, end)
+		write = func(m *model.Message) error {
+			_, err := c.Writer.WriteString(m.PlainText(showTalker, timeFormat, c.Request.Host) + "\n")
+			return err
+		}
+	}
+	c.Writer.Flush()
+
+	for m, err := range messages {
+		if err != nil {
+			// 响应头已发送，中断连接使客户端能发现结果不完整
+			log.Err(err).Msg("read messages failed")
+			c.Abort()
+			panic(http.ErrAbortHandler)
+		}
+		if err := write(m); err != nil {
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+// DefaultCursorLimit 游标分页默认每页消息数量
+const DefaultCursorLimit = 100
+
+func (s *Service) handleChatlogByCursor(c *gin.Context, start, end time.Time, talker, sender, keyword, cursorStr, direction string, limit int, format string) {
+
+	var prev bool
+	switch strings.ToLower(direction) {
+	case "", "next":
+	case "prev":
+		prev = true
+	default:
+		errors.Err(c, errors.InvalidArg("direction"))
+		return
+	}
+
+	cursor, ok := model.ParseCursor(cursorStr, prev)
+	if !ok {
+		errors.Err(c, errors.InvalidArg("cursor"))
+		return
+	}
+	// 显式指定 direction 时覆盖游标中记录的方向
+	if direction != "" {
+		cursor.Prev = prev
+	}
+
+	if limit == 0 {
+		limit = DefaultCursorLimit
+	}
+
+	resp, err := s.db.GetMessagesByCursor(c.Request.Context(), start, end, talker, sender, keyword, cursor, limit)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	if strings.ToLower(format) == "json" {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	c.Writer.Header().Set("X-Next-Cursor", resp.NextCursor)
+	c.Writer.Header().Set("X-Prev-Cursor", resp.PrevCursor)
+	c.Writer.Header().Set("X-Has-More", strconv.FormatBool(resp.HasMore))
+	s.writeMessages(c, format, talker, start, end, model.MessageSeq(resp.Items))
+}
+
+const (
+	// DefaultContextSize 上下文查询默认获取的前后消息数量
+	DefaultContextSize = 10
+	// MaxContextSize 上下文查询最多获取的前后消息数量
+	MaxContextSize = 500
+)
+
+func (s *Service) handleChatlogContext(c *gin.Context) {
+
+	q := struct {
+		Talker string `form:"talker"`
+		Seq    int64  `form:"seq"`
+		Before int    `form:"before,default=10"`
+		After  int    `form:"after,default=10"`
+		Format string `form:"format"`
+	}{}
+
+	if err := c.BindQuery(&q); err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	if _, ok := c.GetQuery("seq"); !ok {
+		errors.Err(c, errors.InvalidArg("seq"))
+		return
+	}
+	q.Before = max(0, min(q.Before, MaxContextSize))
+	q.After = max(0, min(q.After, MaxContextSize))
+
+	messages, err := s.db.GetMessageContext(c.Request.Context(), q.Talker, q.Seq, q.Before, q.After)
 	if err != nil {
 		errors.Err(c, err)
 		return
@@ -126,7 +331,7 @@ func (s *Service) handleChatlog(c *gin.Context) {
 	switch strings.ToLower(q.Format) {
 	case "csv":
 		c.Writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
-		c.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s_%s_%s.csv", q.Talker, start.Format("2006-01-02"), end.Format("2006-01-02")))
+		c.Writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s_%d.csv", q.Talker, q.Seq))
 		c.Writer.Header().Set("Cache-Control", "no-cache")
 		c.Writer.Header().Set("Connection", "keep-alive")
 		c.Writer.Flush()
@@ -148,13 +353,248 @@ func (s *Service) handleChatlog(c *gin.Context) {
 		c.Writer.Flush()
 
 		for _, m := range messages {
-			c.Writer.WriteString(m.PlainText(strings.Contains(q.Talker, ","), util.PerfectTimeFormat(start, end), c.Request.Host))
+			c.Writer.WriteString(m.PlainText(false, "2006-01-02 15:04:05", c.Request.Host))
 			c.Writer.WriteString("\n")
 			c.Writer.Flush()
 		}
 	}
 }
 
+func (s *Service) handleSearch(c *gin.Context) {
+
+	q := struct {
+		Time    string `form:"time"`
+		Talker  string `form:"talker"`
+		Sender  string `form:"sender"`
+		Keyword string `form:"keyword"`
+		Limit   int    `form:"limit"`
+		Offset  int    `form:"offset"`
+		Format  string `form:"format"`
+	}{}
+
+	if err := c.BindQuery(&q); err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	start, end, ok := util.TimeRangeOf(q.Time)
+	if !ok {
+		errors.Err(c, errors.InvalidArg("time"))
+		return
+	}
+	if q.Keyword == "" {
+		errors.Err(c, errors.ErrKeywordEmpty)
+		return
+	}
+	if q.Limit < 0 {
+		q.Limit = 0
+	}
+
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+
+	resp, err := s.db.SearchMessages(c.Request.Context(), start, end, q.Talker, q.Sender, q.Keyword, q.Limit, q.Offset)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	switch strings.ToLower(q.Format) {
+	case "json":
+		// json
+		c.JSON(http.StatusOK, resp)
+	default:
+		// plain text
+		c.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("Connection", "keep-alive")
+		c.Writer.Flush()
+
+		c.Writer.WriteString(resp.PlainText(util.PerfectTimeFormat(start, end)))
+		c.Writer.Flush()
+	}
+}
+
+func (s *Service) handleStats(c *gin.Context) {
+
+	q := struct {
+		Time   string `form:"time"`
+		Talker string `form:"talker"`
+		Format string `form:"format"`
+	}{}
+
+	if err := c.BindQuery(&q); err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	// 未指定时间范围时统计全部聊天记录
+	if q.Time == "" {
+		q.Time = "all"
+	}
+	start, end, ok := util.TimeRangeOf(q.Time)
+	if !ok {
+		errors.Err(c, errors.InvalidArg("time"))
+		return
+	}
+	if q.Talker == "" {
+		errors.Err(c, errors.ErrTalkerEmpty)
+		return
+	}
+
+	stats, err := s.db.GetMessageStats(c.Request.Context(), start, end, q.Talker)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	switch strings.ToLower(q.Format) {
+	case "json":
+		// json
+		c.JSON(http.StatusOK, stats)
+	default:
+		// plain text
+		c.Writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("Connection", "keep-alive")
+		c.Writer.Flush()
+
+		c.Writer.WriteString(stats.PlainText())
+		c.Writer.Flush()
+	}
+}
+
+func (s *Service) handleChanges(c *gin.Context) {
+
+	q := struct {
+		Since string `form:"since"`
+		Limit int    `form:"limit"`
+	}{}
+
+	if err := c.BindQuery(&q); err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	resp, err := s.db.GetChanges(c.Request.Context(), q.Since, q.Limit)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (s *Service) handleStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"database": gin.H{
+			"state":   database.StateNames[s.db.State],
+			"message": s.db.StateMsg,
+		},
+		"decrypt": s.wechat.GetProgress(),
+	})
+}
+
+func (s *Service) handleWebhookDeadLetters(c *gin.Context) {
+
+	q := struct {
+		Limit  int `form:"limit"`
+		Offset int `form:"offset"`
+	}{}
+
+	if err := c.BindQuery(&q); err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	entries, err := s.db.GetWebhookDeadLetters(q.Limit, q.Offset)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": entries})
+}
+
+func (s *Service) handleRetryWebhookDeadLetter(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		errors.Err(c, errors.InvalidArg("id"))
+		return
+	}
+
+	if err := s.db.RetryWebhookDeadLetter(id); err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id})
+}
+
+func (s *Service) handleDeleteWebhookDeadLetter(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		errors.Err(c, errors.InvalidArg("id"))
+		return
+	}
+
+	if err := s.db.DeleteWebhookDeadLetter(id); err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id})
+}
+
+func (s *Service) handleExport(c *gin.Context) {
+
+	q := struct {
+		Time   string `form:"time"`
+		Talker string `form:"talker"`
+		Format string `form:"format"`
+	}{}
+
+	if err := c.BindQuery(&q); err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	// 未指定时间范围时导出全部聊天记录
+	if q.Time == "" {
+		q.Time = "all"
+	}
+	start, end, ok := util.TimeRangeOf(q.Time)
+	if !ok {
+		errors.Err(c, errors.InvalidArg("time"))
+		return
+	}
+	if q.Talker == "" {
+		errors.Err(c, errors.ErrTalkerEmpty)
+		return
+	}
+
+	// 压缩包直接写入响应，开始写入前的错误（如参数错误）仍以 JSON 返回
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s_%s_%s.zip", q.Talker, start.Format("2006-01-02"), end.Format("2006-01-02")))
+	c.Header("Content-Type", "application/zip")
+	zw := export.NewZipWriter(c.Writer)
+	err := export.New(s.conf, s.db).Export(c.Request.Context(), zw, q.Talker, start, end, q.Format)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		if !c.Writer.Written() {
+			c.Writer.Header().Del("Content-Disposition")
+			errors.Err(c, err)
+			return
+		}
+		// 已经开始发送时无法返回错误，中断连接使客户端得到不完整的压缩包
+		log.Err(err).Msgf("failed to export %s", q.Talker)
+		c.Abort()
+		panic(http.ErrAbortHandler)
+	}
+}
+
 func (s *Service) handleContacts(c *gin.Context) {
 
 	q := struct {
@@ -169,7 +609,7 @@ func (s *Service) handleContacts(c *gin.Context) {
 		return
 	}
 
-	list, err := s.db.GetContacts(q.Keyword, q.Limit, q.Offset)
+	list, err := s.db.GetContacts(c.Request.Context(), q.Keyword, q.Limit, q.Offset)
 	if err != nil {
 		errors.Err(c, err)
 		return
@@ -214,7 +654,7 @@ func (s *Service) handleChatRooms(c *gin.Context) {
 		return
 	}
 
-	list, err := s.db.GetChatRooms(q.Keyword, q.Limit, q.Offset)
+	list, err := s.db.GetChatRooms(c.Request.Context(), q.Keyword, q.Limit, q.Offset)
 	if err != nil {
 		errors.Err(c, err)
 		return
@@ -258,7 +698,7 @@ func (s *Service) handleSessions(c *gin.Context) {
 		return
 	}
 
-	sessions, err := s.db.GetSessions(q.Keyword, q.Limit, q.Offset)
+	sessions, err := s.db.GetSessions(c.Request.Context(), q.Keyword, q.Limit, q.Offset)
 	if err != nil {
 		errors.Err(c, err)
 		return
@@ -309,11 +749,11 @@ func (s *Service) handleMedia(c *gin.Context, _type string) {
 	for _, k := range keys {
 		if strings.Contains(k, "/") {
 			if absolutePath, err := s.findPath(_type, k); err == nil {
-				c.Redirect(http.StatusFound, "/data/"+absolutePath)
+				c.Redirect(http.StatusFound, dataURL(c, absolutePath))
 				return
 			}
 		}
-		media, err := s.db.GetMedia(_type, k)
+		media, err := s.db.GetMedia(c.Request.Context(), _type, k)
 		if err != nil {
 			_err = err
 			continue
@@ -327,7 +767,7 @@ func (s *Service) handleMedia(c *gin.Context, _type string) {
 			s.HandleVoice(c, media.Data)
 			return
 		default:
-			c.Redirect(http.StatusFound, "/data/"+media.Path)
+			c.Redirect(http.StatusFound, dataURL(c, media.Path))
 			return
 		}
 	}
@@ -360,8 +800,20 @@ func (s *Service) findPath(_type string, key string) (string, error) {
 	return "", errors.ErrMediaNotFound
 }
 
+// dataURL 返回数据目录中文件的访问地址，通过查询参数携带 Token 时一并保留
+func dataURL(c *gin.Context, path string) string {
+	if token := c.Query(TokenQuery); token != "" {
+		return "/data/" + path + "?" + url.Values{TokenQuery: {token}}.Encode()
+	}
+	return "/data/" + path
+}
+
 func (s *Service) handleMediaData(c *gin.Context) {
 	relativePath := filepath.Clean(c.Param("path"))
+	if !s.db.AllowedMediaPath(c.Request.Context(), relativePath) {
+		errors.Err(c, errors.ErrMediaNotFound)
+		return
+	}
 
 	absolutePath := filepath.Join(s.conf.GetDataDir(), relativePath)
 
@@ -2,6 +2,7 @@ package http
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"time"
 
@@ -9,13 +10,16 @@ import (
 	"github.com/mark3labs/mcp-go/server"
 	"github.com/rs/zerolog/log"
 
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
 	"github.com/sjzar/chatlog/internal/chatlog/database"
+	"github.com/sjzar/chatlog/internal/chatlog/wechat"
 	"github.com/sjzar/chatlog/internal/errors"
 )
 
 type Service struct {
-	conf Config
-	db   *database.Service
+	conf   Config
+	db     *database.Service
+	wechat *wechat.Service
 
 	router *gin.Engine
 	server *http.Server
@@ -28,9 +32,13 @@ type Service struct {
 type Config interface {
 	GetHTTPAddr() string
 	GetDataDir() string
+	GetAuth() *conf.Auth
+	GetHTTPTLS() *conf.TLS
+	GetHTTPSocketMode() string
+	GetWorkDir() string
 }
 
-func NewService(conf Config, db *database.Service) *Service {
+func NewService(conf Config, db *database.Service, wechat *wechat.Service) *Service {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 
@@ -39,53 +47,80 @@ func NewService(conf Config, db *database.Service) *Service {
 		log.Err(err).Msg("Failed to set trusted proxies")
 	}
 
-	// Middleware
-	router.Use(
-		errors.RecoveryMiddleware(),
-		errors.ErrorHandlerMiddleware(),
-		gin.LoggerWithWriter(log.Logger, "/health"),
-		corsMiddleware(),
-	)
-
 	s := &Service{
 		conf:   conf,
 		db:     db,
+		wechat: wechat,
 		router: router,
 	}
 
+	// Middleware
+	router.Use(
+		errors.RecoveryMiddleware(),
+		metricsMiddleware(),
+		errors.ErrorHandlerMiddleware(),
+		gin.LoggerWithConfig(gin.LoggerConfig{Output: log.Logger, SkipPaths: []string{"/health"}, Formatter: logFormatter}),
+		s.corsMiddleware(),
+	)
+
 	s.initMCPServer()
 	s.initRouter()
 	return s
 }
 
 func (s *Service) Start() error {
+	s.checkAuthConfig()
 
-	s.server = &http.Server{
-		Addr:    s.conf.GetHTTPAddr(),
-		Handler: s.router,
+	ln, certFile, keyFile, err := s.prepare()
+	if err != nil {
+		return err
 	}
 
 	go func() {
 		// Handle error from Run
-		if err := s.server.ListenAndServe(); err != nil {
+		if err := s.serve(ln, certFile, keyFile); err != nil && err != http.ErrServerClosed {
 			log.Err(err).Msg("Failed to start HTTP server")
 		}
 	}()
 
-	log.Info().Msg("Starting HTTP server on " + s.conf.GetHTTPAddr())
-
 	return nil
 }
 
 func (s *Service) ListenAndServe() error {
+	s.checkAuthConfig()
+
+	ln, certFile, keyFile, err := s.prepare()
+	if err != nil {
+		return err
+	}
+	return s.serve(ln, certFile, keyFile)
+}
+
+// prepare 创建监听并准备 HTTPS 证书
+func (s *Service) prepare() (net.Listener, string, string, error) {
+	certFile, keyFile, err := s.tlsFiles()
+	if err != nil {
+		return nil, "", "", err
+	}
+	ln, err := s.listen()
+	if err != nil {
+		return nil, "", "", err
+	}
 
 	s.server = &http.Server{
 		Addr:    s.conf.GetHTTPAddr(),
 		Handler: s.router,
 	}
+	return ln, certFile, keyFile, nil
+}
 
+func (s *Service) serve(ln net.Listener, certFile, keyFile string) error {
+	if certFile != "" {
+		log.Info().Msg("Starting HTTPS server on " + s.conf.GetHTTPAddr())
+		return s.server.ServeTLS(ln, certFile, keyFile)
+	}
 	log.Info().Msg("Starting HTTP server on " + s.conf.GetHTTPAddr())
-	return s.server.ListenAndServe()
+	return s.server.Serve(ln)
 }
 
 func (s *Service) Stop() error {
@@ -0,0 +1,331 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/chatlog/database"
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/pkg/util"
+	"github.com/sjzar/chatlog/pkg/websocket"
+)
+
+const (
+	// StreamPingInterval 推送连接的心跳间隔
+	StreamPingInterval = 30 * time.Second
+
+	// StreamCatchUp 使用 Last-Event-ID 恢复时，最多补发的消息时间范围
+	StreamCatchUp = 24 * time.Hour
+
+	// StreamBatchSize 每个会话单次查询的消息数量
+	StreamBatchSize = 500
+
+	// StreamSettleTime 消息写入超过该时间后，认为消息数据库已同步，不再重复扫描
+	StreamSettleTime = time.Minute
+
+	// StreamWriteTimeout 单次推送的写入超时，客户端停止读取时断开连接
+	StreamWriteTimeout = 10 * time.Second
+)
+
+// messageStream 推送订阅后新写入的消息
+// 每个会话分别记录已推送到的位置，消息按 (Seq, Talker) 去重，事件 ID 为最后一条消息的游标
+type messageStream struct {
+	ctx     context.Context
+	db      *database.Service
+	talker  string
+	sender  string
+	keyword string
+	types   []int64
+
+	// 新会话的初始位置
+	cursor *model.Cursor
+	start  time.Time
+
+	cursors map[string]*model.Cursor
+	starts  map[string]time.Time
+}
+
+func (s *Service) newMessageStream(c *gin.Context) (*messageStream, error) {
+	q := struct {
+		Talker      string `form:"talker"`
+		Sender      string `form:"sender"`
+		Keyword     string `form:"keyword"`
+		Type        string `form:"type"`
+		LastEventID string `form:"lastEventId"`
+	}{}
+
+	if err := c.BindQuery(&q); err != nil {
+		return nil, err
+	}
+
+	st := &messageStream{
+		// 整个连接使用同一脱敏范围，推送的化名保持一致
+		ctx:     s.db.WithRedactScope(c.Request.Context()),
+		db:      s.db,
+		talker:  q.Talker,
+		sender:  q.Sender,
+		keyword: q.Keyword,
+		cursor:  &model.Cursor{},
+		start:   time.Now(),
+		cursors: make(map[string]*model.Cursor),
+		starts:  make(map[string]time.Time),
+	}
+
+	if q.Keyword != "" {
+		if _, err := regexp.Compile(q.Keyword); err != nil {
+			return nil, errors.InvalidArg("keyword")
+		}
+	}
+
+	for _, t := range util.Str2List(q.Type, ",") {
+		_type, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return nil, errors.InvalidArg("type")
+		}
+		st.types = append(st.types, _type)
+	}
+
+	// EventSource 断线重连时通过请求头携带 Last-Event-ID，WebSocket 使用查询参数
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = q.LastEventID
+	}
+	if lastEventID != "" {
+		cursor, ok := model.ParseCursor(lastEventID, false)
+		if !ok {
+			return nil, errors.InvalidArg("Last-Event-ID")
+		}
+		st.cursor = cursor
+		st.start = st.start.Add(-StreamCatchUp)
+	}
+
+	return st, nil
+}
+
+// next 查询各会话已推送位置之后的新消息，按 (Seq, Talker) 升序推送
+// 只返回推送时的错误，查询失败时保持连接，等待下次数据库变更后重试
+func (st *messageStream) next(yield func(m *model.Message) error) error {
+	if st.db.State != database.StateReady {
+		return nil
+	}
+
+	for {
+		now := time.Now()
+		talkers, err := st.scanTalkers()
+		if err != nil {
+			log.Debug().Err(err).Msg("get sessions failed")
+			return nil
+		}
+
+		messages := make([]*model.Message, 0)
+		hasMore := false
+		for _, talker := range talkers {
+			cursor, ok := st.cursors[talker]
+			if !ok {
+				cursor = st.cursor
+			}
+			start := st.startOf(talker)
+
+			resp, err := st.db.GetMessagesByCursor(st.ctx, start, now.Add(time.Minute*10), talker, st.sender, st.keyword, cursor, StreamBatchSize)
+			if err != nil {
+				log.Debug().Err(err).Msgf("get messages of %s failed", talker)
+				continue
+			}
+			if len(resp.Items) > 0 {
+				// 消息已脱敏，开启化名时 Talker 被替换，使用脱敏前生成的游标记录位置
+				if next, ok := model.ParseCursor(resp.NextCursor, false); ok {
+					st.cursors[talker] = next
+				}
+				start = resp.Items[len(resp.Items)-1].Time
+				messages = append(messages, resp.Items...)
+			}
+			if resp.HasMore {
+				hasMore = true
+			} else if settled := now.Add(-StreamSettleTime); settled.After(start) {
+				start = settled
+			}
+			st.starts[talker] = start
+		}
+
+		model.SortMessages(messages)
+		for _, m := range messages {
+			if !st.match(m) {
+				continue
+			}
+			if err := yield(m); err != nil {
+				return err
+			}
+		}
+
+		if !hasMore {
+			return nil
+		}
+	}
+}
+
+// scanTalkers 获取需要查询的会话，未指定 talker 时从会话列表中找到有新消息的会话
+func (st *messageStream) scanTalkers() ([]string, error) {
+	if st.talker != "" {
+		return util.Str2List(st.talker, ","), nil
+	}
+
+	// 会话列表仅用于查找会话，不对外输出，使用未脱敏的数据
+	sessions, err := st.db.GetDB().GetSessions(st.ctx, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	talkers := make([]string, 0)
+	for _, session := range sessions.Items {
+		if session.UserName == "" || session.NTime.Before(st.startOf(session.UserName)) {
+			continue
+		}
+		talkers = append(talkers, session.UserName)
+	}
+	return talkers, nil
+}
+
+func (st *messageStream) startOf(talker string) time.Time {
+	if start, ok := st.starts[talker]; ok {
+		return start
+	}
+	return st.start
+}
+
+func (st *messageStream) match(m *model.Message) bool {
+	if len(st.types) == 0 {
+		return true
+	}
+	for _, _type := range st.types {
+		if m.Type == _type {
+			return true
+		}
+	}
+	return false
+}
+
+// handleStream 通过 Server-Sent Events 推送新消息
+func (s *Service) handleStream(c *gin.Context) {
+	stream, err := s.newMessageStream(c)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	notify, cancel := s.db.Subscribe()
+	defer cancel()
+
+	c.Writer.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	c.Writer.Header().Set("Cache-Control", "no-cache")
+	c.Writer.Header().Set("Connection", "keep-alive")
+	c.Writer.Header().Set("X-Accel-Buffering", "no")
+	c.Writer.WriteHeader(http.StatusOK)
+	c.Writer.WriteString("retry: 3000\n\n")
+	c.Writer.Flush()
+
+	rc := http.NewResponseController(c.Writer)
+	send := func(m *model.Message) error {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		rc.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+		if _, err := fmt.Fprintf(c.Writer, "id: %s\nevent: message\ndata: %s\n\n", model.NewCursor(m, false), b); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	s.serveStream(c.Request.Context(), stream, notify, send, func() error {
+		rc.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+		if _, err := c.Writer.WriteString(": ping\n\n"); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+}
+
+// handleStreamWebSocket 通过 WebSocket 推送新消息
+func (s *Service) handleStreamWebSocket(c *gin.Context) {
+	stream, err := s.newMessageStream(c)
+	if err != nil {
+		errors.Err(c, err)
+		return
+	}
+
+	// 浏览器不对 WebSocket 执行跨域检查，需要按允许的来源校验 Origin
+	if origin := c.GetHeader("Origin"); !websocket.SameOrigin(c.Request) && !s.originAllowed(origin) {
+		errors.Err(c, errors.OriginNotAllowed(origin))
+		return
+	}
+
+	conn, err := websocket.Upgrade(c.Writer, c.Request)
+	if err != nil {
+		log.Debug().Err(err).Msg("websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	notify, cancel := s.db.Subscribe()
+	defer cancel()
+
+	// 读取客户端消息以响应 ping 和关闭帧，连接断开时结束推送
+	ctx, stop := context.WithCancel(c.Request.Context())
+	defer stop()
+	go func() {
+		defer stop()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(m *model.Message) error {
+		b, err := json.Marshal(gin.H{"id": model.NewCursor(m, false).String(), "message": m})
+		if err != nil {
+			return err
+		}
+		return conn.WriteText(b)
+	}
+
+	s.serveStream(ctx, stream, notify, send, conn.WritePing)
+	conn.CloseWithCode(websocket.CloseGoingAway)
+}
+
+// serveStream 推送已有的新消息后，在消息数据库变更时继续推送，直到连接断开
+func (s *Service) serveStream(ctx context.Context, stream *messageStream, notify <-chan struct{}, send func(m *model.Message) error, ping func() error) {
+	ticker := time.NewTicker(StreamPingInterval)
+	defer ticker.Stop()
+
+	// 使用 Last-Event-ID 恢复时，先补发断线期间的消息
+	if err := stream.next(send); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-notify:
+			if err := stream.next(send); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return
+			}
+		}
+	}
+}
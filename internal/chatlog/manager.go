@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/sjzar/chatlog/internal/chatlog/conf"
 	"github.com/sjzar/chatlog/internal/chatlog/ctx"
 	"github.com/sjzar/chatlog/internal/chatlog/database"
+	"github.com/sjzar/chatlog/internal/chatlog/export"
 	"github.com/sjzar/chatlog/internal/chatlog/http"
 	"github.com/sjzar/chatlog/internal/chatlog/wechat"
 	iwechat "github.com/sjzar/chatlog/internal/wechat"
@@ -18,6 +20,9 @@ import (
 	"github.com/sjzar/chatlog/pkg/util/dat2img"
 )
 
+// ProgressInterval 命令行模式下输出解密进度的间隔
+const ProgressInterval = 500 * time.Millisecond
+
 // Manager 管理聊天日志应用
 type Manager struct {
 	ctx *ctx.Context
@@ -48,8 +53,9 @@ func (m *Manager) Run(configPath string) error {
 	m.wechat = wechat.NewService(m.ctx)
 
 	m.db = database.NewService(m.ctx)
+	m.wechat.SetPatchCallback(m.db.Notify)
 
-	m.http = http.NewService(m.ctx, m.db)
+	m.http = http.NewService(m.ctx, m.db, m.wechat)
 
 	m.ctx.WeChatInstances = m.wechat.GetWeChatInstances()
 	if len(m.ctx.WeChatInstances) >= 1 {
@@ -96,6 +102,9 @@ func (m *Manager) Switch(info *iwechat.Account, history string) error {
 }
 
 func (m *Manager) StartService() error {
+	if err := http.CheckAuthPolicy(m.ctx.GetAuth(), m.ctx.Platform, m.ctx.Version); err != nil {
+		return err
+	}
 
 	// 按依赖顺序启动服务
 	if err := m.db.Start(); err != nil {
@@ -198,6 +207,11 @@ func (m *Manager) DecryptDBFiles() error {
 	return nil
 }
 
+// GetDecryptProgress 返回最近一次批量解密的进度
+func (m *Manager) GetDecryptProgress() *wechat.DecryptProgress {
+	return m.wechat.GetProgress()
+}
+
 func (m *Manager) StartAutoDecrypt() error {
 	if m.ctx.DataKey == "" || m.ctx.DataDir == "" {
 		return fmt.Errorf("请先获取密钥")
@@ -229,7 +243,7 @@ func (m *Manager) RefreshSession() error {
 			return err
 		}
 	}
-	resp, err := m.db.GetSessions("", 1, 0)
+	resp, err := m.db.GetSessions(context.Background(), "", 1, 0)
 	if err != nil {
 		return err
 	}
@@ -305,7 +319,8 @@ func (m *Manager) CommandKey(configPath string, pid int, force bool, showXorKey
 	return "", fmt.Errorf("wechat process not found")
 }
 
-func (m *Manager) CommandDecrypt(configPath string, cmdConf map[string]any) error {
+// CommandDecrypt 解密数据，onProgress 不为空时定期回调解密进度，结束时回调最终进度
+func (m *Manager) CommandDecrypt(configPath string, cmdConf map[string]any, onProgress func(*wechat.DecryptProgress)) error {
 
 	var err error
 	m.sc, m.scm, err = conf.LoadServiceConfig(configPath, cmdConf)
@@ -325,6 +340,29 @@ func (m *Manager) CommandDecrypt(configPath string, cmdConf map[string]any) erro
 
 	m.wechat = wechat.NewService(m.sc)
 
+	if onProgress != nil {
+		// 等待定时输出的协程退出后再输出最终进度，避免并发调用 onProgress
+		done, stopped := make(chan struct{}), make(chan struct{})
+		defer func() {
+			close(done)
+			<-stopped
+			onProgress(m.wechat.GetProgress())
+		}()
+		go func() {
+			defer close(stopped)
+			tick := time.NewTicker(ProgressInterval)
+			defer tick.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-tick.C:
+					onProgress(m.wechat.GetProgress())
+				}
+			}
+		}()
+	}
+
 	if err := m.wechat.DecryptDBFiles(); err != nil {
 		return err
 	}
@@ -340,6 +378,10 @@ func (m *Manager) CommandHTTPServer(configPath string, cmdConf map[string]any) e
 		return err
 	}
 
+	if err := http.CheckAuthPolicy(m.sc.GetAuth(), m.sc.GetPlatform(), m.sc.GetVersion()); err != nil {
+		return err
+	}
+
 	dataDir := m.sc.GetDataDir()
 	workDir := m.sc.GetWorkDir()
 	if len(dataDir) == 0 && len(workDir) == 0 {
@@ -363,8 +405,9 @@ func (m *Manager) CommandHTTPServer(configPath string, cmdConf map[string]any) e
 	m.wechat = wechat.NewService(m.sc)
 
 	m.db = database.NewService(m.sc)
+	m.wechat.SetPatchCallback(m.db.Notify)
 
-	m.http = http.NewService(m.sc, m.db)
+	m.http = http.NewService(m.sc, m.db, m.wechat)
 
 	if m.sc.GetAutoDecrypt() {
 		if err := m.wechat.StartAutoDecrypt(); err != nil {
@@ -405,3 +448,56 @@ func (m *Manager) CommandHTTPServer(configPath string, cmdConf map[string]any) e
 
 	return m.http.ListenAndServe()
 }
+
+func (m *Manager) CommandExport(configPath string, cmdConf map[string]any, talker string, timeRange string, format string, output string) error {
+
+	var err error
+	m.sc, m.scm, err = conf.LoadServiceConfig(configPath, cmdConf)
+	if err != nil {
+		return err
+	}
+
+	if len(m.sc.GetWorkDir()) == 0 {
+		return fmt.Errorf("workDir is required")
+	}
+
+	start, end, ok := util.TimeRangeOf(timeRange)
+	if !ok {
+		return fmt.Errorf("invalid time range: %s", timeRange)
+	}
+
+	// 如果是 4.0 版本，处理图片密钥
+	dataDir := m.sc.GetDataDir()
+	if m.sc.GetVersion() == 4 && len(dataDir) != 0 {
+		dat2img.SetAesKey(m.sc.GetImgKey())
+		dat2img.ScanAndSetXorKey(dataDir)
+	}
+
+	m.db = database.NewService(m.sc)
+	if err := m.db.Start(); err != nil {
+		return err
+	}
+	defer m.db.Stop()
+
+	// 输出路径以 .zip 结尾时导出为压缩包，否则导出到目录
+	var w export.Writer
+	if strings.HasSuffix(strings.ToLower(output), ".zip") {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = export.NewZipWriter(f)
+	} else {
+		if w, err = export.NewDirWriter(output); err != nil {
+			return err
+		}
+	}
+
+	if err := export.New(m.sc, m.db).Export(context.Background(), w, talker, start, end, format); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,344 @@
+package redact
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/internal/wechatdb"
+)
+
+// 内置规则
+const (
+	DetectorPhone    = "phone"
+	DetectorIDCard   = "idcard"
+	DetectorBankCard = "bankcard"
+	DetectorEmail    = "email"
+	DetectorAddress  = "address"
+)
+
+// Detectors 全部内置规则
+var Detectors = []string{DetectorPhone, DetectorIDCard, DetectorBankCard, DetectorEmail, DetectorAddress}
+
+// DefaultReplace 自定义规则未设置替换内容时使用的文本
+const DefaultReplace = "[已隐藏]"
+
+var (
+	// numberRegex 匹配连续数字，允许使用单个空格或短横线分组，如 "6222 0200 1234 5678"
+	numberRegex  = regexp.MustCompile(`\d(?:[ -]?\d)*[Xx]?`)
+	groupRegex   = regexp.MustCompile(`\d+[Xx]?`)
+	emailRegex   = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)
+	addressRegex = regexp.MustCompile(`(?:\p{Han}{2,8}?(?:省|自治区|市|区|县|镇|乡|街道))*\p{Han}{1,15}?(?:路|街|大道|巷|弄|胡同|村)\d+(?:-\d+)?号(?:\d+(?:号楼|栋|幢|座|单元|层|楼|室))*`)
+)
+
+// 不进行脱敏的消息字段，保留多媒体链接可用
+var skipContents = []string{"md5", "rawmd5", "path", "thumbpath", "voice", "host", "cdnurl", "x", "y"}
+
+type pattern struct {
+	regex   *regexp.Regexp
+	replace string
+}
+
+// Redactor 对输出的聊天内容进行脱敏，隐藏手机号、身份证号、银行卡号、邮箱、地址以及自定义内容
+// 未开启时为 nil，所有方法均可在 nil 上调用
+type Redactor struct {
+	detectors    []string
+	patterns     []*pattern
+	pseudonymize bool
+}
+
+// New 根据配置创建 Redactor，未开启时返回 nil，无效的自定义规则会被忽略
+func New(config *conf.Redact) *Redactor {
+	if config == nil || !config.Enabled {
+		return nil
+	}
+
+	r := &Redactor{
+		detectors:    config.Detectors,
+		pseudonymize: config.Pseudonymize,
+	}
+	if len(r.detectors) == 0 {
+		r.detectors = Detectors
+	}
+	for _, p := range config.Patterns {
+		regex, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			log.Error().Err(err).Msgf("invalid redact pattern %s", p.Name)
+			continue
+		}
+		replace := p.Replace
+		if replace == "" {
+			replace = DefaultReplace
+		}
+		r.patterns = append(r.patterns, &pattern{regex: regex, replace: replace})
+	}
+	return r
+}
+
+// String 对文本进行脱敏
+func (r *Redactor) String(s string) string {
+	if r == nil || s == "" {
+		return s
+	}
+
+	if r.enabled(DetectorEmail) {
+		s = emailRegex.ReplaceAllString(s, "[邮箱]")
+	}
+	if r.enabled(DetectorAddress) {
+		s = addressRegex.ReplaceAllString(s, "[地址]")
+	}
+	if r.enabled(DetectorPhone) || r.enabled(DetectorIDCard) || r.enabled(DetectorBankCard) {
+		s = numberRegex.ReplaceAllStringFunc(s, r.number)
+	}
+	for _, p := range r.patterns {
+		s = p.regex.ReplaceAllString(s, p.replace)
+	}
+	return s
+}
+
+// maxNumberLen 手机号、身份证号、银行卡号的最大位数
+const maxNumberLen = 19
+
+// number 在连续数字中查找手机号、身份证号或银行卡号
+// 只在分组边界处切分，从每个分组开始优先尝试最长的组合，避免相邻的日期、分机号等数字并入后无法识别
+func (r *Redactor) number(s string) string {
+	groups := groupRegex.FindAllStringIndex(s, -1)
+
+	var b strings.Builder
+	last := 0
+	for i := 0; i < len(groups); {
+		n, label := r.matchGroups(s, groups[i:])
+		if label == "" {
+			i++
+			continue
+		}
+		b.WriteString(s[last:groups[i][0]])
+		b.WriteString(label)
+		last = groups[i+n-1][1]
+		i += n
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// matchGroups 返回从第一个分组开始匹配的分组数量及替换文本，未匹配时返回空字符串
+func (r *Redactor) matchGroups(s string, groups [][]int) (int, string) {
+	n, size := 0, 0
+	for n < len(groups) && size+groups[n][1]-groups[n][0] <= maxNumberLen {
+		size += groups[n][1] - groups[n][0]
+		n++
+	}
+	for ; n > 0; n-- {
+		digits := strings.NewReplacer(" ", "", "-", "").Replace(s[groups[0][0]:groups[n-1][1]])
+		switch {
+		case r.enabled(DetectorPhone) && IsPhone(digits):
+			return n, "[手机号]"
+		case r.enabled(DetectorIDCard) && IsIDCard(digits):
+			return n, "[身份证号]"
+		case r.enabled(DetectorBankCard) && IsBankCard(digits):
+			return n, "[银行卡号]"
+		}
+	}
+	return 0, ""
+}
+
+func (r *Redactor) enabled(detector string) bool {
+	return slices.Contains(r.detectors, detector)
+}
+
+// IsPhone 判断是否为中国大陆手机号，支持 86 前缀
+func IsPhone(s string) bool {
+	s = strings.TrimPrefix(s, "86")
+	if len(s) != 11 || s[0] != '1' || s[1] < '3' {
+		return false
+	}
+	return isDigits(s)
+}
+
+// IsIDCard 判断是否为 18 位居民身份证号，校验末位校验码
+func IsIDCard(s string) bool {
+	if len(s) != 18 || !isDigits(s[:17]) {
+		return false
+	}
+	weights := []int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+	sum := 0
+	for i, w := range weights {
+		sum += int(s[i]-'0') * w
+	}
+	return "10X98765432"[sum%11] == strings.ToUpper(s[17:])[0]
+}
+
+// IsBankCard 判断是否为 16 到 19 位且通过 Luhn 校验的银行卡号
+func IsBankCard(s string) bool {
+	if len(s) < 16 || len(s) > 19 || !isDigits(s) {
+		return false
+	}
+	sum := 0
+	for i := 0; i < len(s); i++ {
+		d := int(s[len(s)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Scope 单次响应内的脱敏，开启化名时同一发送者在同一响应中使用相同的化名
+// Scope 不能并发使用
+type Scope struct {
+	r     *Redactor
+	names map[string]string
+}
+
+type scopeKey struct{}
+
+// NewContext 返回携带 Scope 的 context，同一 context 中的多次查询使用相同的化名
+func NewContext(ctx context.Context, scope *Scope) context.Context {
+	if scope == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, scopeKey{}, scope)
+}
+
+// FromContext 获取 context 中的 Scope，不存在时返回 nil
+func FromContext(ctx context.Context) *Scope {
+	scope, _ := ctx.Value(scopeKey{}).(*Scope)
+	return scope
+}
+
+// NewScope 为一次响应创建 Scope，Redactor 为 nil 时返回 nil
+func (r *Redactor) NewScope() *Scope {
+	if r == nil {
+		return nil
+	}
+	return &Scope{
+		r:     r,
+		names: make(map[string]string),
+	}
+}
+
+// String 对文本进行脱敏
+func (s *Scope) String(str string) string {
+	if s == nil {
+		return str
+	}
+	return s.r.String(str)
+}
+
+// Name 返回用户的化名，未开启化名时返回 name
+func (s *Scope) Name(userName, name string) string {
+	if s == nil || !s.r.pseudonymize || userName == "" {
+		return name
+	}
+	return s.pseudonym(userName)
+}
+
+func (s *Scope) pseudonym(userName string) string {
+	if name, ok := s.names[userName]; ok {
+		return name
+	}
+	name := fmt.Sprintf("用户%d", len(s.names)+1)
+	s.names[userName] = name
+	return name
+}
+
+// Message 对消息内容进行脱敏，开启化名时替换发送者，私聊消息同时替换会话对象
+func (s *Scope) Message(m *model.Message) {
+	if s == nil || m == nil {
+		return
+	}
+
+	m.Content = s.r.String(m.Content)
+	for key, value := range m.Contents {
+		if slices.Contains(skipContents, key) {
+			continue
+		}
+		m.Contents[key] = s.value(value)
+	}
+
+	if s.r.pseudonymize && !m.IsSelf {
+		m.SenderName = s.pseudonym(m.Sender)
+		m.Sender = m.SenderName
+	}
+	if s.r.pseudonymize && !m.IsChatRoom {
+		m.TalkerName = s.pseudonym(m.Talker)
+		m.Talker = m.TalkerName
+	}
+}
+
+// Stats 对消息统计进行脱敏，开启化名时替换发送者，私聊统计同时替换会话对象
+func (s *Scope) Stats(stats *wechatdb.MessageStats) {
+	if s == nil || stats == nil || !s.r.pseudonymize {
+		return
+	}
+	if !stats.IsChatRoom {
+		stats.TalkerName = s.pseudonym(stats.Talker)
+		stats.Talker = stats.TalkerName
+	}
+	for _, sender := range stats.Senders {
+		if !sender.IsSelf {
+			sender.SenderName = s.pseudonym(sender.Sender)
+			sender.Sender = sender.SenderName
+		}
+	}
+}
+
+// Session 对会话的最后一条消息进行脱敏，开启化名时替换私聊会话对象
+func (s *Scope) Session(session *model.Session) {
+	if s == nil || session == nil {
+		return
+	}
+	session.Content = s.r.String(session.Content)
+	if s.r.pseudonymize && !strings.HasSuffix(session.UserName, "@chatroom") {
+		session.NickName = s.pseudonym(session.UserName)
+		session.UserName = session.NickName
+	}
+}
+
+func (s *Scope) value(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return s.r.String(v)
+	case *model.Message:
+		s.Message(v)
+	case *model.RecordInfo:
+		s.recordInfo(v)
+	}
+	return value
+}
+
+func (s *Scope) recordInfo(info *model.RecordInfo) {
+	info.Title = s.r.String(info.Title)
+	info.Desc = s.r.String(info.Desc)
+	info.Info = s.r.String(info.Info)
+	for i := range info.DataList.DataItems {
+		item := &info.DataList.DataItems[i]
+		item.DataDesc = s.r.String(item.DataDesc)
+		item.DataTitle = s.r.String(item.DataTitle)
+		item.Location.Label = s.r.String(item.Location.Label)
+		item.Location.PoiName = s.r.String(item.Location.PoiName)
+		item.SourceName = s.Name(item.SourceName, item.SourceName)
+		if item.RecordXML != nil {
+			s.recordInfo(&item.RecordXML.RecordInfo)
+		}
+	}
+}
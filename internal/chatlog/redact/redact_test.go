@@ -0,0 +1,88 @@
+package redact
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+func TestString(t *testing.T) {
+	r := New(&conf.Redact{
+		Enabled:  true,
+		Patterns: []*conf.RedactPattern{{Name: "project", Pattern: `项目[A-Z]+`, Replace: "[项目]"}},
+	})
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"电话 13812345678，备用 +86 138-1234-5678", "电话 [手机号]，备用 +[手机号]"},
+		{"身份证 11010519491231002X", "身份证 [身份证号]"},
+		{"卡号 6222 0200 0000 0000 000 转账", "卡号 [银行卡号] 转账"},
+		{"邮件发到 zhang.san@example.com.cn 吧", "邮件发到 [邮箱] 吧"},
+		{"地址：北京市朝阳区建国路88号3栋201室", "地址：[地址]"},
+		{"项目ABC 周五上线", "[项目] 周五上线"},
+		{"订单 20240101 共 12345678901234 元", "订单 20240101 共 12345678901234 元"},
+		{"电话13812345678 8点见", "电话[手机号] 8点见"},
+		{"分机 13812345678-2", "分机 [手机号]-2"},
+		{"2024 13812345678", "2024 [手机号]"},
+		{"身份证 110105198001010016 09 30 办理", "身份证 [身份证号] 09 30 办理"},
+		{"2024-01-01 110105198001010024", "2024-01-01 [身份证号]"},
+		{"卡号 6222 0200 0000 0000 000 2024-01-01 到账", "卡号 [银行卡号] 2024-01-01 到账"},
+	}
+	for _, tt := range tests {
+		if got := r.String(tt.in); got != tt.want {
+			t.Errorf("String(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	if got := New(&conf.Redact{}).String("13812345678"); got != "13812345678" {
+		t.Errorf("disabled redactor changed text: %q", got)
+	}
+}
+
+func TestPseudonymize(t *testing.T) {
+	scope := New(&conf.Redact{Enabled: true, Pseudonymize: true}).NewScope()
+
+	messages := []*model.Message{
+		{Talker: "a@chatroom", IsChatRoom: true, Sender: "wxid_a", SenderName: "张三", Content: "我的手机 13812345678"},
+		{Talker: "a@chatroom", IsChatRoom: true, Sender: "wxid_b", SenderName: "李四"},
+		{Talker: "a@chatroom", IsChatRoom: true, Sender: "wxid_a", SenderName: "张三", Contents: map[string]interface{}{"md5": "13812345678"}},
+		{Talker: "a@chatroom", IsChatRoom: true, Sender: "wxid_self", IsSelf: true},
+	}
+	for _, m := range messages {
+		scope.Message(m)
+	}
+
+	if messages[0].SenderName != "用户1" || messages[1].SenderName != "用户2" || messages[2].SenderName != "用户1" {
+		t.Errorf("unexpected pseudonyms %q %q %q", messages[0].SenderName, messages[1].SenderName, messages[2].SenderName)
+	}
+	if messages[0].Content != "我的手机 [手机号]" {
+		t.Errorf("content not redacted: %q", messages[0].Content)
+	}
+	if messages[2].Contents["md5"] != "13812345678" {
+		t.Error("media key should not be redacted")
+	}
+	if messages[3].Sender != "wxid_self" || messages[0].Talker != "a@chatroom" {
+		t.Error("self sender and chat room should be kept")
+	}
+}
+
+func TestContextScope(t *testing.T) {
+	r := New(&conf.Redact{Enabled: true, Pseudonymize: true})
+	ctx := NewContext(context.Background(), r.NewScope())
+
+	a := &model.Message{Talker: "wxid_a", Sender: "wxid_a"}
+	FromContext(ctx).Message(a)
+	b := &model.Message{Talker: "wxid_a", Sender: "wxid_a"}
+	FromContext(ctx).Message(b)
+	if a.Sender != b.Sender || a.Talker != "用户1" {
+		t.Errorf("pseudonyms differ in the same context: %q %q", a.Sender, b.Sender)
+	}
+
+	if FromContext(NewContext(context.Background(), New(&conf.Redact{}).NewScope())) != nil {
+		t.Error("expected no scope when redaction is disabled")
+	}
+}
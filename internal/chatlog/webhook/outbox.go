@@ -0,0 +1,387 @@
+package webhook
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// OutboxFile 保存在工作目录中的 webhook 发送队列
+const OutboxFile = "chatlog_webhook.db"
+
+const (
+	StatusPending = "pending"
+	StatusDead    = "dead"
+)
+
+const outboxSchema = `
+CREATE TABLE IF NOT EXISTS webhook_outbox (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	hook TEXT NOT NULL,
+	url TEXT NOT NULL,
+	body BLOB NOT NULL,
+	end_time INTEGER NOT NULL,
+	watermarks TEXT NOT NULL DEFAULT '{}',
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	next_at INTEGER NOT NULL,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS webhook_outbox_hook ON webhook_outbox(hook, status, id);
+CREATE TABLE IF NOT EXISTS webhook_watermark (
+	hook TEXT NOT NULL,
+	talker TEXT NOT NULL,
+	user_name TEXT NOT NULL DEFAULT '',
+	seq INTEGER NOT NULL,
+	time INTEGER NOT NULL,
+	PRIMARY KEY(hook, talker)
+);
+`
+
+// Watermark 会话中已推送到的位置
+// 消息按 (Seq, Talker) 定位，同一秒内的多条消息不会遗漏或重复推送
+type Watermark struct {
+	UserName string    `json:"userName"` // 会话 ID，talker 使用昵称或备注名时与 talker 不同
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"` // 下一次查询的起始时间
+}
+
+// Merge 合并位置，只向前推进
+func (w *Watermark) Merge(other *Watermark) {
+	if other.UserName != "" {
+		w.UserName = other.UserName
+	}
+	w.Seq = max(w.Seq, other.Seq)
+	if other.Time.After(w.Time) {
+		w.Time = other.Time
+	}
+}
+
+// Entry 待发送或发送失败的 webhook 请求
+type Entry struct {
+	ID        int64     `json:"id"`
+	Hook      string    `json:"hook"`
+	URL       string    `json:"url"`
+	Body      string    `json:"body"`
+	EndTime   time.Time `json:"endTime"` // 请求中最后一条消息之后的时间
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError"`
+	NextAt    time.Time `json:"nextAt"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	// Watermarks 发送成功或转为死信后，各会话推进到的位置
+	Watermarks map[string]*Watermark `json:"watermarks"`
+}
+
+// Outbox 持久化的 webhook 发送队列
+// 请求在发送前写入队列，发送成功后删除，超过重试次数后标记为死信
+type Outbox struct {
+	path string
+	db   *sql.DB
+}
+
+// OpenOutbox 打开或创建发送队列，path 为空时发送队列只保存在内存中，重启后丢失
+func OpenOutbox(path string) (*Outbox, error) {
+	dsn := path + "?_journal_mode=WAL&_busy_timeout=5000"
+	if path == "" {
+		dsn = ":memory:"
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, errors.DBConnectFailed(path, err)
+	}
+	if path == "" {
+		// 每个连接都是独立的内存数据库，只使用一个连接
+		db.SetMaxOpenConns(1)
+	}
+
+	if _, err := db.Exec(outboxSchema); err != nil {
+		db.Close()
+		return nil, errors.QueryFailed(outboxSchema, err)
+	}
+
+	return &Outbox{
+		path: path,
+		db:   db,
+	}, nil
+}
+
+// Add 写入待发送的请求
+func (o *Outbox) Add(hook, url string, body []byte, endTime time.Time, marks map[string]*Watermark) (*Entry, error) {
+	now := time.Now()
+	b, _ := json.Marshal(marks)
+	result, err := o.db.Exec(
+		"INSERT INTO webhook_outbox (hook, url, body, end_time, watermarks, status, next_at, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		hook, url, body, endTime.UnixMilli(), string(b), StatusPending, now.UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return nil, errors.QueryFailed("INSERT webhook_outbox", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, errors.QueryFailed("INSERT webhook_outbox", err)
+	}
+
+	return &Entry{
+		ID:         id,
+		Hook:       hook,
+		URL:        url,
+		Body:       string(body),
+		EndTime:    endTime,
+		Status:     StatusPending,
+		NextAt:     now,
+		CreatedAt:  now,
+		Watermarks: marks,
+	}, nil
+}
+
+// Pending 按写入顺序获取 hook 待发送的请求
+func (o *Outbox) Pending(hook string) ([]*Entry, error) {
+	return o.query("WHERE hook = ? AND status = ? ORDER BY id", hook, StatusPending)
+}
+
+// DeadLetters 获取超过重试次数的请求，按写入时间倒序排列
+func (o *Outbox) DeadLetters(limit, offset int) ([]*Entry, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	return o.query("WHERE status = ? ORDER BY id DESC LIMIT ? OFFSET ?", StatusDead, limit, offset)
+}
+
+// Get 获取指定请求
+func (o *Outbox) Get(id int64) (*Entry, error) {
+	return o.get(o.db, id)
+}
+
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func (o *Outbox) get(q queryer, id int64) (*Entry, error) {
+	entries, err := queryEntries(q, "WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errors.ErrWebhookEntryNotFound
+	}
+	return entries[0], nil
+}
+
+func (o *Outbox) query(cond string, args ...any) ([]*Entry, error) {
+	return queryEntries(o.db, cond, args...)
+}
+
+func queryEntries(q queryer, cond string, args ...any) ([]*Entry, error) {
+	query := "SELECT id, hook, url, body, end_time, watermarks, status, attempts, last_error, next_at, created_at FROM webhook_outbox " + cond
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, errors.QueryFailed(query, err)
+	}
+	defer rows.Close()
+
+	entries := make([]*Entry, 0)
+	for rows.Next() {
+		var e Entry
+		var body []byte
+		var marks string
+		var endTime, nextAt, createdAt int64
+		if err := rows.Scan(&e.ID, &e.Hook, &e.URL, &body, &endTime, &marks, &e.Status, &e.Attempts, &e.LastError, &nextAt, &createdAt); err != nil {
+			return nil, errors.ScanRowFailed(err)
+		}
+		e.Body = string(body)
+		json.Unmarshal([]byte(marks), &e.Watermarks)
+		e.EndTime = time.UnixMilli(endTime)
+		e.NextAt = time.UnixMilli(nextAt)
+		e.CreatedAt = time.UnixMilli(createdAt)
+		entries = append(entries, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.QueryFailed(query, err)
+	}
+
+	return entries, nil
+}
+
+// Done 请求发送成功，从队列中删除，并在同一事务中推进会话位置
+func (o *Outbox) Done(id int64) error {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return errors.QueryFailed("BEGIN", err)
+	}
+	defer tx.Rollback()
+
+	entry, err := o.get(tx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM webhook_outbox WHERE id = ?", id); err != nil {
+		return errors.QueryFailed("DELETE webhook_outbox", err)
+	}
+	if err := setWatermarks(tx, entry.Hook, entry.Watermarks); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.QueryFailed("COMMIT", err)
+	}
+	return nil
+}
+
+// Fail 记录发送失败，nextAt 之后再次重试
+func (o *Outbox) Fail(id int64, attempts int, nextAt time.Time, lastError string) error {
+	if _, err := o.db.Exec("UPDATE webhook_outbox SET attempts = ?, next_at = ?, last_error = ? WHERE id = ?",
+		attempts, nextAt.UnixMilli(), lastError, id); err != nil {
+		return errors.QueryFailed("UPDATE webhook_outbox", err)
+	}
+	return nil
+}
+
+// Dead 将请求标记为死信，不再自动重试，并推进会话位置以继续推送后续消息
+func (o *Outbox) Dead(id int64, attempts int, lastError string) error {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return errors.QueryFailed("BEGIN", err)
+	}
+	defer tx.Rollback()
+
+	entry, err := o.get(tx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE webhook_outbox SET status = ?, attempts = ?, last_error = ? WHERE id = ?",
+		StatusDead, attempts, lastError, id); err != nil {
+		return errors.QueryFailed("UPDATE webhook_outbox", err)
+	}
+	if err := setWatermarks(tx, entry.Hook, entry.Watermarks); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.QueryFailed("COMMIT", err)
+	}
+	return nil
+}
+
+// Requeue 将死信重新放回队列，立即重试
+func (o *Outbox) Requeue(id int64) error {
+	result, err := o.db.Exec("UPDATE webhook_outbox SET status = ?, attempts = 0, next_at = ? WHERE id = ? AND status = ?",
+		StatusPending, time.Now().UnixMilli(), id, StatusDead)
+	if err != nil {
+		return errors.QueryFailed("UPDATE webhook_outbox", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.ErrWebhookEntryNotFound
+	}
+	return nil
+}
+
+// Delete 删除请求
+func (o *Outbox) Delete(id int64) error {
+	result, err := o.db.Exec("DELETE FROM webhook_outbox WHERE id = ?", id)
+	if err != nil {
+		return errors.QueryFailed("DELETE webhook_outbox", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.ErrWebhookEntryNotFound
+	}
+	return nil
+}
+
+// Watermarks 获取 hook 在各会话中已推送到的位置
+func (o *Outbox) Watermarks(hook string) (map[string]*Watermark, error) {
+	query := "SELECT talker, user_name, seq, time FROM webhook_watermark WHERE hook = ? AND talker != ''"
+	rows, err := o.db.Query(query, hook)
+	if err != nil {
+		return nil, errors.QueryFailed(query, err)
+	}
+	defer rows.Close()
+
+	marks := make(map[string]*Watermark)
+	for rows.Next() {
+		var talker string
+		var mark Watermark
+		var t int64
+		if err := rows.Scan(&talker, &mark.UserName, &mark.Seq, &t); err != nil {
+			return nil, errors.ScanRowFailed(err)
+		}
+		mark.Time = time.UnixMilli(t)
+		marks[talker] = &mark
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.QueryFailed(query, err)
+	}
+
+	return marks, nil
+}
+
+// SetWatermarks 推进 hook 在各会话中已推送到的位置
+func (o *Outbox) SetWatermarks(hook string, marks map[string]*Watermark) error {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return errors.QueryFailed("BEGIN", err)
+	}
+	defer tx.Rollback()
+
+	if err := setWatermarks(tx, hook, marks); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.QueryFailed("COMMIT", err)
+	}
+	return nil
+}
+
+func setWatermarks(tx *sql.Tx, hook string, marks map[string]*Watermark) error {
+	for talker, mark := range marks {
+		if _, err := tx.Exec(`INSERT INTO webhook_watermark (hook, talker, user_name, seq, time) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(hook, talker) DO UPDATE SET
+				user_name = CASE WHEN excluded.user_name != '' THEN excluded.user_name ELSE user_name END,
+				seq = max(seq, excluded.seq),
+				time = max(time, excluded.time)`,
+			hook, talker, mark.UserName, mark.Seq, mark.Time.UnixMilli()); err != nil {
+			return errors.QueryFailed("INSERT webhook_watermark", err)
+		}
+	}
+	return nil
+}
+
+// Since 获取 hook 首次启用的时间，没有推送记录的会话从该时间开始推送
+func (o *Outbox) Since(hook string) (time.Time, error) {
+	if _, err := o.db.Exec("INSERT OR IGNORE INTO webhook_watermark (hook, talker, seq, time) VALUES (?, '', 0, ?)",
+		hook, time.Now().UnixMilli()); err != nil {
+		return time.Time{}, errors.QueryFailed("INSERT webhook_watermark", err)
+	}
+
+	var t int64
+	if err := o.db.QueryRow("SELECT time FROM webhook_watermark WHERE hook = ? AND talker = ''", hook).Scan(&t); err != nil {
+		return time.Time{}, errors.QueryFailed("SELECT webhook_watermark", err)
+	}
+	return time.UnixMilli(t), nil
+}
+
+// Close 关闭发送队列
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+// Backoff 计算第 attempts 次失败后的重试间隔，按 base 指数增长，不超过 max
+func Backoff(attempts int, base, max time.Duration) time.Duration {
+	if attempts <= 0 {
+		return base
+	}
+	d := base
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= max {
+			return max
+		}
+	}
+	return min(d, max)
+}
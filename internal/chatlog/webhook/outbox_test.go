@@ -0,0 +1,123 @@
+package webhook
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	base, max := time.Second, 10*time.Second
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts, base, max); got != tt.want {
+			t.Errorf("Backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	t.Run("file", func(t *testing.T) { testOutbox(t, filepath.Join(t.TempDir(), OutboxFile)) })
+	// 工作目录加密时发送队列只保存在内存中
+	t.Run("memory", func(t *testing.T) { testOutbox(t, "") })
+}
+
+func testOutbox(t *testing.T, path string) {
+	outbox, err := OpenOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+
+	first, err := outbox.Add("hook", "http://localhost/a", []byte(`{"a":1}`), time.UnixMilli(1000), map[string]*Watermark{
+		"wxid_a": {UserName: "wxid_a", Seq: 10, Time: time.UnixMilli(1000)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := outbox.Add("hook", "http://localhost/a", []byte(`{"a":2}`), time.UnixMilli(2000), map[string]*Watermark{
+		"wxid_a": {UserName: "wxid_a", Seq: 20, Time: time.UnixMilli(2000)},
+		"wxid_b": {UserName: "wxid_b", Seq: 5, Time: time.UnixMilli(2000)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := outbox.Add("other", "http://localhost/b", []byte(`{}`), time.UnixMilli(3000), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := outbox.Pending("hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].ID != first.ID || pending[1].ID != second.ID {
+		t.Fatalf("unexpected pending entries: %+v", pending)
+	}
+	if pending[0].Body != `{"a":1}` || !pending[0].EndTime.Equal(time.UnixMilli(1000)) {
+		t.Errorf("unexpected entry: %+v", pending[0])
+	}
+
+	if err := outbox.Fail(first.ID, 1, time.UnixMilli(5000), "status code: 500"); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Dead(first.ID, 2, "status code: 500"); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Done(second.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, _ = outbox.Pending("hook")
+	if len(pending) != 0 {
+		t.Fatalf("expected no pending entries, got %d", len(pending))
+	}
+	dead, err := outbox.DeadLetters(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].ID != first.ID || dead[0].Attempts != 2 || dead[0].LastError != "status code: 500" {
+		t.Fatalf("unexpected dead letters: %+v", dead)
+	}
+
+	if err := outbox.Requeue(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Requeue(first.ID); err == nil {
+		t.Error("requeue pending entry should fail")
+	}
+	pending, _ = outbox.Pending("hook")
+	if len(pending) != 1 || pending[0].Attempts != 0 {
+		t.Fatalf("unexpected pending entries after requeue: %+v", pending)
+	}
+
+	// 重新发送的死信不会使已推进的位置回退
+	if err := outbox.Done(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	marks, err := outbox.Watermarks("hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 2 || marks["wxid_a"].Seq != 20 || marks["wxid_b"].Seq != 5 || !marks["wxid_a"].Time.Equal(time.UnixMilli(2000)) {
+		t.Errorf("unexpected watermarks: %+v", marks)
+	}
+
+	since, err := outbox.Since("hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := outbox.Since("hook"); !again.Equal(since) {
+		t.Errorf("since changed: %s != %s", again, since)
+	}
+}
@@ -0,0 +1,23 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+const (
+	HeaderTimestamp = "X-Chatlog-Timestamp"
+	HeaderSignature = "X-Chatlog-Signature"
+)
+
+// Sign 计算请求签名，签名内容为 "<timestamp>.<body>"，使用 HMAC-SHA256
+// 接收方应使用相同的 secret 重新计算并比较签名，同时校验时间戳防止重放
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -3,32 +3,74 @@ package webhook
 import (
 	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog/log"
 
 	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
 	"github.com/sjzar/chatlog/internal/wechatdb"
+	"github.com/sjzar/chatlog/pkg/metrics"
+	"github.com/sjzar/chatlog/pkg/util"
 )
 
+const (
+	DefaultMaxRetries = 10
+	DefaultRetryBase  = time.Second
+	DefaultRetryMax   = 10 * time.Minute
+
+	// RetryInterval 检查队列中待重试请求的间隔
+	RetryInterval = time.Second
+
+	// DefaultMaxCatchUp 重启后最多补发的消息时间范围
+	DefaultMaxCatchUp = 24 * time.Hour
+
+	// BatchSize 每个会话单次请求最多推送的消息数量
+	BatchSize = 500
+
+	// SettleTime 会话最后一条消息写入超过该时间后，认为消息数据库已同步
+	SettleTime = time.Minute
+)
+
+// deliveries 回调请求结果，retry 表示等待重试，dead 表示已转入死信
+var deliveries = metrics.NewCounter("chatlog_webhook_deliveries_total", "Webhook delivery attempts by result.", "result")
+
 type Config interface {
+	GetWorkDir() string
+	GetWorkDirKey() string
 	GetWebhook() *conf.Webhook
 }
 
 type Webhook interface {
 	Do(event fsnotify.Event)
+	Retry()
 }
 
 type Service struct {
+	conf   Config
 	config *conf.Webhook
 	hooks  map[string][]*conf.WebhookItem
+
+	mutex  sync.Mutex
+	outbox *Outbox
 }
 
 func New(config Config) *Service {
 	s := &Service{
+		conf:   config,
 		config: config.GetWebhook(),
 	}
 
@@ -59,22 +101,115 @@ func New(config Config) *Service {
 	return s
 }
 
-func (s *Service) GetHooks(ctx context.Context, db *wechatdb.DB) []*Group {
+// GetHooks 创建 webhook 分组，并打开工作目录中的发送队列，ctx 结束时关闭发送队列
+// 发送队列保存了消息明文，设置工作目录口令时只保存在内存中，并删除之前遗留的发送队列
+func (s *Service) GetHooks(ctx context.Context, db *wechatdb.DB) ([]*Group, error) {
 
 	if len(s.hooks) == 0 {
-		return nil
+		return nil, nil
+	}
+
+	path := filepath.Join(s.conf.GetWorkDir(), OutboxFile)
+	if s.conf.GetWorkDirKey() != "" {
+		if err := util.RemoveSQLite(path); err != nil {
+			log.Err(err).Msgf("remove %s failed", path)
+		}
+		path = ""
+	}
+	outbox, err := OpenOutbox(path)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.outbox = outbox
+	s.mutex.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.mutex.Lock()
+		if s.outbox == outbox {
+			s.outbox = nil
+		}
+		s.mutex.Unlock()
+		outbox.Close()
+	}()
+
+	retry := RetryConfig{
+		MaxRetries: s.config.MaxRetries,
+		Base:       time.Duration(s.config.RetryBaseMs) * time.Millisecond,
+		Max:        time.Duration(s.config.RetryMaxMs) * time.Millisecond,
+	}
+	if retry.MaxRetries <= 0 {
+		retry.MaxRetries = DefaultMaxRetries
+	}
+	if retry.Base <= 0 {
+		retry.Base = DefaultRetryBase
+	}
+	if retry.Max <= 0 {
+		retry.Max = DefaultRetryMax
+	}
+	catchUp := time.Duration(s.config.MaxCatchUpMs) * time.Millisecond
+	if catchUp == 0 {
+		catchUp = DefaultMaxCatchUp
 	}
 
 	groups := make([]*Group, 0)
 	for group, items := range s.hooks {
 		hooks := make([]Webhook, 0)
 		for _, item := range items {
-			hooks = append(hooks, NewMessageWebhook(item, db, s.config.Host))
+			hook, err := NewMessageWebhook(item, db, s.config.Host, outbox, retry, catchUp)
+			if err != nil {
+				log.Error().Err(err).Msgf("init webhook %s failed", item.URL)
+				continue
+			}
+			hooks = append(hooks, hook)
 		}
 		groups = append(groups, NewGroup(ctx, group, hooks, s.config.DelayMs))
 	}
 
-	return groups
+	return groups, nil
+}
+
+func (s *Service) getOutbox() (*Outbox, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.outbox == nil {
+		return nil, errors.ErrWebhookNotEnabled
+	}
+	return s.outbox, nil
+}
+
+// GetDeadLetters 获取超过重试次数仍未发送成功的请求
+func (s *Service) GetDeadLetters(limit, offset int) ([]*Entry, error) {
+	outbox, err := s.getOutbox()
+	if err != nil {
+		return nil, err
+	}
+	return outbox.DeadLetters(limit, offset)
+}
+
+// RetryDeadLetter 将死信重新放回发送队列
+func (s *Service) RetryDeadLetter(id int64) error {
+	outbox, err := s.getOutbox()
+	if err != nil {
+		return err
+	}
+	return outbox.Requeue(id)
+}
+
+// DeleteDeadLetter 删除死信
+func (s *Service) DeleteDeadLetter(id int64) error {
+	outbox, err := s.getOutbox()
+	if err != nil {
+		return err
+	}
+	entry, err := outbox.Get(id)
+	if err != nil {
+		return err
+	}
+	if entry.Status != StatusDead {
+		return errors.ErrWebhookEntryNotFound
+	}
+	return outbox.Delete(id)
 }
 
 type Group struct {
@@ -115,6 +250,8 @@ func (g *Group) Group() string {
 }
 
 func (g *Group) loop() {
+	ticker := time.NewTicker(RetryInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case event, ok := <-g.ch:
@@ -125,6 +262,10 @@ func (g *Group) loop() {
 				time.Sleep(time.Duration(g.delayMs) * time.Millisecond)
 			}
 			g.do(event)
+		case <-ticker.C:
+			for _, hook := range g.hooks {
+				go hook.Retry()
+			}
 		case <-g.ctx.Done():
 			return
 		}
@@ -137,63 +278,359 @@ func (g *Group) do(event fsnotify.Event) {
 	}
 }
 
+// RetryConfig 发送失败后的重试策略
+type RetryConfig struct {
+	MaxRetries int
+	Base       time.Duration
+	Max        time.Duration
+}
+
 type MessageWebhook struct {
-	host     string
-	conf     *conf.WebhookItem
-	client   *http.Client
-	db       *wechatdb.DB
-	lastTime time.Time
+	key     string
+	host    string
+	conf    *conf.WebhookItem
+	tmpl    *template.Template
+	client  *http.Client
+	db      *wechatdb.DB
+	outbox  *Outbox
+	retry   RetryConfig
+	catchUp time.Duration
+	mutex   sync.Mutex
+
+	// since hook 首次启用的时间，marks 各会话已推送到的位置，均保存在发送队列中，重启后继续推送
+	since time.Time
+	marks map[string]*Watermark
 }
 
-func NewMessageWebhook(conf *conf.WebhookItem, db *wechatdb.DB, host string) *MessageWebhook {
+func NewMessageWebhook(conf *conf.WebhookItem, db *wechatdb.DB, host string, outbox *Outbox, retry RetryConfig, catchUp time.Duration) (*MessageWebhook, error) {
 	m := &MessageWebhook{
-		host:     host,
-		conf:     conf,
-		client:   &http.Client{Timeout: time.Second * 10},
-		db:       db,
-		lastTime: time.Now(),
+		key:     hookKey(conf),
+		host:    host,
+		conf:    conf,
+		client:  &http.Client{Timeout: time.Second * 10},
+		db:      db,
+		outbox:  outbox,
+		retry:   retry,
+		catchUp: catchUp,
+		since:   time.Now(),
+		marks:   make(map[string]*Watermark),
+	}
+
+	if outbox != nil {
+		since, err := outbox.Since(m.key)
+		if err != nil {
+			return nil, err
+		}
+		marks, err := outbox.Watermarks(m.key)
+		if err != nil {
+			return nil, err
+		}
+		m.since = since
+		m.marks = marks
 	}
-	return m
+
+	if conf.Template != "" {
+		tmpl, err := template.New("webhook").Funcs(templateFuncs).Parse(conf.Template)
+		if err != nil {
+			return nil, errors.Newf(err, http.StatusBadRequest, "invalid webhook template")
+		}
+		m.tmpl = tmpl
+	}
+
+	return m, nil
+}
+
+// templateFuncs 请求体模板中可用的函数
+var templateFuncs = template.FuncMap{
+	// json 将值编码为 JSON，用于在 JSON 模板中安全地嵌入文本
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": strings.Join,
+}
+
+// hookKey 根据配置生成 webhook 标识，用于在重启后找回发送队列中的请求
+func hookKey(conf *conf.WebhookItem) string {
+	h := sha1.Sum([]byte(strings.Join([]string{conf.Type, conf.URL, conf.Talker, conf.Sender, conf.Keyword}, "\n")))
+	return hex.EncodeToString(h[:8])
 }
 
 func (m *MessageWebhook) Do(event fsnotify.Event) {
-	messages, err := m.db.GetMessages(m.lastTime, time.Now().Add(time.Minute*10), m.conf.Talker, m.conf.Sender, m.conf.Keyword, 0, 0)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.flush()
+}
+
+// Retry 队列中有到期的请求时重新发送
+func (m *MessageWebhook) Retry() {
+	if !m.mutex.TryLock() {
+		return
+	}
+	defer m.mutex.Unlock()
+
+	entries, err := m.outbox.Pending(m.key)
 	if err != nil {
-		log.Error().Err(err).Msgf("get messages failed")
+		log.Error().Err(err).Msgf("get pending webhook failed")
+		return
+	}
+	if len(entries) == 0 || entries[0].NextAt.After(time.Now()) {
 		return
 	}
 
-	if len(messages) == 0 {
+	m.flush()
+}
+
+// flush 按顺序发送队列中的请求，全部成功后再查询并发送新消息
+// 队列中存在未发送成功的请求时不查询新消息，会话位置保持不变，消息不会丢失或乱序
+func (m *MessageWebhook) flush() {
+	entries, err := m.outbox.Pending(m.key)
+	if err != nil {
+		log.Error().Err(err).Msgf("get pending webhook failed")
 		return
 	}
+	for _, entry := range entries {
+		if entry.NextAt.After(time.Now()) || !m.send(entry) {
+			return
+		}
+	}
 
-	m.lastTime = messages[len(messages)-1].Time.Add(time.Second)
+	// 每个会话每次最多推送 BatchSize 条消息，追赶积压消息时分多次发送
+	for m.deliver() {
+	}
+}
+
+// deliver 查询各会话位置之后的新消息并发送，返回 true 表示发送成功且还有未推送的消息
+func (m *MessageWebhook) deliver() bool {
+	now := time.Now()
+	scans, err := m.scans(now)
+	if err != nil {
+		log.Error().Err(err).Msgf("get sessions failed")
+		return false
+	}
+
+	messages := make([]*model.Message, 0)
+	marks := make(map[string]*Watermark)
+	hasMore := false
+	for _, scan := range scans {
+		cursor := &model.Cursor{}
+		if scan.mark != nil {
+			cursor = &model.Cursor{Seq: scan.mark.Seq, Talker: scan.mark.UserName}
+		}
+		resp, err := m.db.GetMessagesByCursor(context.Background(), scan.start, now.Add(time.Minute*10), scan.talker, m.conf.Sender, m.conf.Keyword, cursor, BatchSize)
+		if err != nil {
+			log.Error().Err(err).Msgf("get messages of %s failed", scan.talker)
+			continue
+		}
+		hasMore = hasMore || resp.HasMore
+
+		mark := &Watermark{}
+		if scan.mark != nil {
+			*mark = *scan.mark
+		}
+		if len(resp.Items) > 0 {
+			last := resp.Items[len(resp.Items)-1]
+			mark.Merge(&Watermark{UserName: last.Talker, Seq: last.Seq, Time: last.Time})
+			messages = append(messages, resp.Items...)
+		}
+		// 会话列表中的最后一条消息已写入一段时间，之前的消息已全部扫描，下次从之后开始查询
+		if !resp.HasMore && !scan.settled.IsZero() {
+			mark.Merge(&Watermark{Time: scan.settled})
+		}
+		if scan.mark == nil || *mark != *scan.mark {
+			marks[scan.talker] = mark
+		}
+	}
+
+	if len(messages) == 0 {
+		if len(marks) > 0 {
+			if err := m.outbox.SetWatermarks(m.key, marks); err != nil {
+				log.Error().Err(err).Msgf("save webhook watermarks failed")
+				return false
+			}
+			m.merge(marks)
+		}
+		return false
+	}
 
+	model.SortMessages(messages)
+	var endTime time.Time
 	for _, message := range messages {
+		if message.Time.After(endTime) {
+			endTime = message.Time
+		}
 		message.SetContent("host", m.host)
 		message.Content = message.PlainTextContent()
 	}
+	endTime = endTime.Add(time.Second)
 
 	ret := map[string]any{
 		"talker":   m.conf.Talker,
 		"sender":   m.conf.Sender,
 		"keyword":  m.conf.Keyword,
-		"lastTime": m.lastTime.Format(time.DateTime),
+		"lastTime": endTime.Format(time.DateTime),
 		"length":   len(messages),
 		"messages": messages,
 	}
-	body, _ := json.Marshal(ret)
-	req, _ := http.NewRequest("POST", m.conf.URL, bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
+	body, err := m.render(ret)
+	if err != nil {
+		log.Error().Err(err).Msgf("render webhook body failed")
+		return false
+	}
+
+	entry, err := m.outbox.Add(m.key, m.conf.URL, body, endTime, marks)
+	if err != nil {
+		log.Error().Err(err).Msgf("add webhook to outbox failed")
+		return false
+	}
+
+	return m.send(entry) && hasMore
+}
+
+// scan 一个会话的查询范围
+type scan struct {
+	talker  string
+	mark    *Watermark
+	start   time.Time
+	settled time.Time // 不为零时，表示该时间之前的消息已全部写入
+}
+
+// scans 获取需要查询的会话
+// 未指定 talker 时监听所有会话，只查询会话列表中有新消息的会话
+func (m *MessageWebhook) scans(now time.Time) ([]*scan, error) {
+	if m.conf.Talker != "" {
+		talkers := util.Str2List(m.conf.Talker, ",")
+		scans := make([]*scan, 0, len(talkers))
+		for _, talker := range talkers {
+			mark := m.marks[talker]
+			scans = append(scans, &scan{talker: talker, mark: mark, start: m.startTime(mark, now)})
+		}
+		return scans, nil
+	}
+
+	sessions, err := m.db.GetSessions(context.Background(), "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	scans := make([]*scan, 0)
+	for _, session := range sessions.Items {
+		if session.UserName == "" {
+			continue
+		}
+		mark := m.marks[session.UserName]
+		start := m.startTime(mark, now)
+		if session.NTime.Before(start) {
+			continue
+		}
+		s := &scan{talker: session.UserName, mark: mark, start: start}
+		if now.Sub(session.NTime) > SettleTime {
+			s.settled = session.NTime.Add(time.Second)
+		}
+		scans = append(scans, s)
+	}
+	return scans, nil
+}
+
+// startTime 会话的查询起始时间，没有推送记录时从 hook 首次启用时开始，最多追赶 catchUp 时间内的消息
+func (m *MessageWebhook) startTime(mark *Watermark, now time.Time) time.Time {
+	start := m.since
+	if mark != nil {
+		start = mark.Time
+	}
+	if m.catchUp > 0 && start.Before(now.Add(-m.catchUp)) {
+		start = now.Add(-m.catchUp)
+	}
+	return start
+}
+
+func (m *MessageWebhook) merge(marks map[string]*Watermark) {
+	for talker, mark := range marks {
+		if m.marks[talker] == nil {
+			m.marks[talker] = &Watermark{}
+		}
+		m.marks[talker].Merge(mark)
+	}
+}
+
+// send 发送请求，返回 false 表示请求仍在队列中等待重试
+func (m *MessageWebhook) send(entry *Entry) bool {
+	log.Info().Msgf("post messages to %s, body: %s", entry.URL, entry.Body)
+	err := m.post(entry)
+	if err == nil {
+		deliveries.With("success").Inc()
+		if err := m.outbox.Done(entry.ID); err != nil {
+			log.Error().Err(err).Msgf("remove webhook %d from outbox failed", entry.ID)
+			return false
+		}
+		m.merge(entry.Watermarks)
+		return true
+	}
+
+	attempts := entry.Attempts + 1
+	if attempts > m.retry.MaxRetries {
+		deliveries.With("dead").Inc()
+		log.Error().Err(err).Msgf("post messages to %s failed after %d attempts, move to dead letter", entry.URL, attempts)
+		if err := m.outbox.Dead(entry.ID, attempts, err.Error()); err != nil {
+			log.Error().Err(err).Msgf("move webhook %d to dead letter failed", entry.ID)
+			return false
+		}
+		// 死信可以通过接口查看和重新发送，继续处理后续消息
+		m.merge(entry.Watermarks)
+		return true
+	}
+
+	deliveries.With("retry").Inc()
+	next := Backoff(attempts, m.retry.Base, m.retry.Max)
+	log.Error().Err(err).Msgf("post messages to %s failed, retry in %s", entry.URL, next)
+	if err := m.outbox.Fail(entry.ID, attempts, time.Now().Add(next), err.Error()); err != nil {
+		log.Error().Err(err).Msgf("update webhook %d failed", entry.ID)
+	}
+	return false
+}
+
+// render 生成请求体，配置了模板时使用模板渲染
+func (m *MessageWebhook) render(data map[string]any) ([]byte, error) {
+	if m.tmpl == nil {
+		return json.Marshal(data)
+	}
+	buf := &bytes.Buffer{}
+	if err := m.tmpl.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *MessageWebhook) post(entry *Entry) error {
+	req, err := http.NewRequest("POST", entry.URL, strings.NewReader(entry.Body))
+	if err != nil {
+		return err
+	}
+	contentType := m.conf.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range m.conf.Headers {
+		req.Header.Set(key, value)
+	}
+	// 每次发送时重新签名，重试请求使用新的时间戳
+	if m.conf.Secret != "" {
+		timestamp := time.Now().Unix()
+		req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(HeaderSignature, Sign(m.conf.Secret, timestamp, []byte(entry.Body)))
+	}
 
-	log.Info().Msgf("post messages to %s, body: %s", m.conf.URL, string(body))
 	resp, err := m.client.Do(req)
 	if err != nil {
-		log.Error().Err(err).Msgf("post messages failed")
+		return err
 	}
 	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
 
-	if resp.StatusCode != http.StatusOK {
-		log.Error().Msgf("post messages failed, status code: %d", resp.StatusCode)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status code: %d", resp.StatusCode)
 	}
+	return nil
 }
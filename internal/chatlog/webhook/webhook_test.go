@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sjzar/chatlog/internal/chatlog/conf"
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	hook, err := NewMessageWebhook(&conf.WebhookItem{
+		URL:      "http://localhost/hook",
+		Template: `{"msg_type":"text","content":{"text":{{json (printf "%d 条新消息: %s" .length (index .messages 0).Content)}}}}`,
+	}, nil, "", nil, RetryConfig{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := hook.render(map[string]any{
+		"length":   1,
+		"messages": []*model.Message{{Content: `引号"测试"`}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ret struct {
+		MsgType string `json:"msg_type"`
+		Content struct {
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(body, &ret); err != nil {
+		t.Fatalf("invalid json %s: %v", body, err)
+	}
+	if ret.MsgType != "text" || ret.Content.Text != `1 条新消息: 引号"测试"` {
+		t.Errorf("unexpected body: %s", body)
+	}
+}
+
+func TestInvalidTemplate(t *testing.T) {
+	_, err := NewMessageWebhook(&conf.WebhookItem{Template: "{{.messages"}, nil, "", nil, RetryConfig{}, 0)
+	if err == nil {
+		t.Error("expected template parse error")
+	}
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '1700000000.{"text":"hello"}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=1898b1f7ee8ff2fe446237422bd9b3afcdb1fff758351d6ee4236bc6f1530852"
+	got := Sign("secret", 1700000000, []byte(`{"text":"hello"}`))
+	if got != want {
+		t.Errorf("Sign() = %s, want %s", got, want)
+	}
+}
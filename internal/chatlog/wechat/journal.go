@@ -0,0 +1,176 @@
+package wechat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// JournalExt 增量解密回滚日志的扩展名，保存在解密输出文件旁
+const JournalExt = ".journal"
+
+// JournalBatch 回滚日志同步到磁盘前最多缓存的写入次数
+const JournalBatch = 256
+
+const (
+	journalMagic = "CLJ\x01"
+	journalChunk = 1 << 20
+)
+
+// journalFile 在原输出文件上修改页面，覆盖前先把原内容写入回滚日志
+// 写入按批次缓存，回滚日志同步到磁盘后才修改输出文件，失败或中断时可以用回滚日志恢复原文件
+type journalFile struct {
+	f       *os.File
+	j       *os.File
+	w       *bufio.Writer
+	size    int64
+	off     int64
+	pending []journalWrite
+}
+
+// journalWrite 缓存的写入，data 为 nil 时表示截断到 off
+type journalWrite struct {
+	data []byte
+	off  int64
+}
+
+// newJournalFile 创建回滚日志，记录 f 的原始大小
+func newJournalFile(f *os.File, path string) (*journalFile, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	j, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	jf := &journalFile{f: f, j: j, w: bufio.NewWriter(j), size: fi.Size()}
+	jf.w.WriteString(journalMagic)
+	binary.Write(jf.w, binary.LittleEndian, jf.size)
+	return jf, nil
+}
+
+func (jf *journalFile) Write(b []byte) (int, error) {
+	n, err := jf.WriteAt(b, jf.off)
+	jf.off += int64(n)
+	return n, err
+}
+
+func (jf *journalFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := jf.record(off, len(b)); err != nil {
+		return 0, err
+	}
+
+	jf.pending = append(jf.pending, journalWrite{data: append([]byte(nil), b...), off: off})
+	if len(jf.pending) >= JournalBatch {
+		if err := jf.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Truncate 截断前记录被截掉的原内容
+func (jf *journalFile) Truncate(size int64) error {
+	for off := size; off < jf.size; off += journalChunk {
+		if err := jf.record(off, int(min(journalChunk, jf.size-off))); err != nil {
+			return err
+		}
+	}
+	jf.pending = append(jf.pending, journalWrite{off: size})
+	return nil
+}
+
+// record 把原文件 [off, off+n) 的内容写入回滚日志，超出原文件的部分不记录
+func (jf *journalFile) record(off int64, n int) error {
+	old := make([]byte, n)
+	n, err := jf.f.ReadAt(old, off)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	binary.Write(jf.w, binary.LittleEndian, off)
+	binary.Write(jf.w, binary.LittleEndian, uint32(n))
+	_, err = jf.w.Write(old[:n])
+	return err
+}
+
+// flush 同步回滚日志后写入缓存的修改
+func (jf *journalFile) flush() error {
+	if err := jf.w.Flush(); err != nil {
+		return err
+	}
+	if err := jf.j.Sync(); err != nil {
+		return err
+	}
+	for _, p := range jf.pending {
+		if p.data == nil {
+			if err := jf.f.Truncate(p.off); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := jf.f.WriteAt(p.data, p.off); err != nil {
+			return err
+		}
+	}
+	jf.pending = nil
+	return jf.f.Sync()
+}
+
+// commit 写入所有缓存的修改，回滚日志保留到调用方确认结果
+func (jf *journalFile) commit() error {
+	return jf.flush()
+}
+
+// close 关闭回滚日志，未写入的修改被丢弃
+func (jf *journalFile) close() error {
+	jf.w.Flush()
+	return jf.j.Close()
+}
+
+// rollbackJournal 按回滚日志恢复 path 的原内容，日志末尾不完整的记录被忽略
+func rollbackJournal(path string, journal string) error {
+	data, err := os.ReadFile(journal)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(journalMagic)+8 || string(data[:len(journalMagic)]) != journalMagic {
+		return fmt.Errorf("invalid journal %s", journal)
+	}
+	size := int64(binary.LittleEndian.Uint64(data[len(journalMagic):]))
+
+	type record struct {
+		off  int64
+		data []byte
+	}
+	var records []record
+	for pos := len(journalMagic) + 8; pos+12 <= len(data); {
+		off := int64(binary.LittleEndian.Uint64(data[pos:]))
+		n := int(binary.LittleEndian.Uint32(data[pos+8:]))
+		pos += 12
+		if pos+n > len(data) {
+			break
+		}
+		records = append(records, record{off: off, data: data[pos : pos+n]})
+		pos += n
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// 同一位置可能被多次修改，倒序恢复使最早的原内容生效
+	for i := len(records) - 1; i >= 0; i-- {
+		if _, err := f.WriteAt(records[i].data, records[i].off); err != nil {
+			return err
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
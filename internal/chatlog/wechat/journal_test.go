@@ -0,0 +1,49 @@
+package wechat
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalRollback(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.db")
+	journal := path + JournalExt
+	orig := bytes.Repeat([]byte("0123456789abcdef"), JournalBatch)
+	if err := os.WriteFile(path, orig, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jf, err := newJournalFile(f, journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 超过一个批次的写入，同一位置修改两次，并写入超出原文件的部分
+	for i := 0; i < JournalBatch+10; i++ {
+		jf.WriteAt([]byte("xxxx"), int64(i*8%len(orig)))
+	}
+	jf.WriteAt([]byte("tail"), int64(len(orig)+100))
+	jf.Truncate(int64(len(orig) / 2))
+	jf.WriteAt([]byte("tail"), int64(len(orig)+200))
+	if err := jf.commit(); err != nil {
+		t.Fatal(err)
+	}
+	jf.close()
+	f.Close()
+
+	if got, _ := os.ReadFile(path); bytes.Equal(got, orig) {
+		t.Fatal("file not modified")
+	}
+	if err := rollbackJournal(path, journal); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, orig) {
+		t.Errorf("rollback did not restore original content")
+	}
+}
@@ -0,0 +1,275 @@
+package wechat
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/wechat/decrypt"
+)
+
+// 解密状态
+const (
+	ProgressIdle    = "idle"
+	ProgressRunning = "running"
+	ProgressDone    = "done"
+)
+
+// 文件解密状态
+const (
+	FilePending    = "pending"
+	FileDecrypting = "decrypting"
+	FileDone       = "done"
+	FileFailed     = "failed"
+)
+
+// DecryptProgress 解密进度
+type DecryptProgress struct {
+	Status      string          `json:"status"` // idle, running, done
+	StartTime   time.Time       `json:"startTime"`
+	EndTime     time.Time       `json:"endTime"`
+	TotalFiles  int             `json:"totalFiles"`
+	DoneFiles   int             `json:"doneFiles"` // 已处理的文件数，包括失败的文件
+	FailedFiles int             `json:"failedFiles"`
+	TotalBytes  int64           `json:"totalBytes"`
+	DoneBytes   int64           `json:"doneBytes"`
+	TotalPages  int64           `json:"totalPages"`
+	DonePages   int64           `json:"donePages"`
+	ETA         int64           `json:"eta"`     // 预计剩余秒数，无法估算时为 -1
+	Current     []string        `json:"current"` // 正在解密的文件
+	Files       []*FileProgress `json:"files"`
+}
+
+// FileProgress 单个文件的解密进度
+type FileProgress struct {
+	Path       string `json:"path"`
+	Status     string `json:"status"` // pending, decrypting, done, failed
+	TotalBytes int64  `json:"totalBytes"`
+	DoneBytes  int64  `json:"doneBytes"`
+	TotalPages int64  `json:"totalPages"`
+	DonePages  int64  `json:"donePages"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Failed 返回解密失败的文件
+func (p *DecryptProgress) Failed() []*FileProgress {
+	if p == nil {
+		return nil
+	}
+	var failed []*FileProgress
+	for _, f := range p.Files {
+		if f.Status == FileFailed {
+			failed = append(failed, f)
+		}
+	}
+	return failed
+}
+
+// Percent 返回按字节计算的完成百分比
+func (p *DecryptProgress) Percent() float64 {
+	if p.TotalBytes == 0 {
+		if p.Status == ProgressDone {
+			return 100
+		}
+		return 0
+	}
+	return float64(p.DoneBytes) * 100 / float64(p.TotalBytes)
+}
+
+// Bar 返回宽度为 width 的文本进度条
+func (p *DecryptProgress) Bar(width int) string {
+	filled := int(p.Percent() * float64(width) / 100)
+	filled = max(0, min(filled, width))
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", width-filled) + "]"
+}
+
+// Remaining 返回预计剩余时间，无法估算时返回 "-"
+func (p *DecryptProgress) Remaining() string {
+	if p.ETA < 0 {
+		return "-"
+	}
+	return (time.Duration(p.ETA) * time.Second).String()
+}
+
+// String 返回进度说明，如 "45.3% 12/50 files, 1024/4096 pages, 4.0MB/16.0MB, ETA 12s"
+func (p *DecryptProgress) String() string {
+	return fmt.Sprintf("%5.1f%% %d/%d files, %d/%d pages, %s/%s, ETA %s",
+		p.Percent(), p.DoneFiles, p.TotalFiles, p.DonePages, p.TotalPages,
+		formatBytes(p.DoneBytes), formatBytes(p.TotalBytes), p.Remaining())
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// progress 记录当前解密进度，所有方法并发安全
+type progress struct {
+	mutex    sync.Mutex
+	p        DecryptProgress
+	pageSize int64
+}
+
+func newProgress() *progress {
+	return &progress{p: DecryptProgress{Status: ProgressIdle, ETA: -1}}
+}
+
+// start 开始一次批量解密，sizes 为各文件大小
+func (p *progress) start(files []string, sizes []int64, pageSize int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.pageSize = int64(pageSize)
+	p.p = DecryptProgress{
+		Status:     ProgressRunning,
+		StartTime:  time.Now(),
+		TotalFiles: len(files),
+		ETA:        -1,
+		Files:      make([]*FileProgress, len(files)),
+	}
+	for i, file := range files {
+		f := &FileProgress{Path: file, Status: FilePending, TotalBytes: sizes[i], TotalPages: p.pages(sizes[i])}
+		p.p.Files[i] = f
+		p.p.TotalBytes += f.TotalBytes
+		p.p.TotalPages += f.TotalPages
+	}
+}
+
+func (p *progress) pages(size int64) int64 {
+	if p.pageSize <= 0 {
+		return 0
+	}
+	return (size + p.pageSize - 1) / p.pageSize
+}
+
+// file 返回第 i 个文件的进度，调用时需持有锁
+func (p *progress) file(i int) *FileProgress {
+	if i < 0 || i >= len(p.p.Files) {
+		return nil
+	}
+	return p.p.Files[i]
+}
+
+// fileStart 开始解密第 i 个文件
+func (p *progress) fileStart(i int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	f := p.file(i)
+	if f == nil {
+		return
+	}
+	f.Status = FileDecrypting
+	p.p.Current = append(p.p.Current, f.Path)
+}
+
+// add 记录第 i 个文件新写入的字节数
+func (p *progress) add(i int, n int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	f := p.file(i)
+	if f == nil || f.Status != FileDecrypting {
+		return
+	}
+	// 已解密的文件直接复制，输出可能略大于统计时的文件大小
+	n = min(n, f.TotalBytes-f.DoneBytes)
+	if n <= 0 {
+		return
+	}
+	pages := p.pages(f.DoneBytes+n) - p.pages(f.DoneBytes)
+	f.DoneBytes += n
+	f.DonePages += pages
+	p.p.DoneBytes += n
+	p.p.DonePages += pages
+	p.updateETA()
+}
+
+// fileDone 结束第 i 个文件，err 不为空时记录失败原因
+func (p *progress) fileDone(i int, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	f := p.file(i)
+	if f == nil || f.Status != FileDecrypting {
+		return
+	}
+	// 跳过未解密的部分，使总进度与已处理的文件一致
+	p.p.DoneBytes += f.TotalBytes - f.DoneBytes
+	p.p.DonePages += f.TotalPages - f.DonePages
+	if err != nil {
+		f.Status = FileFailed
+		f.Error = err.Error()
+		p.p.FailedFiles++
+	} else {
+		f.Status = FileDone
+		f.DoneBytes, f.DonePages = f.TotalBytes, f.TotalPages
+	}
+	p.p.DoneFiles++
+	p.p.Current = slices.DeleteFunc(p.p.Current, func(path string) bool { return path == f.Path })
+	p.updateETA()
+}
+
+// finish 结束批量解密
+func (p *progress) finish() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.p.Status = ProgressDone
+	p.p.EndTime = time.Now()
+	p.p.ETA = 0
+	p.p.Current = nil
+}
+
+func (p *progress) updateETA() {
+	elapsed := time.Since(p.p.StartTime)
+	if p.p.DoneBytes == 0 || elapsed <= 0 {
+		p.p.ETA = -1
+		return
+	}
+	remain := p.p.TotalBytes - p.p.DoneBytes
+	p.p.ETA = int64(float64(elapsed) * float64(remain) / float64(p.p.DoneBytes) / float64(time.Second))
+}
+
+// snapshot 返回当前进度的副本
+func (p *progress) snapshot() *DecryptProgress {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	s := p.p
+	s.Current = slices.Clone(p.p.Current)
+	s.Files = make([]*FileProgress, len(p.p.Files))
+	for i, f := range p.p.Files {
+		copied := *f
+		s.Files[i] = &copied
+	}
+	return &s
+}
+
+// progressWriter 统计第 i 个文件写入的字节数
+type progressWriter struct {
+	f decrypt.File
+	p *progress
+	i int
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	w.p.add(w.i, int64(n))
+	return n, err
+}
+
+func (w *progressWriter) WriteAt(b []byte, off int64) (int, error) {
+	n, err := w.f.WriteAt(b, off)
+	w.p.add(w.i, int64(n))
+	return n, err
+}
+
+func (w *progressWriter) Truncate(size int64) error {
+	return w.f.Truncate(size)
+}
@@ -0,0 +1,48 @@
+package wechat
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	p := newProgress()
+	p.start([]string{"a.db", "b.db"}, []int64{4096 * 3, 4096}, 4096)
+
+	p.fileStart(0)
+	f, err := os.Create(filepath.Join(t.TempDir(), "a.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := &progressWriter{f: f, p: p, i: 0}
+	w.Write(make([]byte, 16))
+	w.Write(make([]byte, 4096))
+	s := p.snapshot()
+	if s.DoneBytes != 4112 || s.DonePages != 2 || len(s.Current) != 1 || s.Current[0] != "a.db" {
+		t.Errorf("got %d bytes, %d pages, current %q", s.DoneBytes, s.DonePages, s.Current)
+	}
+	// 写入超过文件大小的部分不计入进度
+	w.Write(make([]byte, 4096*3))
+	p.fileStart(1)
+	p.fileDone(0, nil)
+	p.fileDone(1, errors.New("incorrect key"))
+	p.finish()
+
+	s = p.snapshot()
+	if s.Status != ProgressDone || s.DoneFiles != 2 || s.FailedFiles != 1 {
+		t.Errorf("got status %s, %d done, %d failed", s.Status, s.DoneFiles, s.FailedFiles)
+	}
+	if s.DoneBytes != s.TotalBytes || s.DonePages != 4 || s.Percent() != 100 {
+		t.Errorf("got %d/%d bytes, %d pages", s.DoneBytes, s.TotalBytes, s.DonePages)
+	}
+	failed := s.Failed()
+	if len(failed) != 1 || failed[0].Path != "b.db" || failed[0].Error != "incorrect key" {
+		t.Errorf("got failed %+v", failed)
+	}
+	if got := s.Bar(4); got != "[====]" {
+		t.Errorf("got bar %q", got)
+	}
+}
@@ -3,8 +3,11 @@ package wechat
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,6 +18,7 @@ import (
 	"github.com/sjzar/chatlog/internal/wechat"
 	"github.com/sjzar/chatlog/internal/wechat/decrypt"
 	"github.com/sjzar/chatlog/pkg/filemonitor"
+	"github.com/sjzar/chatlog/pkg/metrics"
 	"github.com/sjzar/chatlog/pkg/util"
 )
 
@@ -23,20 +27,40 @@ var (
 	MaxWaitTime  = 10 * time.Second
 )
 
+// PageStateExt 页面状态文件的扩展名，保存在解密输出文件旁
+const PageStateExt = ".pages"
+
+var (
+	// MaxDecryptRetries 微信正在写入导致 HMAC 或结果校验失败时的最大重试次数
+	MaxDecryptRetries = 3
+	// RetryDelay 重试间隔，每次重试递增
+	RetryDelay = 500 * time.Millisecond
+)
+
+var (
+	decryptTotal    = metrics.NewCounter("chatlog_decrypt_total", "Database file decryptions by result.", "result")
+	decryptDuration = metrics.NewHistogram("chatlog_decrypt_duration_seconds", "Database file decryption duration.",
+		[]float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120})
+)
+
 type Service struct {
 	conf           Config
 	lastEvents     map[string]time.Time
 	pendingActions map[string]bool
 	mutex          sync.Mutex
 	fm             *filemonitor.FileMonitor
+	progress       *progress
+	onPatch        func(output string)
 }
 
 type Config interface {
 	GetDataKey() string
 	GetDataDir() string
 	GetWorkDir() string
+	GetWorkDirKey() string
 	GetPlatform() string
 	GetVersion() int
+	GetDecryptWorkers() int
 }
 
 func NewService(conf Config) *Service {
@@ -44,9 +68,15 @@ func NewService(conf Config) *Service {
 		conf:           conf,
 		lastEvents:     make(map[string]time.Time),
 		pendingActions: make(map[string]bool),
+		progress:       newProgress(),
 	}
 }
 
+// SetPatchCallback 设置增量解密完成后的回调，输出文件在原位置修改不会产生 Create 事件，由回调通知数据库服务重新加载
+func (s *Service) SetPatchCallback(callback func(output string)) {
+	s.onPatch = callback
+}
+
 // GetWeChatInstances returns all running WeChat instances
 func (s *Service) GetWeChatInstances() []*wechat.Account {
 	wechat.Load()
@@ -69,7 +99,12 @@ func (s *Service) GetDataKey(info *wechat.Account) (string, error) {
 
 func (s *Service) StartAutoDecrypt() error {
 	log.Info().Msgf("start auto decrypt, data dir: %s", s.conf.GetDataDir())
-	dbGroup, err := filemonitor.NewFileGroup("wechat", s.conf.GetDataDir(), `.*\.db$`, []string{"fts"})
+	// v4 数据库的新消息先写入 WAL 文件，WAL 变化时同样重新解密对应的数据库
+	pattern := `.*\.db$`
+	if s.conf.GetVersion() == 4 {
+		pattern = `.*\.db(-wal)?$`
+	}
+	dbGroup, err := filemonitor.NewFileGroup("wechat", s.conf.GetDataDir(), pattern, []string{"fts"})
 	if err != nil {
 		return err
 	}
@@ -106,14 +141,15 @@ func (s *Service) DecryptFileCallback(event fsnotify.Event) error {
 	if !(event.Op.Has(fsnotify.Write) || event.Op.Has(fsnotify.Create)) {
 		return nil
 	}
+	dbFile := strings.TrimSuffix(event.Name, decrypt.WALSuffix)
 
 	s.mutex.Lock()
-	s.lastEvents[event.Name] = time.Now()
+	s.lastEvents[dbFile] = time.Now()
 
-	if !s.pendingActions[event.Name] {
-		s.pendingActions[event.Name] = true
+	if !s.pendingActions[dbFile] {
+		s.pendingActions[dbFile] = true
 		s.mutex.Unlock()
-		go s.waitAndProcess(event.Name)
+		go s.waitAndProcess(dbFile)
 	} else {
 		s.mutex.Unlock()
 	}
@@ -144,42 +180,246 @@ func (s *Service) waitAndProcess(dbFile string) {
 }
 
 func (s *Service) DecryptDBFile(dbFile string) error {
+	ctx := decrypt.WithWorkers(context.Background(), s.conf.GetDecryptWorkers())
+	return s.decryptDBFile(ctx, dbFile, nil)
+}
+
+// decryptDBFile 解密单个数据库文件，wrap 不为空时用于包装输出以记录进度
+// 解密结果校验通过后才替换原输出文件，失败时保留原文件；微信正在写入导致的校验失败会自动重试
+func (s *Service) decryptDBFile(ctx context.Context, dbFile string, wrap func(decrypt.File) decrypt.File) (err error) {
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			decryptTotal.With("failure").Inc()
+			return
+		}
+		decryptTotal.With("success").Inc()
+		decryptDuration.With().Observe(time.Since(start).Seconds())
+	}()
 
 	decryptor, err := decrypt.NewDecryptor(s.conf.GetPlatform(), s.conf.GetVersion())
 	if err != nil {
 		return err
 	}
+	cipher, err := decrypt.NewWorkDirCipher(s.conf.GetPlatform(), s.conf.GetVersion(), s.conf.GetWorkDirKey())
+	if err != nil {
+		return err
+	}
 
 	output := filepath.Join(s.conf.GetWorkDir(), dbFile[len(s.conf.GetDataDir()):])
 	if err := util.PrepareDir(filepath.Dir(output)); err != nil {
 		return err
 	}
 
+	for retry := 0; ; retry++ {
+		err = s.decryptOutput(ctx, decryptor, cipher, dbFile, output, wrap)
+		if err == nil {
+			break
+		}
+		if retry >= MaxDecryptRetries || !(err == errors.ErrDecryptHashVerificationFailed || err == errors.ErrDecryptVerifyFailed) {
+			log.Err(err).Msgf("failed to decrypt %s", dbFile)
+			return err
+		}
+		log.Debug().Err(err).Msgf("decrypt %s failed, retry %d/%d", dbFile, retry+1, MaxDecryptRetries)
+		select {
+		case <-ctx.Done():
+			return errors.ErrDecryptOperationCanceled
+		case <-time.After(RetryDelay * time.Duration(retry+1)):
+		}
+	}
+
+	return nil
+}
+
+// decryptOutput 解密一次数据库文件
+// 输出文件旁的页面状态文件记录了每个页面的 HMAC，与输出文件一致时只重新解密发生变化的页面
+// cipher 不为空时输出文件使用工作目录口令加密保存
+func (s *Service) decryptOutput(ctx context.Context, decryptor decrypt.Decryptor, cipher *decrypt.WorkDirCipher, dbFile, output string, wrap func(decrypt.File) decrypt.File) error {
+	// 上次增量解密中断时，先用回滚日志恢复原输出文件，失败时完整解密
+	journal := output + JournalExt
+	if _, err := os.Stat(journal); err == nil {
+		if err := rollbackJournal(output, journal); err != nil {
+			log.Debug().Err(err).Msgf("failed to roll back %s", output)
+			os.Remove(output + PageStateExt)
+		}
+		os.Remove(journal)
+	}
+
+	prev, _ := decrypt.LoadPageState(output + PageStateExt)
+	if prev != nil {
+		// 输出文件的加密方式与当前配置不一致（如修改了口令）时需要完整解密
+		salt, ok := outputSalt(cipher, output)
+		if fi, err := os.Stat(output); err == nil && ok && fi.Size() == prev.Size() {
+			err := s.patchOutput(ctx, decryptor, cipher, salt, dbFile, output, prev, wrap)
+			if err != errors.ErrDecryptStateMismatch {
+				return err
+			}
+		}
+	}
+
+	return s.replaceOutput(ctx, decryptor, cipher, dbFile, output, wrap)
+}
+
+// outputSalt 检查输出文件是否按 cipher 加密保存，返回加密使用的盐值；cipher 为空时要求输出文件未加密
+func outputSalt(cipher *decrypt.WorkDirCipher, output string) ([]byte, bool) {
+	if cipher != nil {
+		salt, err := cipher.Salt(output)
+		return salt, err == nil
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	header := make([]byte, len(decrypt.SQLiteHeader))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, false
+	}
+	return nil, string(header) == decrypt.SQLiteHeader
+}
+
+// replaceOutput 完整解密到临时文件，校验通过后替换原输出文件
+func (s *Service) replaceOutput(ctx context.Context, decryptor decrypt.Decryptor, cipher *decrypt.WorkDirCipher, dbFile, output string, wrap func(decrypt.File) decrypt.File) (err error) {
 	outputTemp := output + ".tmp"
+	stateFile := output + PageStateExt
+
 	outputFile, err := os.Create(outputTemp)
 	if err != nil {
 		return fmt.Errorf("failed to create output file: %v", err)
 	}
 	defer func() {
 		outputFile.Close()
-		if err := os.Rename(outputTemp, output); err != nil {
-			log.Debug().Err(err).Msgf("failed to rename %s to %s", outputTemp, output)
+		if err != nil {
+			os.Remove(outputTemp)
 		}
 	}()
 
-	if err := decryptor.Decrypt(context.Background(), dbFile, s.conf.GetDataKey(), outputFile); err != nil {
-		if err == errors.ErrAlreadyDecrypted {
-			if data, err := os.ReadFile(dbFile); err == nil {
-				outputFile.Write(data)
+	var w decrypt.File = outputFile
+	var ef *decrypt.EncryptFile
+	if cipher != nil {
+		if ef, err = cipher.EncryptFile(outputFile, nil); err != nil {
+			return err
+		}
+		w = ef
+	}
+	if wrap != nil {
+		w = wrap(w)
+	}
+
+	pageSize, pages := decryptor.GetPageSize(), int64(0)
+	state, err := decryptor.DecryptIncremental(ctx, dbFile, s.conf.GetDataKey(), w, nil)
+	switch {
+	case err == errors.ErrAlreadyDecrypted:
+		data, err := os.ReadFile(dbFile)
+		if err != nil {
+			return err
+		}
+		if cipher != nil {
+			if err := cipher.CheckPlain(data); err != nil {
+				return err
 			}
-			return nil
 		}
-		log.Err(err).Msgf("failed to decrypt %s", dbFile)
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		pageSize = 0
+	case err != nil:
 		return err
+	default:
+		pages = state.Pages()
+	}
+
+	if ef != nil {
+		if err := ef.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := outputFile.Sync(); err != nil {
+		return err
+	}
+	outputFile.Close()
+	if verr := verifyDB(ctx, outputTemp, pageSize, pages, cipher); verr != nil {
+		log.Warn().Err(verr).Msgf("verify decrypted %s failed", dbFile)
+		return errors.ErrDecryptVerifyFailed
+	}
+
+	// 先删除旧的页面状态，替换输出文件后再保存新的状态
+	os.Remove(stateFile)
+	if err := os.Rename(outputTemp, output); err != nil {
+		return err
+	}
+	if state != nil {
+		if err := state.Save(stateFile); err != nil {
+			log.Debug().Err(err).Msgf("failed to save page state %s", stateFile)
+		}
 	}
 
 	log.Debug().Msgf("Decrypted %s to %s", dbFile, output)
+	return nil
+}
+
+// patchOutput 增量解密，在原输出文件上修改发生变化的页面，覆盖前的内容先写入回滚日志
+// 校验失败时按回滚日志恢复，原文件和页面状态保持不变；完成后通知依赖 Create 事件的数据库连接、缓存和推送重新加载
+// 加密保存时使用输出文件原有的盐值重新加密修改的页面
+func (s *Service) patchOutput(ctx context.Context, decryptor decrypt.Decryptor, cipher *decrypt.WorkDirCipher, salt []byte, dbFile, output string, prev *decrypt.PageState, wrap func(decrypt.File) decrypt.File) (err error) {
+	stateFile := output + PageStateExt
+	journal := output + JournalExt
+
+	outputFile, err := os.OpenFile(output, os.O_RDWR, 0)
+	if err != nil {
+		return errors.ErrDecryptStateMismatch
+	}
+	defer outputFile.Close()
+	jf, err := newJournalFile(outputFile, journal)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		jf.close()
+		if err != nil {
+			// 回滚失败时输出文件内容未知，删除页面状态使下次完整解密
+			if rerr := rollbackJournal(output, journal); rerr != nil {
+				log.Warn().Err(rerr).Msgf("failed to roll back %s", output)
+				os.Remove(stateFile)
+			}
+		}
+		os.Remove(journal)
+	}()
+
+	var w decrypt.File = jf
+	if cipher != nil {
+		if w, err = cipher.EncryptFile(jf, salt); err != nil {
+			return err
+		}
+	}
+	if wrap != nil {
+		w = wrap(w)
+	}
 
+	state, err := decryptor.DecryptIncremental(ctx, dbFile, s.conf.GetDataKey(), w, prev)
+	if err != nil {
+		return err
+	}
+	if err := jf.commit(); err != nil {
+		return err
+	}
+	if verr := verifyDB(ctx, output, decryptor.GetPageSize(), state.Pages(), cipher); verr != nil {
+		log.Warn().Err(verr).Msgf("verify decrypted %s failed", dbFile)
+		return errors.ErrDecryptVerifyFailed
+	}
+
+	// 删除回滚日志后修改才算完成，再保存新的页面状态；两步之间中断时旧状态仍可用于下次增量解密
+	if err := os.Remove(journal); err != nil {
+		return err
+	}
+	if err := state.Save(stateFile); err != nil {
+		log.Debug().Err(err).Msgf("failed to save page state %s", stateFile)
+	}
+	if s.onPatch != nil {
+		s.onPatch(output)
+	}
+
+	log.Debug().Msgf("Decrypted %s to %s, %d of %d pages written", dbFile, output, state.Changed, state.Pages())
 	return nil
 }
 
@@ -194,12 +434,66 @@ func (s *Service) DecryptDBFiles() error {
 		return err
 	}
 
-	for _, dbFile := range dbFiles {
-		if err := s.DecryptDBFile(dbFile); err != nil {
-			log.Debug().Msgf("DecryptDBFile %s failed: %v", dbFile, err)
-			continue
+	decryptor, err := decrypt.NewDecryptor(s.conf.GetPlatform(), s.conf.GetVersion())
+	if err != nil {
+		return err
+	}
+
+	sizes := make([]int64, len(dbFiles))
+	for i, dbFile := range dbFiles {
+		if fi, err := os.Stat(dbFile); err == nil {
+			sizes[i] = fi.Size()
+		}
+	}
+	s.progress.start(dbFiles, sizes, decryptor.GetPageSize())
+	defer s.progress.finish()
+
+	// 多个文件同时解密，文件内的页面也并行解密，共享同一个并发限制
+	workers := s.conf.GetDecryptWorkers()
+	ctx := decrypt.WithWorkers(context.Background(), workers)
+
+	// 优先解密较大的文件，减少最后只剩一个大文件在解密的时间
+	order := make([]int, len(dbFiles))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return sizes[order[a]] > sizes[order[b]] })
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for n := 0; n < min(workers, len(dbFiles)); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				s.progress.fileStart(i)
+				err := s.decryptDBFile(ctx, dbFiles[i], func(f decrypt.File) decrypt.File {
+					return &progressWriter{f: f, p: s.progress, i: i}
+				})
+				s.progress.fileDone(i, err)
+				if err != nil {
+					log.Debug().Msgf("DecryptDBFile %s failed: %v", dbFiles[i], err)
+				}
+			}
+		}()
+	}
+	for _, i := range order {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if failed := s.progress.snapshot().Failed(); len(failed) > 0 {
+		log.Warn().Msgf("%d of %d files failed to decrypt", len(failed), len(dbFiles))
+		for _, f := range failed {
+			log.Warn().Msgf("decrypt %s failed: %s", f.Path, f.Error)
 		}
 	}
 
 	return nil
 }
+
+// GetProgress 返回最近一次批量解密的进度
+func (s *Service) GetProgress() *DecryptProgress {
+	return s.progress.snapshot()
+}
@@ -0,0 +1,113 @@
+package wechat
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/sjzar/chatlog/internal/wechat/decrypt"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
+)
+
+// verifyDB 检查解密后的数据库文件头、页面大小、页数，并执行 PRAGMA quick_check
+// pageSize 或 pages 为 0 时不检查对应项；cipher 不为空时先用工作目录口令解密再检查，并发数由 ctx 设置
+func verifyDB(ctx context.Context, path string, pageSize int, pages int64, cipher *decrypt.WorkDirCipher) error {
+	if cipher != nil {
+		data, err := cipher.Decrypt(ctx, path)
+		if err != nil {
+			return fmt.Errorf("decrypt: %w", err)
+		}
+		if len(data) < 100 {
+			return fmt.Errorf("read header: %w", io.ErrUnexpectedEOF)
+		}
+		if err := verifyHeader(data[:100], int64(len(data)), pageSize, pages); err != nil {
+			return err
+		}
+		// 加载到内存数据库后即释放解密结果，检查期间只保留一份内容
+		return quickCheck(dbm.OpenBytes(func() ([]byte, error) {
+			d := data
+			data = nil
+			return d, nil
+		}))
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 100)
+	_, err = io.ReadFull(f, header)
+	fi, serr := f.Stat()
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+	if serr != nil {
+		return serr
+	}
+	if err := verifyHeader(header, fi.Size(), pageSize, pages); err != nil {
+		return err
+	}
+
+	// immutable 只读打开，不创建 -wal、-shm 文件
+	db, err := sql.Open("sqlite3", sqliteURI(path)+"?immutable=1")
+	if err != nil {
+		return err
+	}
+	return quickCheck(db)
+}
+
+// verifyHeader 检查数据库文件头与文件大小
+func verifyHeader(header []byte, fileSize int64, pageSize int, pages int64) error {
+
+	if string(header[:len(decrypt.SQLiteHeader)]) != decrypt.SQLiteHeader {
+		return fmt.Errorf("invalid SQLite header")
+	}
+	size := int(binary.BigEndian.Uint16(header[16:]))
+	if size == 1 {
+		size = 65536
+	}
+	if size < 512 || (pageSize != 0 && size != pageSize) {
+		return fmt.Errorf("page size %d, expected %d", size, pageSize)
+	}
+	if fileSize%int64(size) != 0 {
+		return fmt.Errorf("file size %d is not a multiple of page size %d", fileSize, size)
+	}
+	filePages := fileSize / int64(size)
+	if pages != 0 && filePages != pages {
+		return fmt.Errorf("%d pages, expected %d", filePages, pages)
+	}
+	// 文件头中的页数在 version-valid-for 与修改计数一致时有效
+	if n := binary.BigEndian.Uint32(header[28:]); n != 0 && binary.BigEndian.Uint32(header[24:]) == binary.BigEndian.Uint32(header[92:]) && int64(n) != filePages {
+		return fmt.Errorf("header records %d pages, file has %d", n, filePages)
+	}
+	return nil
+}
+
+// quickCheck 执行 PRAGMA quick_check 并关闭数据库
+func quickCheck(db *sql.DB) error {
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return fmt.Errorf("quick_check: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("quick_check: %s", result)
+	}
+	return nil
+}
+
+// sqliteURI 返回文件路径对应的 SQLite URI
+func sqliteURI(path string) string {
+	path = filepath.ToSlash(path)
+	path = strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+	return "file:" + path
+}
@@ -0,0 +1,53 @@
+package wechat
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyDB(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test #1.db")
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"CREATE TABLE msg (id INTEGER PRIMARY KEY, content TEXT)",
+		"CREATE INDEX msg_content ON msg (content)",
+		"INSERT INTO msg (content) VALUES ('hello'), ('world')",
+		"PRAGMA wal_checkpoint(TRUNCATE)",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	os.Remove(path + "-wal")
+	os.Remove(path + "-shm")
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyDB(context.Background(), path, 4096, fi.Size()/4096, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + "-shm"); !os.IsNotExist(err) {
+		t.Errorf("verify created -shm file")
+	}
+	if err := verifyDB(context.Background(), path, 4096, fi.Size()/4096+1, nil); err == nil {
+		t.Errorf("expected page count mismatch")
+	}
+
+	// 截断最后一页
+	if err := os.Truncate(path, fi.Size()-4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyDB(context.Background(), path, 4096, 0, nil); err == nil {
+		t.Errorf("expected truncated database to fail verification")
+	}
+}
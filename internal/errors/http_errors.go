@@ -9,3 +9,15 @@ func InvalidArg(arg string) error {
 func HTTPShutDown(cause error) error {
 	return Newf(cause, http.StatusInternalServerError, "http server shut down")
 }
+
+func Unauthorized() error {
+	return New(nil, http.StatusUnauthorized, "unauthorized")
+}
+
+func Forbidden(scope string) error {
+	return Newf(nil, http.StatusForbidden, "token has no access to scope: %s", scope)
+}
+
+func OriginNotAllowed(origin string) error {
+	return Newf(nil, http.StatusForbidden, "origin not allowed: %s", origin)
+}
@@ -40,6 +40,10 @@ func RecoveryMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		defer func() {
 			if r := recover(); r != nil {
+				// 中止已经开始发送的响应，交给 net/http 断开连接
+				if r == http.ErrAbortHandler {
+					panic(r)
+				}
 
 				// 创建内部服务器错误
 				var err *Error
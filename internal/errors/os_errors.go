@@ -14,6 +14,10 @@ func ReadFileFailed(path string, cause error) *Error {
 	return Newf(cause, http.StatusInternalServerError, "failed to read file: %s", path).WithStack()
 }
 
+func WriteFileFailed(path string, cause error) *Error {
+	return Newf(cause, http.StatusInternalServerError, "failed to write file: %s", path).WithStack()
+}
+
 func IncompleteRead(cause error) *Error {
 	return New(cause, http.StatusInternalServerError, "incomplete header read during decryption").WithStack()
 }
@@ -7,6 +7,8 @@ var (
 	ErrDecryptHashVerificationFailed = New(nil, http.StatusBadRequest, "hash verification failed during decryption")
 	ErrDecryptIncorrectKey           = New(nil, http.StatusBadRequest, "incorrect decryption key")
 	ErrDecryptOperationCanceled      = New(nil, http.StatusBadRequest, "decryption operation was canceled")
+	ErrDecryptStateMismatch          = New(nil, http.StatusBadRequest, "page state does not match database file")
+	ErrDecryptVerifyFailed           = New(nil, http.StatusInternalServerError, "decrypted database verification failed")
 	ErrNoMemoryRegionsFound          = New(nil, http.StatusBadRequest, "no memory regions found")
 	ErrReadMemoryTimeout             = New(nil, http.StatusInternalServerError, "read memory timeout")
 	ErrWeChatOffline                 = New(nil, http.StatusBadRequest, "WeChat is offline")
@@ -7,9 +7,17 @@ import (
 
 var (
 	ErrTalkerEmpty     = New(nil, http.StatusBadRequest, "talker empty").WithStack()
+	ErrKeywordEmpty    = New(nil, http.StatusBadRequest, "keyword empty").WithStack()
 	ErrKeyEmpty        = New(nil, http.StatusBadRequest, "key empty").WithStack()
 	ErrMediaNotFound   = New(nil, http.StatusNotFound, "media not found").WithStack()
+	ErrMessageNotFound = New(nil, http.StatusNotFound, "message not found").WithStack()
 	ErrKeyLengthMust32 = New(nil, http.StatusBadRequest, "key length must be 32 bytes").WithStack()
+
+	ErrWebhookNotEnabled    = New(nil, http.StatusNotFound, "webhook not enabled").WithStack()
+	ErrWebhookEntryNotFound = New(nil, http.StatusNotFound, "webhook entry not found").WithStack()
+
+	ErrChangelogNotReady = New(nil, http.StatusServiceUnavailable, "changelog not ready").WithStack()
+	ErrChangelogDisabled = New(nil, http.StatusNotFound, "changelog disabled when work dir key is set").WithStack()
 )
 
 // 数据库初始化相关错误
@@ -57,6 +65,10 @@ func ContactNotFound(key string) *Error {
 	return Newf(nil, http.StatusNotFound, "contact not found: %s", key).WithStack()
 }
 
+func TalkerNotAllowed(talker string) *Error {
+	return Newf(nil, http.StatusForbidden, "talker not allowed: %s", talker).WithStack()
+}
+
 func InitCacheFailed(cause error) *Error {
 	return New(cause, http.StatusInternalServerError, "init cache failed").WithStack()
 }
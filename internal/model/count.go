@@ -0,0 +1,56 @@
+package model
+
+// CountBucket 消息按时间分组计数的间隔（秒）
+// 各时区与 UTC 的偏移都是 15 分钟的整数倍，分组后仍可以按本地时间的小时和日期汇总
+const CountBucket = 900
+
+// MessageCounts 消息的分组计数，由数据源通过聚合查询得到，不读取完整的消息
+type MessageCounts struct {
+	Talker    string            // 实际查询的会话，多个会话以英文逗号分隔
+	Total     int               // 消息总数
+	FirstTime int64             // 最早的消息时间，Unix 时间戳
+	LastTime  int64             // 最晚的消息时间，Unix 时间戳
+	Senders   map[SenderKey]int // 按会话和发送者计数，不含系统消息
+	Types     map[[2]int64]int  // 按 [Type, SubType] 计数
+	Buckets   map[int64]int     // 按时间分组计数，键为 Unix 时间戳除以 CountBucket
+}
+
+// SenderKey 发送者计数的键
+type SenderKey struct {
+	Talker string
+	Sender string
+	IsSelf bool
+}
+
+func NewMessageCounts() *MessageCounts {
+	return &MessageCounts{
+		Senders: make(map[SenderKey]int),
+		Types:   make(map[[2]int64]int),
+		Buckets: make(map[int64]int),
+	}
+}
+
+// AddTime 累计一个时间分组的消息数量，first、last 为该分组中最早和最晚的消息时间
+func (c *MessageCounts) AddTime(bucket int64, count int, first, last int64) {
+	if count == 0 {
+		return
+	}
+	if c.Total == 0 || first < c.FirstTime {
+		c.FirstTime = first
+	}
+	if c.Total == 0 || last > c.LastTime {
+		c.LastTime = last
+	}
+	c.Total += count
+	c.Buckets[bucket] += count
+}
+
+// AddType 累计一种消息类型的数量
+func (c *MessageCounts) AddType(typ, subType int64, count int) {
+	c.Types[[2]int64{typ, subType}] += count
+}
+
+// AddSender 累计一个发送者在会话中的消息数量，系统消息不计入
+func (c *MessageCounts) AddSender(talker, sender string, isSelf bool, count int) {
+	c.Senders[SenderKey{Talker: talker, Sender: sender, IsSelf: isSelf}] += count
+}
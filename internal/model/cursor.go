@@ -0,0 +1,100 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+// Cursor 消息游标，记录消息位置 (Seq, Talker) 及翻页方向
+// 消息按 Seq 排序，Seq 相同时按 Talker 排序，保证多会话查询时位置唯一
+type Cursor struct {
+	Seq    int64  `json:"s"`
+	Talker string `json:"t,omitempty"`
+	Prev   bool   `json:"p,omitempty"` // 是否向前翻页
+}
+
+// NewCursor 创建指向消息位置的游标
+func NewCursor(m *Message, prev bool) *Cursor {
+	return &Cursor{
+		Seq:    m.Seq,
+		Talker: m.Talker,
+		Prev:   prev,
+	}
+}
+
+// ParseCursor 解析游标字符串，空字符串表示从头开始（向前翻页时从最新消息开始）
+func ParseCursor(str string, prev bool) (*Cursor, bool) {
+	if str == "" {
+		c := &Cursor{Prev: prev}
+		if prev {
+			c.Seq = math.MaxInt64
+		}
+		return c, true
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, false
+	}
+	c := &Cursor{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, false
+	}
+	return c, true
+}
+
+// String 返回游标字符串
+func (c *Cursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// SeqOp 返回查询 talker 时 Seq 的比较运算符
+func (c *Cursor) SeqOp(talker string) string {
+	if c.Prev {
+		if talker < c.Talker {
+			return "<="
+		}
+		return "<"
+	}
+	if talker > c.Talker {
+		return ">="
+	}
+	return ">"
+}
+
+// Order 返回查询时 Seq 的排序方向，向前翻页时倒序读取离游标最近的消息
+func (c *Cursor) Order() string {
+	if c.Prev {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+// Trim 将消息按位置升序排列，并保留离游标最近的 limit 条
+func (c *Cursor) Trim(messages []*Message, limit int) []*Message {
+	SortMessages(messages)
+	if limit <= 0 || len(messages) <= limit {
+		return messages
+	}
+	if c.Prev {
+		return messages[len(messages)-limit:]
+	}
+	return messages[:limit]
+}
+
+// SortMessages 按消息位置 (Seq, Talker) 升序排列
+func SortMessages(messages []*Message) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messageLess(messages[i], messages[j])
+	})
+}
+
+func messageLess(a, b *Message) bool {
+	if a.Seq != b.Seq {
+		return a.Seq < b.Seq
+	}
+	return a.Talker < b.Talker
+}
@@ -0,0 +1,128 @@
+package model
+
+import (
+	"container/heap"
+	"iter"
+	"regexp"
+	"slices"
+)
+
+// MessageFilter 读取数据库时逐条应用的消息过滤条件
+type MessageFilter struct {
+	Senders []string
+	Regex   *regexp.Regexp
+}
+
+// Match 消息是否满足过滤条件
+func (f *MessageFilter) Match(m *Message) bool {
+	if len(f.Senders) > 0 && !slices.Contains(f.Senders, m.Sender) {
+		return false
+	}
+	if f.Regex != nil && !f.Regex.MatchString(m.PlainTextContent()) {
+		return false
+	}
+	return true
+}
+
+// MessageSeq 将消息列表转换为消息序列
+func MessageSeq(messages []*Message) iter.Seq2[*Message, error] {
+	return func(yield func(*Message, error) bool) {
+		for _, m := range messages {
+			if !yield(m, nil) {
+				return
+			}
+		}
+	}
+}
+
+// LimitMessages 跳过序列中的前 offset 条消息，最多返回 limit 条，limit 为 0 时不限制
+func LimitMessages(seq iter.Seq2[*Message, error], limit, offset int) iter.Seq2[*Message, error] {
+	if limit <= 0 && offset <= 0 {
+		return seq
+	}
+	return func(yield func(*Message, error) bool) {
+		n := 0
+		for m, err := range seq {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			n++
+			if n <= offset {
+				continue
+			}
+			if !yield(m, nil) {
+				return
+			}
+			if limit > 0 && n >= offset+limit {
+				return
+			}
+		}
+	}
+}
+
+// MergeMessages 多路归并按 (Seq, Talker) 升序排列的消息序列
+// 每个序列同时只读取一条消息，内存占用与序列数量相关，与消息总数无关
+func MergeMessages(seqs []iter.Seq2[*Message, error]) iter.Seq2[*Message, error] {
+	if len(seqs) == 1 {
+		return seqs[0]
+	}
+	return func(yield func(*Message, error) bool) {
+		h := make(messageHeap, 0, len(seqs))
+		for _, seq := range seqs {
+			next, stop := iter.Pull2(seq)
+			defer stop()
+			m, err, ok := next()
+			if !ok {
+				continue
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			h = append(h, &mergeItem{message: m, next: next})
+		}
+		heap.Init(&h)
+
+		for h.Len() > 0 {
+			item := h[0]
+			if !yield(item.message, nil) {
+				return
+			}
+			m, err, ok := item.next()
+			if !ok {
+				heap.Pop(&h)
+				continue
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			item.message = m
+			heap.Fix(&h, 0)
+		}
+	}
+}
+
+type mergeItem struct {
+	message *Message
+	next    func() (*Message, error, bool)
+}
+
+type messageHeap []*mergeItem
+
+func (h messageHeap) Len() int           { return len(h) }
+func (h messageHeap) Less(i, j int) bool { return messageLess(h[i].message, h[j].message) }
+func (h messageHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *messageHeap) Push(x any) {
+	*h = append(*h, x.(*mergeItem))
+}
+
+func (h *messageHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,89 @@
+package model
+
+import (
+	"errors"
+	"iter"
+	"testing"
+)
+
+func seqOf(talker string, seqs ...int64) iter.Seq2[*Message, error] {
+	messages := make([]*Message, 0, len(seqs))
+	for _, seq := range seqs {
+		messages = append(messages, &Message{Seq: seq, Talker: talker})
+	}
+	return MessageSeq(messages)
+}
+
+func TestMergeMessages(t *testing.T) {
+	merged := MergeMessages([]iter.Seq2[*Message, error]{
+		seqOf("b", 1, 4, 7),
+		seqOf("a", 2, 4, 9),
+		seqOf("c"),
+		seqOf("c", 3),
+	})
+
+	var got []string
+	for m, err := range merged {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(rune('0'+m.Seq))+m.Talker)
+	}
+	want := []string{"1b", "2a", "3c", "4a", "4b", "7b", "9a"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	// 提前结束遍历
+	n := 0
+	for range merged {
+		n++
+		if n == 2 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Errorf("break failed, n = %d", n)
+	}
+}
+
+func TestMergeMessagesError(t *testing.T) {
+	errBroken := errors.New("broken")
+	broken := func(yield func(*Message, error) bool) {
+		if !yield(&Message{Seq: 5}, nil) {
+			return
+		}
+		yield(nil, errBroken)
+	}
+
+	var seqs []int64
+	var err error
+	for m, e := range MergeMessages([]iter.Seq2[*Message, error]{seqOf("a", 1, 6, 8), broken}) {
+		if e != nil {
+			err = e
+			break
+		}
+		seqs = append(seqs, m.Seq)
+	}
+	if err != errBroken {
+		t.Errorf("err = %v, want %v", err, errBroken)
+	}
+	if len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 5 {
+		t.Errorf("unexpected messages %v", seqs)
+	}
+}
+
+func TestLimitMessages(t *testing.T) {
+	var seqs []int64
+	for m := range LimitMessages(seqOf("a", 1, 2, 3, 4, 5), 2, 1) {
+		seqs = append(seqs, m.Seq)
+	}
+	if len(seqs) != 2 || seqs[0] != 2 || seqs[1] != 3 {
+		t.Errorf("unexpected messages %v", seqs)
+	}
+}
@@ -105,6 +105,67 @@ const (
 	MessageSubTypeRedEnvelopeCover = 2003
 )
 
+// MessageTypeName 返回消息类型的名称
+func MessageTypeName(_type, subType int64) string {
+	switch _type {
+	case MessageTypeText:
+		return "文本"
+	case MessageTypeImage:
+		return "图片"
+	case MessageTypeVoice:
+		return "语音"
+	case MessageTypeCard:
+		return "名片"
+	case MessageTypeVideo:
+		return "视频"
+	case MessageTypeAnimation:
+		return "动画表情"
+	case MessageTypeLocation:
+		return "位置"
+	case MessageTypeVOIP:
+		return "语音通话"
+	case MessageTypeSystem:
+		return "系统"
+	case MessageTypeShare:
+		switch subType {
+		case MessageSubTypeText:
+			return "文本分享"
+		case MessageSubTypeLink, MessageSubTypeLink2:
+			return "链接"
+		case MessageSubTypeFile:
+			return "文件"
+		case MessageSubTypeGIF:
+			return "GIF表情"
+		case MessageSubTypeMergeForward:
+			return "合并转发"
+		case MessageSubTypeNote:
+			return "笔记"
+		case MessageSubTypeMiniProgram, MessageSubTypeMiniProgram2:
+			return "小程序"
+		case MessageSubTypeChannel:
+			return "视频号"
+		case MessageSubTypeQuote:
+			return "引用"
+		case MessageSubTypePat:
+			return "拍一拍"
+		case MessageSubTypeChannelLive:
+			return "视频号直播"
+		case MessageSubTypeChatRoomNotice:
+			return "群公告"
+		case MessageSubTypeMusic:
+			return "音乐"
+		case MessageSubTypePay:
+			return "转账"
+		case MessageSubTypeRedEnvelope:
+			return "红包"
+		case MessageSubTypeRedEnvelopeCover:
+			return "红包封面"
+		}
+		return "分享"
+	}
+	return "其他"
+}
+
 type Message struct {
 	Version    string                 `json:"-"`                  // 消息版本，内部判断
 	Seq        int64                  `json:"seq"`                // 消息序号，10位时间戳 + 3位序号
@@ -23,6 +23,7 @@ import (
 // ConBlob BLOB
 // )
 type MessageDarwinV3 struct {
+	MesLocalID    int64  `json:"mesLocalID"`
 	MsgCreateTime int64  `json:"msgCreateTime"`
 	MsgContent    string `json:"msgContent"`
 	MessageType   int64  `json:"messageType"`
@@ -32,6 +33,7 @@ type MessageDarwinV3 struct {
 func (m *MessageDarwinV3) Wrap(talker string) *Message {
 
 	_m := &Message{
+		Seq:        m.MsgCreateTime*1000000 + m.MesLocalID%1000000,
 		Time:       time.Unix(m.MsgCreateTime, 0),
 		Type:       m.MessageType,
 		Talker:     talker,
@@ -25,6 +25,7 @@ const (
 type DBFile struct {
 	Path       string
 	Salt       []byte
+	Size       int64
 	TotalPages int64
 	FirstPage  []byte
 }
@@ -63,6 +64,7 @@ func OpenDBFile(dbPath string, pageSize int) (*DBFile, error) {
 	return &DBFile{
 		Path:       dbPath,
 		Salt:       buffer[:SaltSize],
+		Size:       fileSize,
 		FirstPage:  buffer,
 		TotalPages: totalPages,
 	}, nil
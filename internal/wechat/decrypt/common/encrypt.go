@@ -0,0 +1,113 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// EncryptPage 按 DecryptPage 对应的格式加密一页，使用随机 IV
+// 第一页的前 SaltSize 字节写入 salt，明文页面的保留区域被 IV 和 HMAC 覆盖
+func EncryptPage(page []byte, salt []byte, encKey []byte, macKey []byte, pageNum int64, hashFunc func() hash.Hash, hmacSize int, reserve int, pageSize int) ([]byte, error) {
+	offset := 0
+	if pageNum == 0 {
+		offset = SaltSize
+	}
+
+	out := make([]byte, pageSize)
+	if pageNum == 0 {
+		copy(out, salt)
+	}
+
+	iv := out[pageSize-reserve : pageSize-reserve+IVSize]
+	if _, err := rand.Read(iv); err != nil {
+		return nil, errors.DecryptCreateCipherFailed(err)
+	}
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, errors.DecryptCreateCipherFailed(err)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out[offset:pageSize-reserve], page[offset:pageSize-reserve])
+
+	mac := hmac.New(hashFunc, macKey)
+	mac.Write(out[offset : pageSize-reserve+IVSize])
+	pageNoBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(pageNoBytes, uint32(pageNum+1))
+	mac.Write(pageNoBytes)
+	copy(out[pageSize-reserve+IVSize:pageSize-reserve+IVSize+hmacSize], mac.Sum(nil))
+
+	return out, nil
+}
+
+// EncryptFile 逐页加密写入 File，写入内容必须按页对齐
+type EncryptFile struct {
+	f        File
+	pageSize int
+	encrypt  PageFunc
+	buf      []byte
+	page     int64
+}
+
+// NewEncryptFile 创建加密写入的文件，encrypt 加密一页明文
+func NewEncryptFile(f File, pageSize int, encrypt PageFunc) *EncryptFile {
+	return &EncryptFile{f: f, pageSize: pageSize, encrypt: encrypt}
+}
+
+// Write 顺序写入，凑满一页后加密写入
+func (e *EncryptFile) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		m := min(len(b), e.pageSize-len(e.buf))
+		e.buf = append(e.buf, b[:m]...)
+		b = b[m:]
+		if len(e.buf) < e.pageSize {
+			break
+		}
+		if _, err := e.WriteAt(e.buf, e.page*int64(e.pageSize)); err != nil {
+			return n - len(b) - m, err
+		}
+		e.buf = e.buf[:0]
+		e.page++
+	}
+	return n, nil
+}
+
+// WriteAt 加密写入整页
+func (e *EncryptFile) WriteAt(b []byte, off int64) (int, error) {
+	if len(b)%e.pageSize != 0 || off%int64(e.pageSize) != 0 {
+		return 0, fmt.Errorf("unaligned write of %d bytes at %d", len(b), off)
+	}
+	for i := 0; i < len(b); i += e.pageSize {
+		pageNum := off/int64(e.pageSize) + int64(i/e.pageSize)
+		data, err := e.encrypt(b[i:i+e.pageSize], pageNum)
+		if err != nil {
+			return i, err
+		}
+		if _, err := e.f.WriteAt(data, pageNum*int64(e.pageSize)); err != nil {
+			return i, err
+		}
+	}
+	return len(b), nil
+}
+
+func (e *EncryptFile) Truncate(size int64) error {
+	if size == 0 {
+		e.buf = e.buf[:0]
+		e.page = 0
+	}
+	return e.f.Truncate(size)
+}
+
+// Flush 检查顺序写入的内容是否按页对齐
+func (e *EncryptFile) Flush() error {
+	if len(e.buf) != 0 {
+		return fmt.Errorf("incomplete page of %d bytes", len(e.buf))
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// PageStateMagic 页面状态文件的文件头
+const PageStateMagic = "CLPS\x01"
+
+// File 增量解密的输出文件
+type File interface {
+	io.Writer
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// PageState 记录解密时每个页面的 HMAC，用于下次只重新解密内容变化的页面
+type PageState struct {
+	Salt     []byte
+	PageSize int
+	HMACSize int
+	HMACs    []byte
+
+	// Changed 本次解密写入的页数，不保存
+	Changed int64
+}
+
+// Pages 返回已解密的页数
+func (s *PageState) Pages() int64 {
+	if s.HMACSize == 0 {
+		return 0
+	}
+	return int64(len(s.HMACs) / s.HMACSize)
+}
+
+// Size 返回解密输出文件的大小
+func (s *PageState) Size() int64 {
+	return s.Pages() * int64(s.PageSize)
+}
+
+func (s *PageState) hmac(pageNum int64) []byte {
+	return s.HMACs[pageNum*int64(s.HMACSize) : (pageNum+1)*int64(s.HMACSize)]
+}
+
+// match 检查状态是否与当前数据库文件和页面参数一致
+func (s *PageState) match(info *DBFile, pageSize int, hmacSize int) bool {
+	return s.PageSize == pageSize && s.HMACSize == hmacSize && bytes.Equal(s.Salt, info.Salt)
+}
+
+func (s *PageState) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(PageStateMagic)+8+SaltSize+len(s.HMACs)))
+	buf.WriteString(PageStateMagic)
+	binary.Write(buf, binary.LittleEndian, uint32(s.PageSize))
+	binary.Write(buf, binary.LittleEndian, uint32(s.HMACSize))
+	buf.Write(s.Salt)
+	buf.Write(s.HMACs)
+	return buf.Bytes(), nil
+}
+
+func (s *PageState) UnmarshalBinary(data []byte) error {
+	head := len(PageStateMagic) + 8 + SaltSize
+	if len(data) < head || string(data[:len(PageStateMagic)]) != PageStateMagic {
+		return fmt.Errorf("invalid page state")
+	}
+	data = data[len(PageStateMagic):]
+	pageSize := int(binary.LittleEndian.Uint32(data))
+	hmacSize := int(binary.LittleEndian.Uint32(data[4:]))
+	data = data[8:]
+	if pageSize == 0 || hmacSize == 0 || (len(data)-SaltSize)%hmacSize != 0 {
+		return fmt.Errorf("invalid page state")
+	}
+	s.PageSize = pageSize
+	s.HMACSize = hmacSize
+	s.Salt = bytes.Clone(data[:SaltSize])
+	s.HMACs = bytes.Clone(data[SaltSize:])
+	return nil
+}
+
+// LoadPageState 读取页面状态文件
+func LoadPageState(path string) (*PageState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.ReadFileFailed(path, err)
+	}
+	s := &PageState{}
+	if err := s.UnmarshalBinary(data); err != nil {
+		return nil, errors.ReadFileFailed(path, err)
+	}
+	return s, nil
+}
+
+// Save 保存页面状态文件，先写入临时文件再重命名，避免留下不完整的状态
+func (s *PageState) Save(path string) error {
+	data, _ := s.MarshalBinary()
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return errors.WriteFileFailed(temp, err)
+	}
+	if err := os.Rename(temp, path); err != nil {
+		os.Remove(temp)
+		return errors.WriteFileFailed(path, err)
+	}
+	return nil
+}
+
+// DecryptIncremental 解密 r 中的数据库内容到 output 并返回页面状态
+// prev 为空时完整解密到 output；否则 output 应为上一次的解密结果，只解密 HMAC 发生变化的页面并写入对应位置，
+// prev 与数据库的盐值和页面参数不一致时返回 ErrDecryptStateMismatch。wal 不为空时以合并 WAL 后的页面为准
+func DecryptIncremental(ctx context.Context, dbfile string, r io.Reader, output File, info *DBFile, pageSize int, reserve int, hmacSize int, prev *PageState, wal *WAL, decrypt PageFunc) (*PageState, error) {
+	macOffset := pageSize - reserve + IVSize
+	state := &PageState{
+		Salt:     bytes.Clone(info.Salt),
+		PageSize: pageSize,
+		HMACSize: hmacSize,
+	}
+
+	r, totalPages := wal.Apply(r, info, pageSize)
+	pages := totalPages
+	if wal == nil {
+		// 末尾不完整的页面不解密
+		pages = info.Size / int64(pageSize)
+	}
+
+	if prev != nil && !prev.match(info, pageSize, hmacSize) {
+		return nil, errors.ErrDecryptStateMismatch
+	}
+
+	if prev == nil {
+		if err := output.Truncate(0); err != nil {
+			return nil, errors.WriteOutputFailed(err)
+		}
+		// 全零页面不会调用 decrypt，对应的 HMAC 保持为零，与读取到的页面一致
+		hmacs := make([]byte, totalPages*int64(hmacSize))
+		err := DecryptPages(ctx, dbfile, r, output, totalPages, pageSize, func(page []byte, pageNum int64) ([]byte, error) {
+			copy(hmacs[pageNum*int64(hmacSize):], page[macOffset:macOffset+hmacSize])
+			return decrypt(page, pageNum)
+		})
+		if err != nil {
+			return nil, err
+		}
+		state.HMACs = hmacs[:pages*int64(hmacSize)]
+		state.Changed = pages
+		return state, nil
+	}
+
+	state.HMACs = make([]byte, pages*int64(hmacSize))
+	pageBuf := make([]byte, pageSize)
+	var first []byte
+	for curPage := int64(0); curPage < pages; curPage++ {
+		select {
+		case <-ctx.Done():
+			return nil, errors.ErrDecryptOperationCanceled
+		default:
+		}
+
+		if _, err := io.ReadFull(r, pageBuf); err != nil {
+			return nil, errors.ReadFileFailed(dbfile, err)
+		}
+
+		mac := pageBuf[macOffset : macOffset+hmacSize]
+		copy(state.HMACs[curPage*int64(hmacSize):], mac)
+		if curPage < prev.Pages() && bytes.Equal(prev.hmac(curPage), mac) {
+			continue
+		}
+
+		data, err := decryptPage(pageBuf, curPage, decrypt)
+		if err != nil {
+			return nil, err
+		}
+		state.Changed++
+
+		// 第一页包含 SQLite 文件修改计数，最后写入
+		if curPage == 0 {
+			first = append([]byte(SQLiteHeader), data...)
+			continue
+		}
+		if _, err := output.WriteAt(data, curPage*int64(pageSize)); err != nil {
+			return nil, errors.WriteOutputFailed(err)
+		}
+	}
+
+	if state.Size() < prev.Size() {
+		if err := output.Truncate(state.Size()); err != nil {
+			return nil, errors.WriteOutputFailed(err)
+		}
+	}
+	if first != nil {
+		if _, err := output.WriteAt(first, 0); err != nil {
+			return nil, errors.WriteOutputFailed(err)
+		}
+	}
+
+	return state, nil
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+func TestDecryptIncremental(t *testing.T) {
+	const (
+		pageSize = 64
+		reserve  = 32
+		hmacSize = 16
+	)
+	decrypt := func(page []byte, pageNum int64) ([]byte, error) {
+		out := make([]byte, len(page))
+		for i, b := range page {
+			out[i] = b ^ byte(pageNum)
+		}
+		if pageNum == 0 {
+			out = out[SaltSize:]
+		}
+		return out, nil
+	}
+	dbInfo := func(data []byte) *DBFile {
+		return &DBFile{Salt: data[:SaltSize], Size: int64(len(data)), TotalPages: int64((len(data) + pageSize - 1) / pageSize)}
+	}
+
+	dir := t.TempDir()
+	run := func(name string, data []byte, prev *PageState) (*PageState, []byte) {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		state, err := DecryptIncremental(context.Background(), "test.db", bytes.NewReader(data), f, dbInfo(data), pageSize, reserve, hmacSize, prev, nil, decrypt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := os.ReadFile(f.Name())
+		return state, out
+	}
+
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, pageSize*40)
+	r.Read(data)
+	state, _ := run("out.db", data, nil)
+	if state.Pages() != 40 || state.Changed != 40 {
+		t.Fatalf("got %d pages, %d changed", state.Pages(), state.Changed)
+	}
+
+	// 修改第 0、3、7 页，截断并追加不完整的页面
+	for _, page := range []int{0, 3, 7} {
+		r.Read(data[page*pageSize+SaltSize : (page+1)*pageSize])
+	}
+	data = append(data[:pageSize*30], make([]byte, 10)...)
+	state, got := run("out.db", data, state)
+	if state.Pages() != 30 || state.Changed != 3 {
+		t.Errorf("got %d pages, %d changed", state.Pages(), state.Changed)
+	}
+	_, want := run("full.db", data, nil)
+	if !bytes.Equal(got, want) {
+		t.Errorf("incremental output differs from full decryption")
+	}
+
+	// 追加页面
+	more := make([]byte, pageSize*5)
+	r.Read(more)
+	data = append(data[:pageSize*30], more...)
+	state, got = run("out.db", data, state)
+	if state.Pages() != 35 || state.Changed != 5 {
+		t.Errorf("got %d pages, %d changed", state.Pages(), state.Changed)
+	}
+	os.Remove(filepath.Join(dir, "full.db"))
+	_, want = run("full.db", data, nil)
+	if !bytes.Equal(got, want) {
+		t.Errorf("incremental output differs from full decryption")
+	}
+
+	// 盐值变化时不修改输出文件
+	salted := bytes.Clone(data)
+	r.Read(salted[:SaltSize])
+	f, err := os.OpenFile(filepath.Join(dir, "out.db"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := DecryptIncremental(context.Background(), "test.db", bytes.NewReader(salted), f, dbInfo(salted), pageSize, reserve, hmacSize, state, nil, decrypt); err != errors.ErrDecryptStateMismatch {
+		t.Errorf("got error %v, want state mismatch", err)
+	}
+	if out, _ := os.ReadFile(f.Name()); !bytes.Equal(out, got) {
+		t.Errorf("output modified on state mismatch")
+	}
+
+	path := filepath.Join(dir, "out.db.pages")
+	if err := state.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPageState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.Salt, state.Salt) || !bytes.Equal(loaded.HMACs, state.HMACs) || loaded.PageSize != pageSize || loaded.HMACSize != hmacSize {
+		t.Errorf("loaded state differs from saved state")
+	}
+}
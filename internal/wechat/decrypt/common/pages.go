@@ -0,0 +1,199 @@
+package common
+
+import (
+	"context"
+	"io"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// BatchPages 并行解密时每个任务包含的页数
+const BatchPages = 64
+
+// PageFunc 解密一个非零页面，pageNum 从 0 开始
+type PageFunc func(page []byte, pageNum int64) ([]byte, error)
+
+type workersKey struct{}
+
+// WithWorkers 设置并行解密页面的并发数，使用同一个 context 的多次解密共享该并发限制
+// 未设置或 n <= 1 时按顺序解密
+func WithWorkers(ctx context.Context, n int) context.Context {
+	if n <= 1 {
+		return ctx
+	}
+	return context.WithValue(ctx, workersKey{}, make(chan struct{}, n))
+}
+
+func workers(ctx context.Context) chan struct{} {
+	sem, _ := ctx.Value(workersKey{}).(chan struct{})
+	return sem
+}
+
+// DecryptPages 写入 SQLite 头后逐页解密 r 中的数据库内容，全零页面原样写入
+// 页面之间相互独立，设置并发数时按批次并行解密，输出内容与顺序解密一致
+func DecryptPages(ctx context.Context, dbfile string, r io.Reader, output io.Writer, totalPages int64, pageSize int, decrypt PageFunc) error {
+	if _, err := output.Write([]byte(SQLiteHeader)); err != nil {
+		return errors.WriteOutputFailed(err)
+	}
+
+	sem := workers(ctx)
+	if sem == nil {
+		return decryptSequential(ctx, dbfile, r, output, totalPages, pageSize, decrypt)
+	}
+	return decryptParallel(ctx, sem, dbfile, r, output, totalPages, pageSize, decrypt)
+}
+
+func decryptSequential(ctx context.Context, dbfile string, r io.Reader, output io.Writer, totalPages int64, pageSize int, decrypt PageFunc) error {
+	pageBuf := make([]byte, pageSize)
+
+	for curPage := int64(0); curPage < totalPages; curPage++ {
+		// 检查是否取消
+		select {
+		case <-ctx.Done():
+			return errors.ErrDecryptOperationCanceled
+		default:
+			// 继续处理
+		}
+
+		// 读取一页
+		n, err := io.ReadFull(r, pageBuf)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// 处理最后一部分页面
+				if n > 0 {
+					break
+				}
+			}
+			return errors.ReadFileFailed(dbfile, err)
+		}
+
+		data, err := decryptPage(pageBuf, curPage, decrypt)
+		if err != nil {
+			return err
+		}
+
+		if _, err := output.Write(data); err != nil {
+			return errors.WriteOutputFailed(err)
+		}
+	}
+
+	return nil
+}
+
+// decryptPage 解密一页，全零页面原样返回
+func decryptPage(page []byte, pageNum int64, decrypt PageFunc) ([]byte, error) {
+	for _, b := range page {
+		if b != 0 {
+			return decrypt(page, pageNum)
+		}
+	}
+	return page, nil
+}
+
+// batch 一次并行解密任务
+type batch struct {
+	data  []byte
+	first int64
+	pages int
+	out   [][]byte
+	err   error
+	done  chan struct{}
+}
+
+func (b *batch) run(pageSize int, decrypt PageFunc) {
+	defer close(b.done)
+	b.out = make([][]byte, b.pages)
+	for i := 0; i < b.pages; i++ {
+		data, err := decryptPage(b.data[i*pageSize:(i+1)*pageSize], b.first+int64(i), decrypt)
+		if err != nil {
+			b.err = err
+			return
+		}
+		b.out[i] = data
+	}
+}
+
+// decryptParallel 顺序读取页面并分批交给 goroutine 解密，按读取顺序写入结果
+// sem 限制同时在处理中的批次数量，同时限制了内存占用
+func decryptParallel(ctx context.Context, sem chan struct{}, dbfile string, r io.Reader, output io.Writer, totalPages int64, pageSize int, decrypt PageFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan *batch, cap(sem))
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(queue)
+		readErr <- readBatches(ctx, sem, dbfile, r, queue, totalPages, pageSize, decrypt)
+	}()
+
+	var err error
+	for b := range queue {
+		<-b.done
+		if err == nil {
+			err = b.err
+		}
+		if err == nil {
+			for _, data := range b.out {
+				if _, werr := output.Write(data); werr != nil {
+					err = errors.WriteOutputFailed(werr)
+					break
+				}
+			}
+		}
+		<-sem
+		if err != nil {
+			// 停止读取，继续等待已提交的批次完成
+			cancel()
+		}
+	}
+
+	if rerr := <-readErr; err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// readBatches 读取页面并提交解密任务，返回读取错误
+func readBatches(ctx context.Context, sem chan struct{}, dbfile string, r io.Reader, queue chan<- *batch, totalPages int64, pageSize int, decrypt PageFunc) error {
+	for first := int64(0); first < totalPages; first += BatchPages {
+		select {
+		case <-ctx.Done():
+			return errors.ErrDecryptOperationCanceled
+		case sem <- struct{}{}:
+		}
+
+		pages := int(min(BatchPages, totalPages-first))
+		data := make([]byte, pages*pageSize)
+		n, err := io.ReadFull(r, data)
+		full := n / pageSize
+
+		// 与顺序解密一致：忽略末尾不完整的页面，缺少整页时返回读取错误
+		var stop error
+		if err != nil {
+			if (err == io.EOF || err == io.ErrUnexpectedEOF) && n%pageSize != 0 {
+				stop = io.EOF
+			} else if err == io.ErrUnexpectedEOF {
+				stop = errors.ReadFileFailed(dbfile, io.EOF)
+			} else {
+				stop = errors.ReadFileFailed(dbfile, err)
+			}
+		}
+
+		if full == 0 {
+			<-sem
+		} else {
+			b := &batch{data: data, first: first, pages: full, done: make(chan struct{})}
+			go b.run(pageSize, decrypt)
+			queue <- b
+		}
+
+		if stop == io.EOF {
+			return nil
+		}
+		if stop != nil {
+			return stop
+		}
+	}
+	return nil
+}
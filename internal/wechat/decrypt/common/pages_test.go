@@ -0,0 +1,63 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestDecryptPages(t *testing.T) {
+	const pageSize = 64
+	decrypt := func(page []byte, pageNum int64) ([]byte, error) {
+		out := make([]byte, len(page))
+		for i, b := range page {
+			out[i] = b ^ byte(pageNum)
+		}
+		return out, nil
+	}
+
+	for _, size := range []int{0, pageSize, pageSize*BatchPages*3 + pageSize*5, pageSize*BatchPages + 17} {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(data)
+		// 保留部分全零页面
+		if size > pageSize*3 {
+			clear(data[pageSize*2 : pageSize*3])
+		}
+		totalPages := int64((size + pageSize - 1) / pageSize)
+
+		want := &bytes.Buffer{}
+		if err := DecryptPages(context.Background(), "test.db", bytes.NewReader(data), want, totalPages, pageSize, decrypt); err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int{2, 4, 16} {
+			got := &bytes.Buffer{}
+			ctx := WithWorkers(context.Background(), n)
+			if err := DecryptPages(ctx, "test.db", bytes.NewReader(data), got, totalPages, pageSize, decrypt); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("size %d, workers %d: output differs from sequential decryption", size, n)
+			}
+		}
+	}
+}
+
+func TestDecryptPagesError(t *testing.T) {
+	const pageSize = 64
+	errBad := errors.New("bad page")
+	decrypt := func(page []byte, pageNum int64) ([]byte, error) {
+		if pageNum == BatchPages*2+3 {
+			return nil, errBad
+		}
+		return page, nil
+	}
+
+	data := bytes.Repeat([]byte{1}, pageSize*BatchPages*8)
+	ctx := WithWorkers(context.Background(), 4)
+	err := DecryptPages(ctx, "test.db", bytes.NewReader(data), &bytes.Buffer{}, BatchPages*8, pageSize, decrypt)
+	if err != errBad {
+		t.Errorf("got %v, want %v", err, errBad)
+	}
+}
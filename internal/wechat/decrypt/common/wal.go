@@ -0,0 +1,152 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// WAL 文件格式常量，参考 https://www.sqlite.org/fileformat.html#the_write_ahead_log
+const (
+	WALSuffix      = "-wal"
+	WALHeaderSize  = 32
+	WALFrameHeader = 24
+	walMagic       = 0x377f0682
+)
+
+// WAL 数据库 WAL 文件中已提交的页面
+// 加密数据库的 WAL 帧头为明文，帧中的页面与数据库页面使用相同的方式加密
+type WAL struct {
+	// DBPages 最后一次提交后数据库的页数
+	DBPages int64
+	// Pages 每个页面最后一次提交的内容，页号从 0 开始
+	Pages map[int64][]byte
+}
+
+// OpenWAL 读取数据库对应的 WAL 文件，文件不存在或没有已提交的帧时返回 nil
+// 从头校验帧的盐值和校验和，遇到无效帧时停止，与 SQLite 恢复 WAL 的方式一致
+func OpenWAL(dbfile string, pageSize int) (*WAL, error) {
+	path := dbfile + WALSuffix
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.ReadFileFailed(path, err)
+	}
+	return ParseWAL(data, pageSize), nil
+}
+
+// ParseWAL 解析 WAL 文件内容，没有已提交的帧时返回 nil
+func ParseWAL(data []byte, pageSize int) *WAL {
+	if len(data) < WALHeaderSize {
+		return nil
+	}
+	magic := binary.BigEndian.Uint32(data)
+	if magic&^1 != walMagic || int(binary.BigEndian.Uint32(data[8:])) != pageSize {
+		return nil
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if magic&1 == 1 {
+		order = binary.BigEndian
+	}
+
+	s1, s2 := walChecksum(order, data[:24], 0, 0)
+	if s1 != binary.BigEndian.Uint32(data[24:]) || s2 != binary.BigEndian.Uint32(data[28:]) {
+		return nil
+	}
+	salt := data[16:24]
+
+	wal := &WAL{Pages: make(map[int64][]byte)}
+	pending := make(map[int64][]byte)
+	frameSize := WALFrameHeader + pageSize
+	for off := WALHeaderSize; off+frameSize <= len(data); off += frameSize {
+		frame := data[off : off+frameSize]
+		if !bytes.Equal(frame[8:16], salt) {
+			break
+		}
+		s1, s2 = walChecksum(order, frame[:8], s1, s2)
+		s1, s2 = walChecksum(order, frame[WALFrameHeader:], s1, s2)
+		if s1 != binary.BigEndian.Uint32(frame[16:]) || s2 != binary.BigEndian.Uint32(frame[20:]) {
+			break
+		}
+
+		pgno := binary.BigEndian.Uint32(frame)
+		if pgno == 0 {
+			break
+		}
+		pending[int64(pgno)-1] = frame[WALFrameHeader:]
+
+		// 提交帧记录提交后的数据库页数
+		if commit := binary.BigEndian.Uint32(frame[4:]); commit > 0 {
+			for pageNum, page := range pending {
+				wal.Pages[pageNum] = page
+			}
+			clear(pending)
+			wal.DBPages = int64(commit)
+		}
+	}
+
+	if wal.DBPages == 0 {
+		return nil
+	}
+	for pageNum := range wal.Pages {
+		if pageNum >= wal.DBPages {
+			delete(wal.Pages, pageNum)
+		}
+	}
+	return wal
+}
+
+// walChecksum 按 SQLite WAL 的校验和算法累加计算，data 长度为 8 的倍数
+func walChecksum(order binary.ByteOrder, data []byte, s1, s2 uint32) (uint32, uint32) {
+	for i := 0; i+8 <= len(data); i += 8 {
+		s1 += order.Uint32(data[i:]) + s2
+		s2 += order.Uint32(data[i+4:]) + s1
+	}
+	return s1, s2
+}
+
+// Apply 返回合并 WAL 后的数据库内容和页数，r 为数据库文件内容，w 为 nil 时原样返回
+// 数据库中超出 DBPages 的页面被丢弃，数据库和 WAL 中都不存在的页面为全零
+func (w *WAL) Apply(r io.Reader, info *DBFile, pageSize int) (io.Reader, int64) {
+	if w == nil {
+		return r, info.TotalPages
+	}
+	return &walReader{r: r, wal: w, dbPages: info.Size / int64(pageSize), page: make([]byte, pageSize)}, w.DBPages
+}
+
+type walReader struct {
+	r       io.Reader
+	wal     *WAL
+	dbPages int64
+	page    []byte
+	cur     int64
+	buf     []byte
+}
+
+func (r *walReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.cur >= r.wal.DBPages {
+			return 0, io.EOF
+		}
+		if r.cur < r.dbPages {
+			if _, err := io.ReadFull(r.r, r.page); err != nil {
+				return 0, err
+			}
+		} else {
+			clear(r.page)
+		}
+		if page, ok := r.wal.Pages[r.cur]; ok {
+			copy(r.page, page)
+		}
+		r.buf = r.page
+		r.cur++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
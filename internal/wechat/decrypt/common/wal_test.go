@@ -0,0 +1,78 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// buildWAL 按 SQLite 格式生成 WAL 文件，commits[i] 不为零时第 i 帧为提交帧
+func buildWAL(pageSize int, pgnos []uint32, commits []uint32, pages [][]byte) []byte {
+	order := binary.LittleEndian
+	hdr := make([]byte, WALHeaderSize)
+	binary.BigEndian.PutUint32(hdr, walMagic)
+	binary.BigEndian.PutUint32(hdr[4:], 3007000)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(pageSize))
+	copy(hdr[16:24], "saltsalt")
+	s1, s2 := walChecksum(order, hdr[:24], 0, 0)
+	binary.BigEndian.PutUint32(hdr[24:], s1)
+	binary.BigEndian.PutUint32(hdr[28:], s2)
+
+	data := hdr
+	for i, pgno := range pgnos {
+		frame := make([]byte, WALFrameHeader, WALFrameHeader+pageSize)
+		binary.BigEndian.PutUint32(frame, pgno)
+		binary.BigEndian.PutUint32(frame[4:], commits[i])
+		copy(frame[8:16], hdr[16:24])
+		frame = append(frame, pages[i]...)
+		s1, s2 = walChecksum(order, frame[:8], s1, s2)
+		s1, s2 = walChecksum(order, frame[WALFrameHeader:], s1, s2)
+		binary.BigEndian.PutUint32(frame[16:], s1)
+		binary.BigEndian.PutUint32(frame[20:], s2)
+		data = append(data, frame...)
+	}
+	return data
+}
+
+func TestParseWAL(t *testing.T) {
+	const pageSize = 64
+	page := func(b byte) []byte { return bytes.Repeat([]byte{b}, pageSize) }
+
+	// 第一个事务修改第 2 页，第二个事务修改第 1、2 页并新增第 4 页，最后一个事务未提交
+	data := buildWAL(pageSize,
+		[]uint32{2, 1, 2, 4, 3},
+		[]uint32{3, 0, 0, 4, 0},
+		[][]byte{page('a'), page('b'), page('c'), page('d'), page('e')})
+	// 末尾不完整的帧
+	data = append(data, make([]byte, 30)...)
+
+	wal := ParseWAL(data, pageSize)
+	if wal == nil || wal.DBPages != 4 || len(wal.Pages) != 3 {
+		t.Fatalf("got %+v", wal)
+	}
+	if !bytes.Equal(wal.Pages[1], page('c')) || !bytes.Equal(wal.Pages[0], page('b')) {
+		t.Errorf("got stale page content")
+	}
+
+	db := append(append(page('1'), page('2')...), page('3')...)
+	info := &DBFile{Size: int64(len(db)), TotalPages: 3}
+	r, totalPages := wal.Apply(bytes.NewReader(db), info, pageSize)
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Join([][]byte{page('b'), page('c'), page('3'), page('d')}, nil)
+	if totalPages != 4 || !bytes.Equal(got, want) {
+		t.Errorf("got %d pages, merged content differs", totalPages)
+	}
+
+	// 校验和错误的帧及之后的帧都被忽略
+	data[WALHeaderSize+WALFrameHeader+pageSize+WALFrameHeader] ^= 1
+	if wal := ParseWAL(data, pageSize); wal == nil || wal.DBPages != 3 || len(wal.Pages) != 1 {
+		t.Errorf("got %+v", wal)
+	}
+	if wal := ParseWAL(data[:WALHeaderSize], pageSize); wal != nil {
+		t.Errorf("got %+v for empty WAL", wal)
+	}
+}
@@ -5,15 +5,39 @@ import (
 	"io"
 
 	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/common"
 	"github.com/sjzar/chatlog/internal/wechat/decrypt/darwin"
 	"github.com/sjzar/chatlog/internal/wechat/decrypt/windows"
 )
 
+type (
+	// File 增量解密的输出文件
+	File = common.File
+	// PageState 解密时每个页面的 HMAC
+	PageState = common.PageState
+	// EncryptFile 加密写入的输出文件
+	EncryptFile = common.EncryptFile
+)
+
+const (
+	// SQLiteHeader 解密后数据库的文件头
+	SQLiteHeader = common.SQLiteHeader
+	// WALSuffix 数据库 WAL 文件的后缀
+	WALSuffix = common.WALSuffix
+)
+
 // Decryptor 定义数据库解密的接口
 type Decryptor interface {
 	// Decrypt 解密数据库
 	Decrypt(ctx context.Context, dbfile string, key string, output io.Writer) error
 
+	// DecryptIncremental 增量解密数据库，prev 为上一次解密的页面状态，为空时完整解密
+	// prev 与数据库不匹配时返回 ErrDecryptStateMismatch，不修改 output
+	DecryptIncremental(ctx context.Context, dbfile string, key string, output common.File, prev *common.PageState) (*common.PageState, error)
+
+	// Encrypter 返回使用 key 和 salt 按相同格式加密页面的函数，用于加密保存工作目录中的数据库
+	Encrypter(key string, salt []byte) (common.PageFunc, error)
+
 	// Validate 验证密钥是否有效
 	Validate(page1 []byte, key []byte) bool
 
@@ -46,3 +70,13 @@ func NewDecryptor(platform string, version int) (Decryptor, error) {
 		return nil, errors.PlatformUnsupported(platform, version)
 	}
 }
+
+// WithWorkers 设置并行解密页面的并发数，使用同一个 context 的多次解密共享该并发限制
+func WithWorkers(ctx context.Context, n int) context.Context {
+	return common.WithWorkers(ctx, n)
+}
+
+// LoadPageState 读取页面状态文件
+func LoadPageState(path string) (*PageState, error) {
+	return common.LoadPageState(path)
+}
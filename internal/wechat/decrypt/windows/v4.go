@@ -72,28 +72,40 @@ func (d *V4Decryptor) Validate(page1 []byte, key []byte) bool {
 	return common.ValidateKey(page1, key, salt, d.hashFunc, d.hmacSize, d.reserve, d.pageSize, d.deriveKeys)
 }
 
-// Decrypt 解密数据库
-func (d *V4Decryptor) Decrypt(ctx context.Context, dbfile string, hexKey string, output io.Writer) error {
+// open 读取数据库基本信息并验证密钥，返回页面解密函数
+func (d *V4Decryptor) open(dbfile string, hexKey string) (*common.DBFile, common.PageFunc, error) {
 	// 解码密钥
 	key, err := hex.DecodeString(hexKey)
 	if err != nil {
-		return errors.DecodeKeyFailed(err)
+		return nil, nil, errors.DecodeKeyFailed(err)
 	}
 
 	// 打开数据库文件并读取基本信息
 	dbInfo, err := common.OpenDBFile(dbfile, d.pageSize)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	// 验证密钥
 	if !d.Validate(dbInfo.FirstPage, key) {
-		return errors.ErrDecryptIncorrectKey
+		return nil, nil, errors.ErrDecryptIncorrectKey
 	}
 
 	// 计算密钥
 	encKey, macKey := d.deriveKeys(key, dbInfo.Salt)
 
+	return dbInfo, func(page []byte, pageNum int64) ([]byte, error) {
+		return common.DecryptPage(page, encKey, macKey, pageNum, d.hashFunc, d.hmacSize, d.reserve, d.pageSize)
+	}, nil
+}
+
+// Decrypt 解密数据库
+func (d *V4Decryptor) Decrypt(ctx context.Context, dbfile string, hexKey string, output io.Writer) error {
+	dbInfo, decryptPage, err := d.open(dbfile, hexKey)
+	if err != nil {
+		return err
+	}
+
 	// 打开数据库文件
 	dbFile, err := os.Open(dbfile)
 	if err != nil {
@@ -101,68 +113,48 @@ func (d *V4Decryptor) Decrypt(ctx context.Context, dbfile string, hexKey string,
 	}
 	defer dbFile.Close()
 
-	// 写入SQLite头
-	_, err = output.Write([]byte(common.SQLiteHeader))
+	// 合并 WAL 中已提交的页面
+	wal, err := common.OpenWAL(dbfile, d.pageSize)
+	if err != nil {
+		return err
+	}
+	r, totalPages := wal.Apply(dbFile, dbInfo, d.pageSize)
+
+	// 逐页解密
+	return common.DecryptPages(ctx, dbfile, r, output, totalPages, d.pageSize, decryptPage)
+}
+
+// DecryptIncremental 增量解密数据库，只重新解密与 prev 相比发生变化的页面
+func (d *V4Decryptor) DecryptIncremental(ctx context.Context, dbfile string, hexKey string, output common.File, prev *common.PageState) (*common.PageState, error) {
+	dbInfo, decryptPage, err := d.open(dbfile, hexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dbFile, err := os.Open(dbfile)
 	if err != nil {
-		return errors.WriteOutputFailed(err)
+		return nil, errors.OpenFileFailed(dbfile, err)
 	}
+	defer dbFile.Close()
 
-	// 处理每一页
-	pageBuf := make([]byte, d.pageSize)
-
-	for curPage := int64(0); curPage < dbInfo.TotalPages; curPage++ {
-		// 检查是否取消
-		select {
-		case <-ctx.Done():
-			return errors.ErrDecryptOperationCanceled
-		default:
-			// 继续处理
-		}
-
-		// 读取一页
-		n, err := io.ReadFull(dbFile, pageBuf)
-		if err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				// 处理最后一部分页面
-				if n > 0 {
-					break
-				}
-			}
-			return errors.ReadFileFailed(dbfile, err)
-		}
-
-		// 检查页面是否全为零
-		allZeros := true
-		for _, b := range pageBuf {
-			if b != 0 {
-				allZeros = false
-				break
-			}
-		}
-
-		if allZeros {
-			// 写入零页面
-			_, err = output.Write(pageBuf)
-			if err != nil {
-				return errors.WriteOutputFailed(err)
-			}
-			continue
-		}
-
-		// 解密页面
-		decryptedData, err := common.DecryptPage(pageBuf, encKey, macKey, curPage, d.hashFunc, d.hmacSize, d.reserve, d.pageSize)
-		if err != nil {
-			return err
-		}
-
-		// 写入解密后的页面
-		_, err = output.Write(decryptedData)
-		if err != nil {
-			return errors.WriteOutputFailed(err)
-		}
+	wal, err := common.OpenWAL(dbfile, d.pageSize)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return common.DecryptIncremental(ctx, dbfile, dbFile, output, dbInfo, d.pageSize, d.reserve, d.hmacSize, prev, wal, decryptPage)
+}
+
+// Encrypter 返回使用 key 和 salt 按相同格式加密页面的函数
+func (d *V4Decryptor) Encrypter(hexKey string, salt []byte) (common.PageFunc, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, errors.DecodeKeyFailed(err)
+	}
+	encKey, macKey := d.deriveKeys(key, salt)
+	return func(page []byte, pageNum int64) ([]byte, error) {
+		return common.EncryptPage(page, salt, encKey, macKey, pageNum, d.hashFunc, d.hmacSize, d.reserve, d.pageSize)
+	}, nil
 }
 
 // GetPageSize 返回页面大小
@@ -0,0 +1,103 @@
+package decrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt/common"
+)
+
+// WorkDirCipher 使用 chatlog 口令加密保存工作目录中的数据库
+// 页面格式与对应平台的微信数据库相同（SQLCipher），密钥为口令的 SHA-256，
+// 可以用 SQLCipher 的 PRAGMA hexkey 配合对应版本的兼容参数打开
+type WorkDirCipher struct {
+	decryptor Decryptor
+	key       string
+}
+
+// NewWorkDirCipher 创建工作目录加密器，passphrase 为空时返回 nil
+func NewWorkDirCipher(platform string, version int, passphrase string) (*WorkDirCipher, error) {
+	if passphrase == "" {
+		return nil, nil
+	}
+	decryptor, err := NewDecryptor(platform, version)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256([]byte(passphrase))
+	return &WorkDirCipher{decryptor: decryptor, key: hex.EncodeToString(key[:])}, nil
+}
+
+// EncryptFile 返回加密写入 output 的文件，salt 为空时生成新的盐值
+// 在已加密的文件上修改页面时需要使用该文件原有的盐值
+func (c *WorkDirCipher) EncryptFile(output File, salt []byte) (*EncryptFile, error) {
+	if salt == nil {
+		salt = make([]byte, common.SaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+	encrypt, err := c.decryptor.Encrypter(c.key, salt)
+	if err != nil {
+		return nil, err
+	}
+	return common.NewEncryptFile(output, c.decryptor.GetPageSize(), encrypt), nil
+}
+
+// Salt 检查 path 是否使用当前口令加密，返回文件的盐值
+func (c *WorkDirCipher) Salt(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.OpenFileFailed(path, err)
+	}
+	defer f.Close()
+
+	page := make([]byte, c.decryptor.GetPageSize())
+	if _, err := io.ReadFull(f, page); err != nil {
+		return nil, errors.ReadFileFailed(path, err)
+	}
+	if bytes.HasPrefix(page, []byte(SQLiteHeader)) {
+		return nil, errors.ErrAlreadyDecrypted
+	}
+	key, _ := hex.DecodeString(c.key)
+	if !c.decryptor.Validate(page, key) {
+		return nil, errors.ErrDecryptIncorrectKey
+	}
+	return page[:common.SaltSize], nil
+}
+
+// CheckPlain 检查未加密的数据库能否加密保存：页面大小一致，且每页保留区域足够存放 IV 和 HMAC
+func (c *WorkDirCipher) CheckPlain(header []byte) error {
+	if len(header) < 21 || !bytes.HasPrefix(header, []byte(SQLiteHeader)) {
+		return fmt.Errorf("invalid SQLite header")
+	}
+	pageSize := int(binary.BigEndian.Uint16(header[16:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize != c.decryptor.GetPageSize() || int(header[20]) < c.decryptor.GetReserve() {
+		return fmt.Errorf("page size %d with %d reserved bytes cannot be encrypted", pageSize, header[20])
+	}
+	return nil
+}
+
+// Decrypt 解密工作目录中加密保存的数据库，文件未加密时返回 ErrAlreadyDecrypted
+// 并发数由 ctx 中的 WithWorkers 设置
+func (c *WorkDirCipher) Decrypt(ctx context.Context, path string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if fi, err := os.Stat(path); err == nil {
+		buf.Grow(int(fi.Size()))
+	}
+	if err := c.decryptor.Decrypt(ctx, path, c.key, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,80 @@
+package decrypt
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+func TestWorkDirCipher(t *testing.T) {
+	cipher, err := NewWorkDirCipher("windows", 4, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pageSize, reserve := cipher.decryptor.GetPageSize(), cipher.decryptor.GetReserve()
+
+	data := make([]byte, 3*pageSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	copy(data, SQLiteHeader)
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef, err := cipher.EncryptFile(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 分多次写入，跨越页面边界
+	for _, chunk := range [][]byte{data[:100], data[100 : 2*pageSize+7], data[2*pageSize+7:]} {
+		if _, err := ef.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ef.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	encrypted, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encrypted) != len(data) || bytes.HasPrefix(encrypted, []byte(SQLiteHeader)) {
+		t.Fatalf("unexpected encrypted file of %d bytes", len(encrypted))
+	}
+	if _, err := cipher.Salt(path); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cipher.Decrypt(WithWorkers(context.Background(), 2), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(data) {
+		t.Fatalf("decrypted %d bytes, want %d", len(got), len(data))
+	}
+	// 保留区域被 IV 和 HMAC 覆盖，只比较页面内容
+	for i := 0; i < len(data); i += pageSize {
+		if !bytes.Equal(got[i:i+pageSize-reserve], data[i:i+pageSize-reserve]) {
+			t.Errorf("page %d mismatch", i/pageSize)
+		}
+	}
+
+	other, err := NewWorkDirCipher("windows", 4, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Salt(path); err != errors.ErrDecryptIncorrectKey {
+		t.Errorf("Salt with wrong passphrase = %v, want ErrDecryptIncorrectKey", err)
+	}
+	if c, _ := NewWorkDirCipher("windows", 4, ""); c != nil {
+		t.Errorf("expected nil cipher for empty passphrase")
+	}
+}
@@ -0,0 +1,143 @@
+package darwinv3
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
+	"github.com/sjzar/chatlog/pkg/util"
+)
+
+// senderExpr 群聊消息内容以 "发送者:\n" 开头，与 Wrap 一样取第一个 ":\n" 之前的部分
+const senderExpr = `CASE WHEN instr(msgContent, ':' || char(10)) > 0 THEN substr(msgContent, 1, instr(msgContent, ':' || char(10)) - 1) ELSE '' END`
+
+// CountMessages 通过聚合查询统计会话在时间范围内的消息数量，按发送者、类型和时间分组
+// 只有分享消息需要读取完整内容来确定子类型
+func (ds *DataSource) CountMessages(ctx context.Context, startTime, endTime time.Time, talker string) (*model.MessageCounts, error) {
+	talkers := util.Str2List(talker, ",")
+	if len(talkers) == 0 {
+		return nil, errors.ErrTalkerEmpty
+	}
+
+	counts := model.NewMessageCounts()
+	for _, talkerItem := range talkers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		_talkerMd5Bytes := md5.Sum([]byte(talkerItem))
+		talkerMd5 := hex.EncodeToString(_talkerMd5Bytes[:])
+		dbPath, ok := ds.talkerDBMap[talkerMd5]
+		if !ok {
+			continue
+		}
+
+		db, err := ds.dbm.OpenDB(dbPath)
+		if err != nil {
+			log.Error().Msgf("数据库 %s 未打开", dbPath)
+			continue
+		}
+
+		if err := countTable(ctx, db, "Chat_"+talkerMd5, talkerItem, startTime, endTime, counts); err != nil {
+			return nil, err
+		}
+	}
+
+	return counts, nil
+}
+
+// countTable 统计单个会话的消息表
+func countTable(ctx context.Context, db *sql.DB, tableName, talker string, startTime, endTime time.Time, counts *model.MessageCounts) error {
+	args := []interface{}{startTime.Unix(), endTime.Unix()}
+
+	query := fmt.Sprintf(`
+		SELECT msgCreateTime / %d, COUNT(*), MIN(msgCreateTime), MAX(msgCreateTime)
+		FROM %s
+		WHERE msgCreateTime >= ? AND msgCreateTime <= ?
+		GROUP BY 1
+	`, model.CountBucket, tableName)
+	err := dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+		var bucket, first, last int64
+		var count int
+		if err := rows.Scan(&bucket, &count, &first, &last); err != nil {
+			return err
+		}
+		counts.AddTime(bucket, count, first, last)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf(`
+		SELECT messageType, COUNT(*)
+		FROM %s
+		WHERE msgCreateTime >= ? AND msgCreateTime <= ? AND messageType != %d
+		GROUP BY messageType
+	`, tableName, model.MessageTypeShare)
+	err = dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+		var typ int64
+		var count int
+		if err := rows.Scan(&typ, &count); err != nil {
+			return err
+		}
+		counts.AddType(typ, 0, count)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 分享消息的子类型记录在内容的 XML 中
+	query = fmt.Sprintf(`
+		SELECT messageType, msgContent
+		FROM %s
+		WHERE msgCreateTime >= ? AND msgCreateTime <= ? AND messageType = %d
+	`, tableName, model.MessageTypeShare)
+	err = dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+		var msg model.MessageDarwinV3
+		if err := rows.Scan(&msg.MessageType, &msg.MsgContent); err != nil {
+			return err
+		}
+		m := msg.Wrap(talker)
+		counts.AddType(m.Type, m.SubType, 1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	isChatRoom := strings.HasSuffix(talker, "@chatroom")
+	senderCol := "''"
+	if isChatRoom {
+		senderCol = senderExpr
+	}
+	query = fmt.Sprintf(`
+		SELECT %s, mesDes, COUNT(*)
+		FROM %s
+		WHERE msgCreateTime >= ? AND msgCreateTime <= ? AND messageType != %d
+		GROUP BY 1, 2
+	`, senderCol, tableName, model.MessageTypeSystem)
+	return dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+		var sender string
+		var mesDes, count int
+		if err := rows.Scan(&sender, &mesDes, &count); err != nil {
+			return err
+		}
+		isSelf := mesDes == 0
+		if !isChatRoom && !isSelf {
+			sender = talker
+		}
+		counts.AddSender(talker, sender, isSelf, count)
+		return nil
+	})
+}
@@ -3,8 +3,10 @@ package darwinv3
 import (
 	"context"
 	"crypto/md5"
+	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"iter"
 	"regexp"
 	"sort"
 	"strings"
@@ -64,10 +66,11 @@ type DataSource struct {
 	user2DisplayName map[string]string
 }
 
-func New(path string) (*DataSource, error) {
+// New 创建数据源，decrypter 不为空时工作目录中的数据库为加密保存
+func New(path string, decrypter dbm.Decrypter) (*DataSource, error) {
 	ds := &DataSource{
 		path:             path,
-		dbm:              dbm.NewDBManager(path),
+		dbm:              dbm.NewDBManager(path, decrypter),
 		talkerDBMap:      make(map[string]string),
 		user2DisplayName: make(map[string]string),
 	}
@@ -191,7 +194,22 @@ func (ds *DataSource) initChatRoomDb() error {
 	return nil
 }
 
+// SeqExpr darwinv3 消息表没有消息序号，使用 10位时间戳 + 6位本地序号 生成 Seq
+// 查询时按 SeqExpr 排序，与游标比较的顺序一致；Seq 相同（同一秒内本地序号相差 10^6 的整数倍）时按 mesLocalID 排序
+const SeqExpr = "(msgCreateTime * 1000000 + mesLocalID % 1000000)"
+
 func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	return ds.getMessages(ctx, startTime, endTime, talker, sender, keyword, nil, limit, offset)
+}
+
+func (ds *DataSource) GetMessagesByCursor(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, cursor *model.Cursor, limit int) ([]*model.Message, error) {
+	return ds.getMessages(ctx, startTime, endTime, talker, sender, keyword, cursor, limit, 0)
+}
+
+// getMessages 查询消息，cursor 不为空时只返回游标之后（或之前）的 limit 条消息
+func (ds *DataSource) getMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, cursor *model.Cursor, limit, offset int) ([]*model.Message, error) {
+	scanned := dbm.RowCounterFrom(ctx)
+
 	if talker == "" {
 		return nil, errors.ErrTalkerEmpty
 	}
@@ -243,15 +261,24 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 		tableName := fmt.Sprintf("Chat_%s", talkerMd5)
 
 		// 构建查询条件
+		conditions := []string{"msgCreateTime >= ? AND msgCreateTime <= ?"}
+		args := []interface{}{startTime.Unix(), endTime.Unix()}
+		order := "ASC"
+		if cursor != nil {
+			conditions = append(conditions, SeqExpr+" "+cursor.SeqOp(talkerItem)+" ?")
+			args = append(args, cursor.Seq)
+			order = cursor.Order()
+		}
+
 		query := fmt.Sprintf(`
-			SELECT msgCreateTime, msgContent, messageType, mesDes
+			SELECT mesLocalID, msgCreateTime, msgContent, messageType, mesDes
 			FROM %s 
-			WHERE msgCreateTime >= ? AND msgCreateTime <= ? 
-			ORDER BY msgCreateTime ASC
-		`, tableName)
+			WHERE %s 
+			ORDER BY %s %s, mesLocalID %s
+		`, tableName, strings.Join(conditions, " AND "), SeqExpr, order, order)
 
 		// 执行查询
-		rows, err := db.QueryContext(ctx, query, startTime.Unix(), endTime.Unix())
+		rows, err := db.QueryContext(ctx, query, args...)
 		if err != nil {
 			// 如果表不存在，跳过此talker
 			if strings.Contains(err.Error(), "no such table") {
@@ -262,9 +289,12 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 		}
 
 		// 处理查询结果，在读取时进行过滤
+		matched := 0
 		for rows.Next() {
+			scanned.Inc()
 			var msg model.MessageDarwinV3
 			err := rows.Scan(
+				&msg.MesLocalID,
 				&msg.MsgCreateTime,
 				&msg.MsgContent,
 				&msg.MessageType,
@@ -303,6 +333,15 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 
 			// 通过所有过滤条件，保留此消息
 			filteredMessages = append(filteredMessages, message)
+			matched++
+
+			// 游标查询时，每个会话最多读取 limit 条离游标最近的消息
+			if cursor != nil {
+				if limit > 0 && matched >= limit {
+					break
+				}
+				continue
+			}
 
 			// 检查是否已经满足分页处理数量
 			if limit > 0 && len(filteredMessages) >= offset+limit {
@@ -328,6 +367,10 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 		rows.Close()
 	}
 
+	if cursor != nil {
+		return cursor.Trim(filteredMessages, limit), nil
+	}
+
 	// 对所有消息按时间排序
 	// FIXME 不同 talker 需要使用 Time 排序
 	sort.Slice(filteredMessages, func(i, j int) bool {
@@ -363,6 +406,99 @@ func extractTalkerFromTableName(tableName string) string {
 	return strings.TrimPrefix(tableName, "Chat_")
 }
 
+// IterMessages 流式查询消息，各会话的查询结果按 Seq 多路归并后逐条返回
+func (ds *DataSource) IterMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string) (iter.Seq2[*model.Message, error], error) {
+	if talker == "" {
+		return nil, errors.ErrTalkerEmpty
+	}
+
+	// 解析talker参数，支持多个talker（以英文逗号分隔）
+	talkers := util.Str2List(talker, ",")
+	if len(talkers) == 0 {
+		return nil, errors.ErrTalkerEmpty
+	}
+
+	filter := &model.MessageFilter{Senders: util.Str2List(sender, ",")}
+	if keyword != "" {
+		regex, err := regexp.Compile(keyword)
+		if err != nil {
+			return nil, errors.QueryFailed("invalid regex pattern", err)
+		}
+		filter.Regex = regex
+	}
+
+	seqs := make([]iter.Seq2[*model.Message, error], 0, len(talkers))
+	for _, talkerItem := range talkers {
+		// 在 darwinv3 中，需要先找到对应的数据库
+		_talkerMd5Bytes := md5.Sum([]byte(talkerItem))
+		talkerMd5 := hex.EncodeToString(_talkerMd5Bytes[:])
+		dbPath, ok := ds.talkerDBMap[talkerMd5]
+		if !ok {
+			continue
+		}
+
+		db, err := ds.dbm.OpenDB(dbPath)
+		if err != nil {
+			log.Error().Msgf("数据库 %s 未打开", dbPath)
+			continue
+		}
+
+		query := fmt.Sprintf(`
+			SELECT mesLocalID, msgCreateTime, msgContent, messageType, mesDes
+			FROM Chat_%s 
+			WHERE msgCreateTime >= ? AND msgCreateTime <= ? 
+			ORDER BY %s ASC, mesLocalID ASC
+		`, talkerMd5, SeqExpr)
+		args := []interface{}{startTime.Unix(), endTime.Unix()}
+
+		seqs = append(seqs, ds.iterTable(ctx, db, dbPath, talkerItem, query, args, filter))
+	}
+
+	return model.MergeMessages(seqs), nil
+}
+
+// iterTable 逐行读取单个消息表的查询结果，遍历结束或中止时关闭查询
+func (ds *DataSource) iterTable(ctx context.Context, db *sql.DB, dbPath string, talker string, query string, args []interface{}, filter *model.MessageFilter) iter.Seq2[*model.Message, error] {
+	return func(yield func(*model.Message, error) bool) {
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			// 如果表不存在，跳过此talker
+			if !strings.Contains(err.Error(), "no such table") {
+				log.Err(err).Msgf("从数据库 %s 查询消息失败", dbPath)
+			}
+			return
+		}
+		defer rows.Close()
+
+		scanned := dbm.RowCounterFrom(ctx)
+		for rows.Next() {
+			scanned.Inc()
+			var msg model.MessageDarwinV3
+			if err := rows.Scan(
+				&msg.MesLocalID,
+				&msg.MsgCreateTime,
+				&msg.MsgContent,
+				&msg.MessageType,
+				&msg.MesDes,
+			); err != nil {
+				yield(nil, errors.ScanRowFailed(err))
+				return
+			}
+
+			message := msg.Wrap(talker)
+			if !filter.Match(message) {
+				continue
+			}
+			if !yield(message, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, errors.QueryFailed(query, err))
+		}
+	}
+}
+
 // GetContacts 实现获取联系人信息的方法
 func (ds *DataSource) GetContacts(ctx context.Context, key string, limit, offset int) ([]*model.Contact, error) {
 	var query string
@@ -648,6 +784,16 @@ WHERE
 	return media, nil
 }
 
+// SupportsLabels 尚未解析该版本的联系人标签
+func (ds *DataSource) SupportsLabels() bool {
+	return false
+}
+
+// Notify 通知数据库文件已在原位置修改，触发与文件被替换时相同的回调
+func (ds *DataSource) Notify(path string) {
+	ds.dbm.Notify(path)
+}
+
 // Close 实现关闭数据库连接的方法
 func (ds *DataSource) Close() error {
 	return ds.dbm.Close()
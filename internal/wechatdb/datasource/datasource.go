@@ -2,6 +2,7 @@ package datasource
 
 import (
 	"context"
+	"iter"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -9,6 +10,7 @@ import (
 	"github.com/sjzar/chatlog/internal/errors"
 	"github.com/sjzar/chatlog/internal/model"
 	"github.com/sjzar/chatlog/internal/wechatdb/datasource/darwinv3"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
 	v4 "github.com/sjzar/chatlog/internal/wechatdb/datasource/v4"
 	"github.com/sjzar/chatlog/internal/wechatdb/datasource/windowsv3"
 )
@@ -18,6 +20,15 @@ type DataSource interface {
 	// 消息
 	GetMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error)
 
+	// 游标分页，返回游标之后（或之前）的 limit 条消息，按 Seq 升序排列
+	GetMessagesByCursor(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, cursor *model.Cursor, limit int) ([]*model.Message, error)
+
+	// 流式读取消息，按 Seq 升序逐条返回，不在内存中保留全部结果
+	IterMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string) (iter.Seq2[*model.Message, error], error)
+
+	// 统计消息数量，按发送者、类型和时间分组，不读取完整的消息
+	CountMessages(ctx context.Context, startTime, endTime time.Time, talker string) (*model.MessageCounts, error)
+
 	// 联系人
 	GetContacts(ctx context.Context, key string, limit, offset int) ([]*model.Contact, error)
 
@@ -30,22 +41,34 @@ type DataSource interface {
 	// 媒体
 	GetMedia(ctx context.Context, _type string, key string) (*model.Media, error)
 
+	// 是否支持联系人标签，不支持时联系人的 Labels 始终为空
+	SupportsLabels() bool
+
 	// 设置回调函数
 	SetCallback(group string, callback func(event fsnotify.Event) error) error
 
+	// 通知数据库文件已在原位置修改
+	Notify(path string)
+
 	Close() error
 }
 
-func New(path string, platform string, version int) (DataSource, error) {
+// SupportsLabels 判断平台和版本对应的数据源是否支持联系人标签，与数据源的 SupportsLabels 一致
+func SupportsLabels(platform string, version int) bool {
+	return platform == "windows" && version == 3
+}
+
+// New 创建数据源，decrypter 不为空时工作目录中的数据库为加密保存
+func New(path string, platform string, version int, decrypter dbm.Decrypter) (DataSource, error) {
 	switch {
 	case platform == "windows" && version == 3:
-		return windowsv3.New(path)
+		return windowsv3.New(path, decrypter)
 	case platform == "windows" && version == 4:
-		return v4.New(path)
+		return v4.New(path, decrypter)
 	case platform == "darwin" && version == 3:
-		return darwinv3.New(path)
+		return darwinv3.New(path, decrypter)
 	case platform == "darwin" && version == 4:
-		return v4.New(path)
+		return v4.New(path, decrypter)
 	default:
 		return nil, errors.PlatformUnsupported(platform, version)
 	}
@@ -2,6 +2,8 @@ package dbm
 
 import (
 	"database/sql"
+	"io"
+	"os"
 	"path/filepath"
 	"runtime"
 	"sync"
@@ -14,26 +16,35 @@ import (
 	"github.com/sjzar/chatlog/internal/errors"
 	"github.com/sjzar/chatlog/pkg/filecopy"
 	"github.com/sjzar/chatlog/pkg/filemonitor"
+	"github.com/sjzar/chatlog/pkg/metrics"
 )
 
+const sqliteHeader = "SQLite format 3\x00"
+
+// openDBs 当前打开的数据库连接数
+var openDBs = metrics.NewGauge("chatlog_db_open_handles", "Open database handles in the database manager.")
+
 type DBManager struct {
-	path    string
-	id      string
-	fm      *filemonitor.FileMonitor
-	fgs     map[string]*filemonitor.FileGroup
-	dbs     map[string]*sql.DB
-	dbPaths map[string][]string
-	mutex   sync.RWMutex
+	path      string
+	id        string
+	decrypter Decrypter
+	fm        *filemonitor.FileMonitor
+	fgs       map[string]*filemonitor.FileGroup
+	dbs       map[string]*sql.DB
+	dbPaths   map[string][]string
+	mutex     sync.RWMutex
 }
 
-func NewDBManager(path string) *DBManager {
+// NewDBManager 创建数据库管理器，decrypter 不为空时工作目录中的数据库为加密保存，打开时解密到内存
+func NewDBManager(path string, decrypter Decrypter) *DBManager {
 	return &DBManager{
-		path:    path,
-		id:      filepath.Base(path),
-		fm:      filemonitor.NewFileMonitor(),
-		fgs:     make(map[string]*filemonitor.FileGroup),
-		dbs:     make(map[string]*sql.DB),
-		dbPaths: make(map[string][]string),
+		path:      path,
+		id:        filepath.Base(path),
+		decrypter: decrypter,
+		fm:        filemonitor.NewFileMonitor(),
+		fgs:       make(map[string]*filemonitor.FileGroup),
+		dbs:       make(map[string]*sql.DB),
+		dbPaths:   make(map[string][]string),
 	}
 }
 
@@ -119,25 +130,47 @@ func (d *DBManager) OpenDB(path string) (*sql.DB, error) {
 		return db, nil
 	}
 	var err error
-	tempPath := path
-	if runtime.GOOS == "windows" {
-		tempPath, err = filecopy.GetTempCopy(d.id, path)
+	if d.decrypter != nil && !isPlain(path) {
+		// 加密保存的数据库在首次建立连接时解密到内存，文件变更前所有连接共享解密结果
+		db = OpenBytes(func() ([]byte, error) {
+			return d.decrypter(path)
+		})
+	} else {
+		tempPath := path
+		if runtime.GOOS == "windows" {
+			tempPath, err = filecopy.GetTempCopy(d.id, path)
+			if err != nil {
+				log.Err(err).Msgf("获取临时拷贝文件 %s 失败", path)
+				return nil, err
+			}
+		}
+		db, err = sql.Open("sqlite3", tempPath)
 		if err != nil {
-			log.Err(err).Msgf("获取临时拷贝文件 %s 失败", path)
+			log.Err(err).Msgf("连接数据库 %s 失败", path)
 			return nil, err
 		}
 	}
-	db, err = sql.Open("sqlite3", tempPath)
-	if err != nil {
-		log.Err(err).Msgf("连接数据库 %s 失败", path)
-		return nil, err
-	}
 	d.mutex.Lock()
 	d.dbs[path] = db
 	d.mutex.Unlock()
+	openDBs.With().Inc()
 	return db, nil
 }
 
+// isPlain 检查数据库文件是否未加密
+func isPlain(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return string(header) == sqliteHeader
+}
+
 func (d *DBManager) Callback(event fsnotify.Event) error {
 	if !event.Op.Has(fsnotify.Create) {
 		return nil
@@ -150,6 +183,7 @@ func (d *DBManager) Callback(event fsnotify.Event) error {
 		go func(db *sql.DB) {
 			time.Sleep(time.Second * 5)
 			db.Close()
+			openDBs.With().Dec()
 		}(db)
 	}
 	d.mutex.Unlock()
@@ -157,6 +191,11 @@ func (d *DBManager) Callback(event fsnotify.Event) error {
 	return nil
 }
 
+// Notify 通知数据库文件已在原位置修改，与文件被替换时一样触发 Create 回调
+func (d *DBManager) Notify(path string) {
+	d.fm.Notify(fsnotify.Event{Name: path, Op: fsnotify.Create})
+}
+
 func (d *DBManager) Start() error {
 	return d.fm.Start()
 }
@@ -168,6 +207,7 @@ func (d *DBManager) Stop() error {
 func (d *DBManager) Close() error {
 	for _, db := range d.dbs {
 		db.Close()
+		openDBs.With().Dec()
 	}
 	return d.fm.Stop()
 }
@@ -0,0 +1,127 @@
+package dbm
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Decrypter 读取加密保存的数据库文件，返回解密后的内容；文件未加密时返回 errors.ErrAlreadyDecrypted
+type Decrypter func(path string) ([]byte, error)
+
+// memdbSeq 内存数据库名称序号，同一进程中名称相同的 memdb 数据库共享内容
+var memdbSeq atomic.Int64
+
+// OpenBytes 将数据库内容加载为只读的内存数据库，不写入磁盘
+// load 在首次建立连接时调用一次，内容复制到进程内共享的 memdb 数据库后即释放，之后所有连接共享同一份内容；
+// 加载失败时下次建立连接再重试
+func OpenBytes(load func() ([]byte, error)) *sql.DB {
+	c := &memConnector{
+		load:   load,
+		uri:    fmt.Sprintf("file:/chatlog-memdb-%d?vfs=memdb", memdbSeq.Add(1)),
+		driver: &sqlite3.SQLiteDriver{},
+	}
+	db := sql.OpenDB(c)
+	db.SetMaxIdleConns(1)
+	return db
+}
+
+type memConnector struct {
+	load   func() ([]byte, error)
+	uri    string
+	driver *sqlite3.SQLiteDriver
+
+	mutex sync.Mutex
+	// holder 持有共享的 memdb 数据库，保证连接池中的连接全部关闭后内容仍然保留
+	holder *sqlite3.SQLiteConn
+}
+
+// init 首次调用时加载数据库内容到共享的 memdb 数据库
+func (c *memConnector) init() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.holder != nil {
+		return nil
+	}
+
+	data, err := c.load()
+	if err != nil {
+		return err
+	}
+	if len(data) < 100 {
+		return fmt.Errorf("invalid database of %d bytes", len(data))
+	}
+	// 内存数据库不支持 WAL，文件头中的读写版本改回 rollback journal
+	data[18], data[19] = 1, 1
+
+	// Deserialize 生成的数据库只属于当前连接，通过 backup 复制到共享的 memdb 数据库
+	src, err := c.driver.Open(":memory:")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := src.(*sqlite3.SQLiteConn).Deserialize(data, "main"); err != nil {
+		return err
+	}
+
+	holder, err := c.driver.Open(c.uri)
+	if err != nil {
+		return err
+	}
+	if err := backup(holder.(*sqlite3.SQLiteConn), src.(*sqlite3.SQLiteConn)); err != nil {
+		holder.Close()
+		return err
+	}
+	c.holder = holder.(*sqlite3.SQLiteConn)
+	return nil
+}
+
+// backup 将 src 的内容完整复制到 dst
+func backup(dst, src *sqlite3.SQLiteConn) error {
+	b, err := dst.Backup("main", src, "main")
+	if err != nil {
+		return err
+	}
+	if _, err := b.Step(-1); err != nil {
+		b.Close()
+		return err
+	}
+	return b.Finish()
+}
+
+func (c *memConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	conn, err := c.driver.Open(c.uri)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.(*sqlite3.SQLiteConn).Exec("PRAGMA query_only = 1", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *memConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Close 释放共享的 memdb 数据库，由 sql.DB 的 Close 调用
+func (c *memConnector) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.holder == nil {
+		return nil
+	}
+	err := c.holder.Close()
+	c.holder = nil
+	return err
+}
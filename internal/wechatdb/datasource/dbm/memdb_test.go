@@ -0,0 +1,78 @@
+package dbm
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenBytes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"CREATE TABLE msg (id INTEGER PRIMARY KEY, content TEXT)",
+		"INSERT INTO msg (content) VALUES ('hello'), ('world')",
+		"PRAGMA wal_checkpoint(TRUNCATE)",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loads := 0
+	mem := OpenBytes(func() ([]byte, error) {
+		loads++
+		return append([]byte(nil), data...), nil
+	})
+	defer mem.Close()
+
+	var n int
+	if err := mem.QueryRow("SELECT COUNT(*) FROM msg").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d rows, want 2", n)
+	}
+	if _, err := mem.Exec("INSERT INTO msg (content) VALUES ('again')"); err == nil {
+		t.Errorf("expected write to read-only database to fail")
+	}
+
+	// 同时打开多个连接并交替读取，只加载一次，所有连接看到相同的内容
+	ctx := context.Background()
+	rows := make([]*sql.Rows, 3)
+	for i := range rows {
+		conn, err := mem.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if rows[i], err = conn.QueryContext(ctx, "SELECT content FROM msg ORDER BY id"); err != nil {
+			t.Fatal(err)
+		}
+		defer rows[i].Close()
+	}
+	for _, want := range []string{"hello", "world"} {
+		for _, r := range rows {
+			var content string
+			if !r.Next() {
+				t.Fatalf("missing row %q: %v", want, r.Err())
+			}
+			if err := r.Scan(&content); err != nil || content != want {
+				t.Fatalf("got %q, %v, want %q", content, err, want)
+			}
+		}
+	}
+	if loads != 1 {
+		t.Errorf("loaded %d times, want 1", loads)
+	}
+}
@@ -0,0 +1,68 @@
+package dbm
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// RowCounter 统计一次查询从数据库扫描的行数（过滤前），可在多个 goroutine 中并发计数
+type RowCounter struct {
+	n atomic.Int64
+}
+
+type rowCounterKey struct{}
+
+// WithRowCounter 返回携带行数计数器的 context，数据源在扫描查询结果时计数
+func WithRowCounter(ctx context.Context) (context.Context, *RowCounter) {
+	c := &RowCounter{}
+	return context.WithValue(ctx, rowCounterKey{}, c), c
+}
+
+// RowCounterFrom 获取 context 中的行数计数器，不存在时返回 nil
+func RowCounterFrom(ctx context.Context) *RowCounter {
+	c, _ := ctx.Value(rowCounterKey{}).(*RowCounter)
+	return c
+}
+
+// Inc 计数加一，计数器为 nil 时忽略
+func (c *RowCounter) Inc() {
+	if c != nil {
+		c.n.Add(1)
+	}
+}
+
+// Load 返回当前计数
+func (c *RowCounter) Load() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.n.Load()
+}
+
+// ScanRows 执行查询并对每一行调用 scan，表不存在时视为没有结果
+func ScanRows(ctx context.Context, db *sql.DB, query string, args []interface{}, scan func(rows *sql.Rows) error) error {
+	counter := RowCounterFrom(ctx)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return nil
+		}
+		return errors.QueryFailed(query, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		counter.Inc()
+		if err := scan(rows); err != nil {
+			return errors.ScanRowFailed(err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.QueryFailed(query, err)
+	}
+	return nil
+}
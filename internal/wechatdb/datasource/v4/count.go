@@ -0,0 +1,138 @@
+package v4
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
+	"github.com/sjzar/chatlog/pkg/util"
+)
+
+// CountMessages 通过聚合查询统计会话在时间范围内的消息数量，按发送者、类型和时间分组
+// 只有分享消息需要读取内容来确定子类型
+func (ds *DataSource) CountMessages(ctx context.Context, startTime, endTime time.Time, talker string) (*model.MessageCounts, error) {
+	talkers := util.Str2List(talker, ",")
+	if len(talkers) == 0 {
+		return nil, errors.ErrTalkerEmpty
+	}
+
+	dbInfos := ds.getDBInfosForTimeRange(startTime, endTime)
+	if len(dbInfos) == 0 {
+		return nil, errors.TimeRangeNotFound(startTime, endTime)
+	}
+
+	counts := model.NewMessageCounts()
+	for _, dbInfo := range dbInfos {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		db, err := ds.dbm.OpenDB(dbInfo.FilePath)
+		if err != nil {
+			log.Error().Msgf("数据库 %s 未打开", dbInfo.FilePath)
+			continue
+		}
+
+		for _, talkerItem := range talkers {
+			_talkerMd5Bytes := md5.Sum([]byte(talkerItem))
+			tableName := "Msg_" + hex.EncodeToString(_talkerMd5Bytes[:])
+			if err := countTable(ctx, db, tableName, talkerItem, startTime, endTime, counts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return counts, nil
+}
+
+// countTable 统计单个消息表，local_type 低 32 位为消息类型
+func countTable(ctx context.Context, db *sql.DB, tableName, talker string, startTime, endTime time.Time, counts *model.MessageCounts) error {
+	args := []interface{}{startTime.Unix(), endTime.Unix()}
+
+	query := fmt.Sprintf(`
+		SELECT create_time / %d, COUNT(*), MIN(create_time), MAX(create_time)
+		FROM %s
+		WHERE create_time >= ? AND create_time <= ?
+		GROUP BY 1
+	`, model.CountBucket, tableName)
+	err := dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+		var bucket, first, last int64
+		var count int
+		if err := rows.Scan(&bucket, &count, &first, &last); err != nil {
+			return err
+		}
+		counts.AddTime(bucket, count, first, last)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf(`
+		SELECT local_type, COUNT(*)
+		FROM %s
+		WHERE create_time >= ? AND create_time <= ? AND (local_type & 4294967295) != %d
+		GROUP BY local_type
+	`, tableName, model.MessageTypeShare)
+	err = dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+		var localType int64
+		var count int
+		if err := rows.Scan(&localType, &count); err != nil {
+			return err
+		}
+		typ, subType := util.SplitInt64ToTwoInt32(localType)
+		counts.AddType(typ, subType, count)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 分享消息的子类型以内容中的 XML 为准
+	query = fmt.Sprintf(`
+		SELECT local_type, message_content
+		FROM %s
+		WHERE create_time >= ? AND create_time <= ? AND (local_type & 4294967295) = %d
+	`, tableName, model.MessageTypeShare)
+	err = dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+		var msg model.MessageV4
+		if err := rows.Scan(&msg.LocalType, &msg.MessageContent); err != nil {
+			return err
+		}
+		m := msg.Wrap(talker)
+		counts.AddType(m.Type, m.SubType, 1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// FIXME 与 Wrap 一致，通过 status 判断是否是自己发送的消息，目前可能不准确
+	isChatRoom := strings.HasSuffix(talker, "@chatroom")
+	query = fmt.Sprintf(`
+		SELECT COALESCE(n.user_name, ''), m.status = 2, COUNT(*)
+		FROM %s m
+		LEFT JOIN Name2Id n ON m.real_sender_id = n.rowid
+		WHERE m.create_time >= ? AND m.create_time <= ? AND (m.local_type & 4294967295) != %d
+		GROUP BY m.real_sender_id, m.status = 2
+	`, tableName, model.MessageTypeSystem)
+	return dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+		var sender string
+		var sent bool
+		var count int
+		if err := rows.Scan(&sender, &sent, &count); err != nil {
+			return err
+		}
+		counts.AddSender(talker, sender, sent || (!isChatRoom && talker != sender), count)
+		return nil
+	})
+}
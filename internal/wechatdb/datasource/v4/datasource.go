@@ -6,9 +6,12 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"iter"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -18,6 +21,7 @@ import (
 	"github.com/sjzar/chatlog/internal/errors"
 	"github.com/sjzar/chatlog/internal/model"
 	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
+	"github.com/sjzar/chatlog/internal/wechatdb/fts"
 	"github.com/sjzar/chatlog/pkg/util"
 )
 
@@ -68,15 +72,23 @@ type DataSource struct {
 	path string
 	dbm  *dbm.DBManager
 
-	// 消息数据库信息
+	// 消息数据库信息，数据库变更回调和索引 goroutine 并发访问
 	messageInfos []MessageDBInfo
+	mutex        sync.RWMutex
+
+	// 全文索引
+	index       *fts.Index
+	indexCh     chan struct{}
+	indexCtx    context.Context
+	indexCancel context.CancelFunc
 }
 
-func New(path string) (*DataSource, error) {
+// New 创建数据源，decrypter 不为空时工作目录中的数据库为加密保存
+func New(path string, decrypter dbm.Decrypter) (*DataSource, error) {
 
 	ds := &DataSource{
 		path:         path,
-		dbm:          dbm.NewDBManager(path),
+		dbm:          dbm.NewDBManager(path, decrypter),
 		messageInfos: make([]MessageDBInfo, 0),
 	}
 
@@ -99,9 +111,17 @@ func New(path string) (*DataSource, error) {
 		if err := ds.initMessageDbs(); err != nil {
 			log.Err(err).Msgf("Failed to reinitialize message DBs: %s", event.Name)
 		}
+		ds.triggerIndex()
 		return nil
 	})
 
+	// 全文索引保存了消息明文，工作目录加密时不建立索引并删除之前遗留的索引，关键词搜索逐条扫描消息
+	if decrypter == nil {
+		ds.initIndex()
+	} else if err := util.RemoveSQLite(filepath.Join(path, IndexFile)); err != nil {
+		log.Err(err).Msg("remove fts index failed")
+	}
+
 	return ds, nil
 }
 
@@ -116,7 +136,9 @@ func (ds *DataSource) initMessageDbs() error {
 	dbPaths, err := ds.dbm.GetDBPath(Message)
 	if err != nil {
 		if strings.Contains(err.Error(), "db file not found") {
+			ds.mutex.Lock()
 			ds.messageInfos = make([]MessageDBInfo, 0)
+			ds.mutex.Unlock()
 			return nil
 		}
 		return err
@@ -162,6 +184,8 @@ func (ds *DataSource) initMessageDbs() error {
 			infos[i].EndTime = infos[i+1].StartTime
 		}
 	}
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
 	if len(ds.messageInfos) > 0 && len(infos) < len(ds.messageInfos) {
 		log.Warn().Msgf("message db count decreased from %d to %d, skip init", len(ds.messageInfos), len(infos))
 		return nil
@@ -172,6 +196,9 @@ func (ds *DataSource) initMessageDbs() error {
 
 // getDBInfosForTimeRange 获取时间范围内的数据库信息
 func (ds *DataSource) getDBInfosForTimeRange(startTime, endTime time.Time) []MessageDBInfo {
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+
 	var dbs []MessageDBInfo
 	for _, info := range ds.messageInfos {
 		if info.StartTime.Before(endTime) && info.EndTime.After(startTime) {
@@ -182,6 +209,17 @@ func (ds *DataSource) getDBInfosForTimeRange(startTime, endTime time.Time) []Mes
 }
 
 func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	return ds.getMessages(ctx, startTime, endTime, talker, sender, keyword, nil, limit, offset)
+}
+
+func (ds *DataSource) GetMessagesByCursor(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, cursor *model.Cursor, limit int) ([]*model.Message, error) {
+	return ds.getMessages(ctx, startTime, endTime, talker, sender, keyword, cursor, limit, 0)
+}
+
+// getMessages 查询消息，cursor 不为空时只返回游标之后（或之前）的 limit 条消息
+func (ds *DataSource) getMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, cursor *model.Cursor, limit, offset int) ([]*model.Message, error) {
+	scanned := dbm.RowCounterFrom(ctx)
+
 	if talker == "" {
 		return nil, errors.ErrTalkerEmpty
 	}
@@ -211,6 +249,13 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 		}
 	}
 
+	// 关键词可以通过全文索引查询时，只读取索引命中的候选消息和尚未索引的消息
+	var candidates map[string][]int64
+	var progress map[string]map[string]int64
+	if regex != nil {
+		candidates, progress = ds.searchIndex(ctx, dbInfos, talkers, startTime, endTime, keyword)
+	}
+
 	// 从每个相关数据库中查询消息，并在读取时进行过滤
 	filteredMessages := []*model.Message{}
 
@@ -250,6 +295,17 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 			// 构建查询条件
 			conditions := []string{"create_time >= ? AND create_time <= ?"}
 			args := []interface{}{startTime.Unix(), endTime.Unix()}
+			if candidates != nil {
+				cond, arg := candidateCondition(candidates[talkerItem], progress[filepath.Base(dbInfo.FilePath)][tableName])
+				conditions = append(conditions, cond)
+				args = append(args, arg...)
+			}
+			order := "ASC"
+			if cursor != nil {
+				conditions = append(conditions, "m.sort_seq "+cursor.SeqOp(talkerItem)+" ?")
+				args = append(args, cursor.Seq)
+				order = cursor.Order()
+			}
 			log.Debug().Msgf("Table name: %s", tableName)
 			log.Debug().Msgf("Start time: %d, End time: %d", startTime.Unix(), endTime.Unix())
 
@@ -258,8 +314,8 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 				FROM %s m
 				LEFT JOIN Name2Id n ON m.real_sender_id = n.rowid
 				WHERE %s 
-				ORDER BY m.sort_seq ASC
-			`, tableName, strings.Join(conditions, " AND "))
+				ORDER BY m.sort_seq %s
+			`, tableName, strings.Join(conditions, " AND "), order)
 
 			// 执行查询
 			rows, err := db.QueryContext(ctx, query, args...)
@@ -273,7 +329,9 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 			}
 
 			// 处理查询结果，在读取时进行过滤
+			matched := 0
 			for rows.Next() {
+				scanned.Inc()
 				var msg model.MessageV4
 				err := rows.Scan(
 					&msg.SortSeq,
@@ -317,6 +375,15 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 
 				// 通过所有过滤条件，保留此消息
 				filteredMessages = append(filteredMessages, message)
+				matched++
+
+				// 游标查询时，每个表最多读取 limit 条离游标最近的消息
+				if cursor != nil {
+					if limit > 0 && matched >= limit {
+						break
+					}
+					continue
+				}
 
 				// 检查是否已经满足分页处理数量
 				if limit > 0 && len(filteredMessages) >= offset+limit {
@@ -343,6 +410,10 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 		}
 	}
 
+	if cursor != nil {
+		return cursor.Trim(filteredMessages, limit), nil
+	}
+
 	// 对所有消息按时间排序
 	sort.Slice(filteredMessages, func(i, j int) bool {
 		return filteredMessages[i].Seq < filteredMessages[j].Seq
@@ -363,6 +434,120 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 	return filteredMessages, nil
 }
 
+// IterMessages 流式查询消息，各数据库、各会话的查询结果按 Seq 多路归并后逐条返回
+func (ds *DataSource) IterMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string) (iter.Seq2[*model.Message, error], error) {
+	if talker == "" {
+		return nil, errors.ErrTalkerEmpty
+	}
+
+	// 解析talker参数，支持多个talker（以英文逗号分隔）
+	talkers := util.Str2List(talker, ",")
+	if len(talkers) == 0 {
+		return nil, errors.ErrTalkerEmpty
+	}
+
+	// 找到时间范围内的数据库文件
+	dbInfos := ds.getDBInfosForTimeRange(startTime, endTime)
+	if len(dbInfos) == 0 {
+		return nil, errors.TimeRangeNotFound(startTime, endTime)
+	}
+
+	filter := &model.MessageFilter{Senders: util.Str2List(sender, ",")}
+	if keyword != "" {
+		regex, err := regexp.Compile(keyword)
+		if err != nil {
+			return nil, errors.QueryFailed("invalid regex pattern", err)
+		}
+		filter.Regex = regex
+	}
+
+	// 关键词可以通过全文索引查询时，只读取索引命中的候选消息和尚未索引的消息
+	var candidates map[string][]int64
+	var progress map[string]map[string]int64
+	if filter.Regex != nil {
+		candidates, progress = ds.searchIndex(ctx, dbInfos, talkers, startTime, endTime, keyword)
+	}
+
+	seqs := make([]iter.Seq2[*model.Message, error], 0, len(dbInfos)*len(talkers))
+	for _, dbInfo := range dbInfos {
+		db, err := ds.dbm.OpenDB(dbInfo.FilePath)
+		if err != nil {
+			log.Error().Msgf("数据库 %s 未打开", dbInfo.FilePath)
+			continue
+		}
+
+		for _, talkerItem := range talkers {
+			_talkerMd5Bytes := md5.Sum([]byte(talkerItem))
+			tableName := "Msg_" + hex.EncodeToString(_talkerMd5Bytes[:])
+
+			conditions := []string{"create_time >= ? AND create_time <= ?"}
+			args := []interface{}{startTime.Unix(), endTime.Unix()}
+			if candidates != nil {
+				cond, arg := candidateCondition(candidates[talkerItem], progress[filepath.Base(dbInfo.FilePath)][tableName])
+				conditions = append(conditions, cond)
+				args = append(args, arg...)
+			}
+
+			query := fmt.Sprintf(`
+				SELECT m.sort_seq, m.server_id, m.local_type, n.user_name, m.create_time, m.message_content, m.packed_info_data, m.status
+				FROM %s m
+				LEFT JOIN Name2Id n ON m.real_sender_id = n.rowid
+				WHERE %s 
+				ORDER BY m.sort_seq ASC
+			`, tableName, strings.Join(conditions, " AND "))
+
+			seqs = append(seqs, ds.iterTable(ctx, db, dbInfo.FilePath, talkerItem, query, args, filter))
+		}
+	}
+
+	return model.MergeMessages(seqs), nil
+}
+
+// iterTable 逐行读取单个消息表的查询结果，遍历结束或中止时关闭查询
+func (ds *DataSource) iterTable(ctx context.Context, db *sql.DB, dbPath string, talker string, query string, args []interface{}, filter *model.MessageFilter) iter.Seq2[*model.Message, error] {
+	return func(yield func(*model.Message, error) bool) {
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			// 如果表不存在，SQLite 会返回错误
+			if !strings.Contains(err.Error(), "no such table") {
+				log.Err(err).Msgf("从数据库 %s 查询消息失败", dbPath)
+			}
+			return
+		}
+		defer rows.Close()
+
+		scanned := dbm.RowCounterFrom(ctx)
+		for rows.Next() {
+			scanned.Inc()
+			var msg model.MessageV4
+			if err := rows.Scan(
+				&msg.SortSeq,
+				&msg.ServerID,
+				&msg.LocalType,
+				&msg.UserName,
+				&msg.CreateTime,
+				&msg.MessageContent,
+				&msg.PackedInfoData,
+				&msg.Status,
+			); err != nil {
+				yield(nil, errors.ScanRowFailed(err))
+				return
+			}
+
+			message := msg.Wrap(talker)
+			if !filter.Match(message) {
+				continue
+			}
+			if !yield(message, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, errors.QueryFailed(query, err))
+		}
+	}
+}
+
 // 联系人
 func (ds *DataSource) GetContacts(ctx context.Context, key string, limit, offset int) ([]*model.Contact, error) {
 	var query string
@@ -747,6 +932,20 @@ func (ds *DataSource) GetVoice(ctx context.Context, key string) (*model.Media, e
 	return nil, errors.ErrMediaNotFound
 }
 
+// SupportsLabels 尚未解析该版本的联系人标签
+func (ds *DataSource) SupportsLabels() bool {
+	return false
+}
+
+// Notify 通知数据库文件已在原位置修改，触发与文件被替换时相同的回调
+func (ds *DataSource) Notify(path string) {
+	ds.dbm.Notify(path)
+}
+
 func (ds *DataSource) Close() error {
+	if ds.index != nil {
+		ds.indexCancel()
+		ds.index.Close()
+	}
 	return ds.dbm.Close()
 }
@@ -0,0 +1,250 @@
+package v4
+
+import (
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/internal/wechatdb/fts"
+)
+
+const (
+	// IndexFile 全文索引文件名，位于工作目录下
+	IndexFile = "chatlog_fts.db"
+
+	// IndexBatchSize 每批写入索引的消息数量
+	IndexBatchSize = 5000
+
+	// IndexDelay 收到数据库变更后，延迟更新索引的时间
+	IndexDelay = 3 * time.Second
+)
+
+// initIndex 打开全文索引并在后台完成首次构建
+func (ds *DataSource) initIndex() {
+	index, err := fts.Open(filepath.Join(ds.path, IndexFile))
+	if err != nil {
+		log.Err(err).Msg("open fts index failed, keyword search will scan messages")
+		return
+	}
+	ds.index = index
+	ds.indexCh = make(chan struct{}, 1)
+	ds.indexCtx, ds.indexCancel = context.WithCancel(context.Background())
+
+	go ds.indexLoop()
+	ds.triggerIndex()
+}
+
+// triggerIndex 触发一次索引更新，更新进行中时合并请求
+func (ds *DataSource) triggerIndex() {
+	if ds.index == nil {
+		return
+	}
+	select {
+	case ds.indexCh <- struct{}{}:
+	default:
+	}
+}
+
+func (ds *DataSource) indexLoop() {
+	first := true
+	for {
+		select {
+		case <-ds.indexCh:
+			if !first {
+				time.Sleep(IndexDelay)
+			}
+			first = false
+			start := time.Now()
+			if err := ds.updateIndex(ds.indexCtx); err != nil {
+				log.Err(err).Msg("update fts index failed")
+				continue
+			}
+			log.Debug().Msgf("update fts index done, cost %s", time.Since(start))
+		case <-ds.indexCtx.Done():
+			return
+		}
+	}
+}
+
+// updateIndex 将各消息数据库中新增的消息写入全文索引
+// 首次构建完成前索引不可用；之后增量更新期间索引保持可用，查询时会逐行匹配索引位置之后的消息
+func (ds *DataSource) updateIndex(ctx context.Context) error {
+	// messageInfos 只会整体替换，复制切片后即可在锁外遍历
+	ds.mutex.RLock()
+	infos := ds.messageInfos
+	ds.mutex.RUnlock()
+
+	for _, info := range infos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := ds.updateIndexForDB(ctx, info.FilePath); err != nil {
+			return err
+		}
+	}
+
+	ds.index.SetReady(true)
+	return nil
+}
+
+func (ds *DataSource) updateIndexForDB(ctx context.Context, filePath string) error {
+	db, err := ds.dbm.OpenDB(filePath)
+	if err != nil {
+		return err
+	}
+
+	source := filepath.Base(filePath)
+	progress, err := ds.index.Progress(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	// 通过 Name2Id 还原表名对应的 talker
+	md5ToTalker := make(map[string]string)
+	rows, err := db.QueryContext(ctx, "SELECT user_name FROM Name2Id")
+	if err != nil {
+		log.Err(err).Msgf("查询数据库 %s 的 Name2Id 表失败", filePath)
+		return nil
+	}
+	for rows.Next() {
+		var userName string
+		if err := rows.Scan(&userName); err != nil {
+			continue
+		}
+		_md5Bytes := md5.Sum([]byte(userName))
+		md5ToTalker[hex.EncodeToString(_md5Bytes[:])] = userName
+	}
+	rows.Close()
+
+	tables := make([]string, 0)
+	rows, err = db.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type='table' AND name LIKE 'Msg_%'")
+	if err != nil {
+		log.Err(err).Msgf("查询数据库 %s 的消息表失败", filePath)
+		return nil
+	}
+	for rows.Next() {
+		var tableName string
+		if err := rows.Scan(&tableName); err != nil {
+			continue
+		}
+		tables = append(tables, tableName)
+	}
+	rows.Close()
+
+	for _, tableName := range tables {
+		talker, ok := md5ToTalker[strings.TrimPrefix(tableName, "Msg_")]
+		if !ok {
+			continue
+		}
+		if err := ds.updateIndexForTable(ctx, db, source, tableName, talker, progress[tableName]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ds *DataSource) updateIndexForTable(ctx context.Context, db *sql.DB, source, tableName, talker string, lastID int64) error {
+	query := fmt.Sprintf(`
+		SELECT m.local_id, m.sort_seq, m.server_id, m.local_type, n.user_name, m.create_time, m.message_content, m.packed_info_data, m.status
+		FROM %s m
+		LEFT JOIN Name2Id n ON m.real_sender_id = n.rowid
+		WHERE m.local_id > ?
+		ORDER BY m.local_id ASC
+		LIMIT %d
+	`, tableName, IndexBatchSize)
+
+	for {
+		rows, err := db.QueryContext(ctx, query, lastID)
+		if err != nil {
+			log.Err(err).Msgf("从数据库 %s 读取表 %s 失败", source, tableName)
+			return nil
+		}
+
+		docs := make([]*fts.Document, 0, IndexBatchSize)
+		for rows.Next() {
+			var localID int64
+			var msg model.MessageV4
+			if err := rows.Scan(
+				&localID,
+				&msg.SortSeq,
+				&msg.ServerID,
+				&msg.LocalType,
+				&msg.UserName,
+				&msg.CreateTime,
+				&msg.MessageContent,
+				&msg.PackedInfoData,
+				&msg.Status,
+			); err != nil {
+				rows.Close()
+				return errors.ScanRowFailed(err)
+			}
+			lastID = localID
+
+			message := msg.Wrap(talker)
+			docs = append(docs, &fts.Document{
+				Talker:  talker,
+				Seq:     message.Seq,
+				Time:    message.Time.Unix(),
+				Sender:  message.Sender,
+				Content: message.PlainTextContent(),
+			})
+		}
+		rows.Close()
+
+		if len(docs) == 0 {
+			return nil
+		}
+		if err := ds.index.Append(ctx, source, tableName, lastID, docs); err != nil {
+			return err
+		}
+		if len(docs) < IndexBatchSize {
+			return nil
+		}
+	}
+}
+
+// searchIndex 通过全文索引查询关键词，返回 talker => seq 候选列表，以及各数据库中各表已索引到的 local_id
+// 先读取索引位置再查询索引，位置之前的消息一定已在索引中，位置之后的消息需要逐行匹配
+// 索引不可用时返回 nil，查询方回退到逐行匹配
+func (ds *DataSource) searchIndex(ctx context.Context, dbInfos []MessageDBInfo, talkers []string, startTime, endTime time.Time, keyword string) (map[string][]int64, map[string]map[string]int64) {
+	if ds.index == nil || !ds.index.Ready() {
+		return nil, nil
+	}
+
+	progress := make(map[string]map[string]int64, len(dbInfos))
+	for _, dbInfo := range dbInfos {
+		source := filepath.Base(dbInfo.FilePath)
+		p, err := ds.index.Progress(ctx, source)
+		if err != nil {
+			log.Err(err).Msgf("read fts progress of %s failed", source)
+			return nil, nil
+		}
+		progress[source] = p
+	}
+
+	candidates, ok := ds.index.Search(ctx, talkers, startTime, endTime, keyword)
+	if !ok {
+		return nil, nil
+	}
+	return candidates, progress
+}
+
+// candidateCondition 返回只读取候选消息和索引位置之后消息的查询条件
+func candidateCondition(seqs []int64, lastID int64) (string, []interface{}) {
+	if seqs == nil {
+		seqs = []int64{}
+	}
+	b, _ := json.Marshal(seqs)
+	return "(m.sort_seq IN (SELECT value FROM json_each(?)) OR m.local_id > ?)", []interface{}{string(b), lastID}
+}
@@ -0,0 +1,163 @@
+package windowsv3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
+	"github.com/sjzar/chatlog/pkg/util"
+)
+
+// CountMessages 通过聚合查询统计会话在时间范围内的消息数量，按发送者、类型和时间分组
+// 群聊的发送者记录在 BytesExtra 中，分享消息的子类型以内容为准，只读取这两类需要的列
+func (ds *DataSource) CountMessages(ctx context.Context, startTime, endTime time.Time, talker string) (*model.MessageCounts, error) {
+	talkers := util.Str2List(talker, ",")
+	if len(talkers) == 0 {
+		return nil, errors.ErrTalkerEmpty
+	}
+
+	dbInfos := ds.getDBInfosForTimeRange(startTime, endTime)
+	if len(dbInfos) == 0 {
+		return nil, errors.TimeRangeNotFound(startTime, endTime)
+	}
+
+	counts := model.NewMessageCounts()
+	for _, dbInfo := range dbInfos {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		db, err := ds.dbm.OpenDB(dbInfo.FilePath)
+		if err != nil {
+			log.Error().Msgf("数据库 %s 未打开", dbInfo.FilePath)
+			continue
+		}
+
+		for _, talkerItem := range talkers {
+			conditions := []string{"Sequence >= ? AND Sequence <= ?"}
+			args := []interface{}{startTime.Unix() * 1000, endTime.Unix() * 1000}
+			if talkerID, ok := dbInfo.TalkerMap[talkerItem]; ok {
+				conditions = append(conditions, "TalkerId = ?")
+				args = append(args, talkerID)
+			} else {
+				conditions = append(conditions, "StrTalker = ?")
+				args = append(args, talkerItem)
+			}
+			if err := countTable(ctx, db, talkerItem, strings.Join(conditions, " AND "), args, counts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return counts, nil
+}
+
+// countTable 统计 MSG 表中满足 where 条件的消息
+func countTable(ctx context.Context, db *sql.DB, talker string, where string, args []interface{}, counts *model.MessageCounts) error {
+	query := fmt.Sprintf(`
+		SELECT CreateTime / %d, COUNT(*), MIN(CreateTime), MAX(CreateTime)
+		FROM MSG
+		WHERE %s
+		GROUP BY 1
+	`, model.CountBucket, where)
+	err := dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+		var bucket, first, last int64
+		var count int
+		if err := rows.Scan(&bucket, &count, &first, &last); err != nil {
+			return err
+		}
+		counts.AddTime(bucket, count, first, last)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf(`
+		SELECT Type, SubType, COUNT(*)
+		FROM MSG
+		WHERE %s AND Type != %d
+		GROUP BY Type, SubType
+	`, where, model.MessageTypeShare)
+	err = dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+		var typ, subType int64
+		var count int
+		if err := rows.Scan(&typ, &subType, &count); err != nil {
+			return err
+		}
+		counts.AddType(typ, subType, count)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 分享消息的子类型以内容中的 XML 为准
+	query = fmt.Sprintf(`
+		SELECT Type, SubType, CompressContent
+		FROM MSG
+		WHERE %s AND Type = %d
+	`, where, model.MessageTypeShare)
+	err = dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+		var msg model.MessageV3
+		if err := rows.Scan(&msg.Type, &msg.SubType, &msg.CompressContent); err != nil {
+			return err
+		}
+		m := msg.Wrap()
+		counts.AddType(m.Type, m.SubType, 1)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasSuffix(talker, "@chatroom") {
+		query = fmt.Sprintf(`
+			SELECT IsSender, COUNT(*)
+			FROM MSG
+			WHERE %s AND Type != %d
+			GROUP BY IsSender
+		`, where, model.MessageTypeSystem)
+		return dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+			var isSender, count int
+			if err := rows.Scan(&isSender, &count); err != nil {
+				return err
+			}
+			if isSender == 1 {
+				counts.AddSender(talker, "", true, count)
+			} else {
+				counts.AddSender(talker, talker, false, count)
+			}
+			return nil
+		})
+	}
+
+	// 群聊的发送者记录在 BytesExtra 中，无法在 SQL 中分组
+	query = fmt.Sprintf(`
+		SELECT IsSender, BytesExtra
+		FROM MSG
+		WHERE %s AND Type != %d
+	`, where, model.MessageTypeSystem)
+	return dbm.ScanRows(ctx, db, query, args, func(rows *sql.Rows) error {
+		var isSender int
+		var bytesExtra []byte
+		if err := rows.Scan(&isSender, &bytesExtra); err != nil {
+			return err
+		}
+		sender := ""
+		if len(bytesExtra) != 0 {
+			if extra := model.ParseBytesExtra(bytesExtra); extra != nil {
+				sender = extra[1]
+			}
+		}
+		counts.AddSender(talker, sender, isSender == 1, 1)
+		return nil
+	})
+}
@@ -2,8 +2,10 @@ package windowsv3
 
 import (
 	"context"
+	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"iter"
 	"regexp"
 	"sort"
 	"strings"
@@ -78,11 +80,11 @@ type DataSource struct {
 	messageInfos []MessageDBInfo
 }
 
-// New 创建一个新的 WindowsV3DataSource
-func New(path string) (*DataSource, error) {
+// New 创建数据源，decrypter 不为空时工作目录中的数据库为加密保存
+func New(path string, decrypter dbm.Decrypter) (*DataSource, error) {
 	ds := &DataSource{
 		path:         path,
-		dbm:          dbm.NewDBManager(path),
+		dbm:          dbm.NewDBManager(path, decrypter),
 		messageInfos: make([]MessageDBInfo, 0),
 	}
 
@@ -227,6 +229,17 @@ func (ds *DataSource) getDBInfosForTimeRange(startTime, endTime time.Time) []Mes
 }
 
 func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
+	return ds.getMessages(ctx, startTime, endTime, talker, sender, keyword, nil, limit, offset)
+}
+
+func (ds *DataSource) GetMessagesByCursor(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, cursor *model.Cursor, limit int) ([]*model.Message, error) {
+	return ds.getMessages(ctx, startTime, endTime, talker, sender, keyword, cursor, limit, 0)
+}
+
+// getMessages 查询消息，cursor 不为空时只返回游标之后（或之前）的 limit 条消息
+func (ds *DataSource) getMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, cursor *model.Cursor, limit, offset int) ([]*model.Message, error) {
+	scanned := dbm.RowCounterFrom(ctx)
+
 	if talker == "" {
 		return nil, errors.ErrTalkerEmpty
 	}
@@ -286,14 +299,20 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 				conditions = append(conditions, "StrTalker = ?")
 				args = append(args, talkerItem)
 			}
+			order := "ASC"
+			if cursor != nil {
+				conditions = append(conditions, "Sequence "+cursor.SeqOp(talkerItem)+" ?")
+				args = append(args, cursor.Seq)
+				order = cursor.Order()
+			}
 
 			query := fmt.Sprintf(`
 				SELECT MsgSvrID, Sequence, CreateTime, StrTalker, IsSender, 
 					Type, SubType, StrContent, CompressContent, BytesExtra
 				FROM MSG 
 				WHERE %s 
-				ORDER BY Sequence ASC
-			`, strings.Join(conditions, " AND "))
+				ORDER BY Sequence %s
+			`, strings.Join(conditions, " AND "), order)
 
 			// 执行查询
 			rows, err := db.QueryContext(ctx, query, args...)
@@ -307,7 +326,9 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 			}
 
 			// 处理查询结果，在读取时进行过滤
+			matched := 0
 			for rows.Next() {
+				scanned.Inc()
 				var msg model.MessageV3
 				var compressContent []byte
 				var bytesExtra []byte
@@ -358,6 +379,15 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 
 				// 通过所有过滤条件，保留此消息
 				filteredMessages = append(filteredMessages, message)
+				matched++
+
+				// 游标查询时，每个库最多读取 limit 条离游标最近的消息
+				if cursor != nil {
+					if limit > 0 && matched >= limit {
+						break
+					}
+					continue
+				}
 
 				// 检查是否已经满足分页处理数量
 				if limit > 0 && len(filteredMessages) >= offset+limit {
@@ -384,6 +414,10 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 		}
 	}
 
+	if cursor != nil {
+		return cursor.Trim(filteredMessages, limit), nil
+	}
+
 	// 对所有消息按时间排序
 	sort.Slice(filteredMessages, func(i, j int) bool {
 		return filteredMessages[i].Seq < filteredMessages[j].Seq
@@ -404,6 +438,120 @@ func (ds *DataSource) GetMessages(ctx context.Context, startTime, endTime time.T
 	return filteredMessages, nil
 }
 
+// IterMessages 流式查询消息，各数据库、各会话的查询结果按 Seq 多路归并后逐条返回
+func (ds *DataSource) IterMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string) (iter.Seq2[*model.Message, error], error) {
+	if talker == "" {
+		return nil, errors.ErrTalkerEmpty
+	}
+
+	// 解析talker参数，支持多个talker（以英文逗号分隔）
+	talkers := util.Str2List(talker, ",")
+	if len(talkers) == 0 {
+		return nil, errors.ErrTalkerEmpty
+	}
+
+	// 找到时间范围内的数据库文件
+	dbInfos := ds.getDBInfosForTimeRange(startTime, endTime)
+	if len(dbInfos) == 0 {
+		return nil, errors.TimeRangeNotFound(startTime, endTime)
+	}
+
+	filter := &model.MessageFilter{Senders: util.Str2List(sender, ",")}
+	if keyword != "" {
+		regex, err := regexp.Compile(keyword)
+		if err != nil {
+			return nil, errors.QueryFailed("invalid regex pattern", err)
+		}
+		filter.Regex = regex
+	}
+
+	seqs := make([]iter.Seq2[*model.Message, error], 0, len(dbInfos)*len(talkers))
+	for _, dbInfo := range dbInfos {
+		db, err := ds.dbm.OpenDB(dbInfo.FilePath)
+		if err != nil {
+			log.Error().Msgf("数据库 %s 未打开", dbInfo.FilePath)
+			continue
+		}
+
+		for _, talkerItem := range talkers {
+			conditions := []string{"Sequence >= ? AND Sequence <= ?"}
+			args := []interface{}{startTime.Unix() * 1000, endTime.Unix() * 1000}
+
+			// 添加talker条件
+			if talkerID, ok := dbInfo.TalkerMap[talkerItem]; ok {
+				conditions = append(conditions, "TalkerId = ?")
+				args = append(args, talkerID)
+			} else {
+				conditions = append(conditions, "StrTalker = ?")
+				args = append(args, talkerItem)
+			}
+
+			query := fmt.Sprintf(`
+				SELECT MsgSvrID, Sequence, CreateTime, StrTalker, IsSender, 
+					Type, SubType, StrContent, CompressContent, BytesExtra
+				FROM MSG 
+				WHERE %s 
+				ORDER BY Sequence ASC
+			`, strings.Join(conditions, " AND "))
+
+			seqs = append(seqs, ds.iterTable(ctx, db, dbInfo.FilePath, query, args, filter))
+		}
+	}
+
+	return model.MergeMessages(seqs), nil
+}
+
+// iterTable 逐行读取消息表的查询结果，遍历结束或中止时关闭查询
+func (ds *DataSource) iterTable(ctx context.Context, db *sql.DB, dbPath string, query string, args []interface{}, filter *model.MessageFilter) iter.Seq2[*model.Message, error] {
+	return func(yield func(*model.Message, error) bool) {
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			// 如果表不存在，跳过此talker
+			if !strings.Contains(err.Error(), "no such table") {
+				log.Err(err).Msgf("从数据库 %s 查询消息失败", dbPath)
+			}
+			return
+		}
+		defer rows.Close()
+
+		scanned := dbm.RowCounterFrom(ctx)
+		for rows.Next() {
+			scanned.Inc()
+			var msg model.MessageV3
+			var compressContent []byte
+			var bytesExtra []byte
+			if err := rows.Scan(
+				&msg.MsgSvrID,
+				&msg.Sequence,
+				&msg.CreateTime,
+				&msg.StrTalker,
+				&msg.IsSender,
+				&msg.Type,
+				&msg.SubType,
+				&msg.StrContent,
+				&compressContent,
+				&bytesExtra,
+			); err != nil {
+				yield(nil, errors.ScanRowFailed(err))
+				return
+			}
+			msg.CompressContent = compressContent
+			msg.BytesExtra = bytesExtra
+
+			message := msg.Wrap()
+			if !filter.Match(message) {
+				continue
+			}
+			if !yield(message, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(nil, errors.QueryFailed(query, err))
+		}
+	}
+}
+
 // GetContacts 实现获取联系人信息的方法
 func (ds *DataSource) GetContacts(ctx context.Context, key string, limit, offset int) ([]*model.Contact, error) {
 	var query string
@@ -411,12 +559,12 @@ func (ds *DataSource) GetContacts(ctx context.Context, key string, limit, offset
 
 	if key != "" {
 		// 按照关键字查询
-		query = `SELECT UserName, Alias, Remark, NickName, Reserved1 FROM Contact 
+		query = `SELECT UserName, Alias, Remark, NickName, Reserved1, IFNULL(LabelIDList, '') FROM Contact 
                 WHERE UserName = ? OR Alias = ? OR Remark = ? OR NickName = ?`
 		args = []interface{}{key, key, key, key}
 	} else {
 		// 查询所有联系人
-		query = `SELECT UserName, Alias, Remark, NickName, Reserved1 FROM Contact`
+		query = `SELECT UserName, Alias, Remark, NickName, Reserved1, IFNULL(LabelIDList, '') FROM Contact`
 	}
 
 	// 添加排序、分页
@@ -433,6 +581,7 @@ func (ds *DataSource) GetContacts(ctx context.Context, key string, limit, offset
 	if err != nil {
 		return nil, err
 	}
+	labels := ds.getContactLabels(ctx, db)
 	rows, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, errors.QueryFailed(query, err)
@@ -448,18 +597,47 @@ func (ds *DataSource) GetContacts(ctx context.Context, key string, limit, offset
 			&contactV3.Remark,
 			&contactV3.NickName,
 			&contactV3.Reserved1,
+			&contactV3.LabelIDList,
 		)
 
 		if err != nil {
 			return nil, errors.ScanRowFailed(err)
 		}
 
-		contacts = append(contacts, contactV3.Wrap())
+		contact := contactV3.Wrap()
+		for _, id := range util.Str2List(contactV3.LabelIDList, ",") {
+			if name, ok := labels[id]; ok {
+				contact.Labels = append(contact.Labels, name)
+			}
+		}
+		contacts = append(contacts, contact)
 	}
 
 	return contacts, nil
 }
 
+// getContactLabels 获取联系人标签 ID 与名称的对应关系
+func (ds *DataSource) getContactLabels(ctx context.Context, db *sql.DB) map[string]string {
+	labels := make(map[string]string)
+	rows, err := db.QueryContext(ctx, `SELECT LabelId, LabelName FROM ContactLabel`)
+	if err != nil {
+		// 旧版本数据库中可能没有标签表
+		log.Debug().Err(err).Msg("query contact labels failed")
+		return labels
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			log.Debug().Err(err).Msg("scan contact label failed")
+			return labels
+		}
+		labels[id] = name
+	}
+	return labels
+}
+
 // GetChatRooms 实现获取群聊信息的方法
 func (ds *DataSource) GetChatRooms(ctx context.Context, key string, limit, offset int) ([]*model.ChatRoom, error) {
 	var query string
@@ -772,6 +950,16 @@ func (ds *DataSource) GetVoice(ctx context.Context, key string) (*model.Media, e
 	return nil, errors.ErrMediaNotFound
 }
 
+// SupportsLabels 联系人表中记录了标签 ID，可以按标签匹配会话
+func (ds *DataSource) SupportsLabels() bool {
+	return true
+}
+
+// Notify 通知数据库文件已在原位置修改，触发与文件被替换时相同的回调
+func (ds *DataSource) Notify(path string) {
+	ds.dbm.Notify(path)
+}
+
 // Close 实现 DataSource 接口的 Close 方法
 func (ds *DataSource) Close() error {
 	return ds.dbm.Close()
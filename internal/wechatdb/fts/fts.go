@@ -0,0 +1,245 @@
+package fts
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/internal/errors"
+)
+
+// SchemaVersion 索引结构版本，版本不一致时重建索引
+const SchemaVersion = 1
+
+const schema = `
+CREATE TABLE IF NOT EXISTS fts_meta (
+	id INTEGER PRIMARY KEY,
+	talker TEXT NOT NULL,
+	seq INTEGER NOT NULL,
+	time INTEGER NOT NULL,
+	sender TEXT NOT NULL DEFAULT '',
+	UNIQUE(talker, seq)
+);
+CREATE INDEX IF NOT EXISTS fts_meta_time ON fts_meta(time);
+CREATE VIRTUAL TABLE IF NOT EXISTS fts_content USING fts4(content, tokenize=simple);
+CREATE TABLE IF NOT EXISTS fts_progress (
+	source TEXT NOT NULL,
+	tbl TEXT NOT NULL,
+	last_id INTEGER NOT NULL,
+	PRIMARY KEY(source, tbl)
+);
+`
+
+// Document 待索引的消息
+type Document struct {
+	Talker  string
+	Seq     int64
+	Time    int64
+	Sender  string
+	Content string
+}
+
+// Index 消息全文索引，保存在工作目录中，由 chatlog 自行维护
+type Index struct {
+	path  string
+	db    *sql.DB
+	mutex sync.Mutex
+	ready atomic.Bool
+}
+
+// Open 打开或创建全文索引
+func Open(path string) (*Index, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, errors.DBConnectFailed(path, err)
+	}
+
+	idx := &Index{
+		path: path,
+		db:   db,
+	}
+	if err := idx.init(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+func (i *Index) init() error {
+	var version int
+	if err := i.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return errors.QueryFailed("PRAGMA user_version", err)
+	}
+
+	if version != SchemaVersion {
+		log.Info().Msgf("fts index schema version %d, expected %d, rebuild index %s", version, SchemaVersion, i.path)
+		for _, table := range []string{"fts_meta", "fts_content", "fts_progress"} {
+			if _, err := i.db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+				return errors.QueryFailed("DROP TABLE "+table, err)
+			}
+		}
+	}
+
+	if _, err := i.db.Exec(schema); err != nil {
+		return errors.QueryFailed(schema, err)
+	}
+
+	if _, err := i.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", SchemaVersion)); err != nil {
+		return errors.QueryFailed("PRAGMA user_version", err)
+	}
+
+	return nil
+}
+
+// Ready 索引是否可用于查询
+// 首次构建完成前不可用，查询方应回退到逐行匹配；之后查询方需要逐行匹配 Progress 之后尚未索引的消息
+func (i *Index) Ready() bool {
+	return i.ready.Load()
+}
+
+// SetReady 设置索引是否可用
+func (i *Index) SetReady(ready bool) {
+	i.ready.Store(ready)
+}
+
+// Progress 获取数据源中各表已索引到的位置
+func (i *Index) Progress(ctx context.Context, source string) (map[string]int64, error) {
+	rows, err := i.db.QueryContext(ctx, "SELECT tbl, last_id FROM fts_progress WHERE source = ?", source)
+	if err != nil {
+		return nil, errors.QueryFailed("SELECT fts_progress", err)
+	}
+	defer rows.Close()
+
+	progress := make(map[string]int64)
+	for rows.Next() {
+		var table string
+		var lastID int64
+		if err := rows.Scan(&table, &lastID); err != nil {
+			return nil, errors.ScanRowFailed(err)
+		}
+		progress[table] = lastID
+	}
+
+	return progress, nil
+}
+
+// Append 写入一批消息，并在同一事务中更新索引位置
+func (i *Index) Append(ctx context.Context, source, table string, lastID int64, docs []*Document) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.QueryFailed("BEGIN", err)
+	}
+	defer tx.Rollback()
+
+	metaStmt, err := tx.PrepareContext(ctx, "INSERT OR IGNORE INTO fts_meta (talker, seq, time, sender) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return errors.QueryFailed("INSERT fts_meta", err)
+	}
+	defer metaStmt.Close()
+
+	contentStmt, err := tx.PrepareContext(ctx, "INSERT INTO fts_content (docid, content) VALUES (?, ?)")
+	if err != nil {
+		return errors.QueryFailed("INSERT fts_content", err)
+	}
+	defer contentStmt.Close()
+
+	for _, doc := range docs {
+		tokens := Tokenize(doc.Content)
+		if tokens == "" {
+			continue
+		}
+		result, err := metaStmt.ExecContext(ctx, doc.Talker, doc.Seq, doc.Time, doc.Sender)
+		if err != nil {
+			return errors.QueryFailed("INSERT fts_meta", err)
+		}
+		// 已索引过的消息不重复写入
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		docID, err := result.LastInsertId()
+		if err != nil {
+			return errors.QueryFailed("INSERT fts_meta", err)
+		}
+		if _, err := contentStmt.ExecContext(ctx, docID, tokens); err != nil {
+			return errors.QueryFailed("INSERT fts_content", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"INSERT OR REPLACE INTO fts_progress (source, tbl, last_id) VALUES (?, ?, ?)",
+		source, table, lastID); err != nil {
+		return errors.QueryFailed("INSERT fts_progress", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.QueryFailed("COMMIT", err)
+	}
+
+	return nil
+}
+
+// Search 查询时间范围内命中关键词的消息，返回 talker => seq 列表
+// talkers 为空时查询所有会话
+// 当索引不可用或关键词无法转换为索引查询时，返回 false
+func (i *Index) Search(ctx context.Context, talkers []string, startTime, endTime time.Time, keyword string) (map[string][]int64, bool) {
+	if !i.Ready() {
+		return nil, false
+	}
+
+	match, ok := MatchQuery(keyword)
+	if !ok {
+		return nil, false
+	}
+
+	query := `
+		SELECT m.talker, m.seq
+		FROM fts_content f
+		JOIN fts_meta m ON m.id = f.docid
+		WHERE fts_content MATCH ? AND m.time >= ? AND m.time <= ?`
+	args := []interface{}{match, startTime.Unix(), endTime.Unix()}
+	if len(talkers) > 0 {
+		b, _ := json.Marshal(talkers)
+		query += " AND m.talker IN (SELECT value FROM json_each(?))"
+		args = append(args, string(b))
+	}
+
+	rows, err := i.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Debug().Err(err).Msgf("fts search %s failed", keyword)
+		return nil, false
+	}
+	defer rows.Close()
+
+	result := make(map[string][]int64)
+	for rows.Next() {
+		var talker string
+		var seq int64
+		if err := rows.Scan(&talker, &seq); err != nil {
+			log.Debug().Err(err).Msg("fts scan row failed")
+			return nil, false
+		}
+		result[talker] = append(result[talker], seq)
+	}
+	if err := rows.Err(); err != nil {
+		log.Debug().Err(err).Msgf("fts search %s failed", keyword)
+		return nil, false
+	}
+
+	return result, true
+}
+
+// Close 关闭索引
+func (i *Index) Close() error {
+	return i.db.Close()
+}
@@ -0,0 +1,102 @@
+package fts
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"你好吗", "你好 好吗 吗"},
+		{"你", "你"},
+		{"Hi, 项目进度", "hi i 项目 目进 进度 度"},
+		{"，。！", ""},
+	}
+
+	for _, tt := range tests {
+		if got := Tokenize(tt.input); got != tt.want {
+			t.Errorf("Tokenize(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestMatchQuery(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   string
+		wantOk bool
+	}{
+		{"项目进度", `"项目 目进 进度"`, true},
+		{"进", "进*", true},
+		{"项目 report", `"项目" AND "re ep po or rt"`, true},
+		{"项目|进度", `("项目") OR ("进度")`, true},
+		{"项目.*进度", "", false},
+		{"!!", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := MatchQuery(tt.input)
+		if ok != tt.wantOk || got != tt.want {
+			t.Errorf("MatchQuery(%q) = %q, %v, want %q, %v", tt.input, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestIndexSearch(t *testing.T) {
+	idx, err := Open(filepath.Join(t.TempDir(), "fts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	ctx := context.Background()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	docs := []*Document{
+		{Talker: "a@chatroom", Seq: 1, Time: base.Unix(), Content: "今天的项目进度怎么样"},
+		{Talker: "a@chatroom", Seq: 2, Time: base.Add(time.Hour).Unix(), Content: "deploy finished"},
+		{Talker: "wxid_b", Seq: 3, Time: base.Add(2 * time.Hour).Unix(), Content: "进度已同步"},
+	}
+	if err := idx.Append(ctx, "message_0.db", "Msg_a", 10, docs); err != nil {
+		t.Fatal(err)
+	}
+	// 重复写入不会产生重复结果
+	if err := idx.Append(ctx, "message_0.db", "Msg_a", 10, docs); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := idx.Search(ctx, nil, base, base.Add(24*time.Hour), "进度"); ok {
+		t.Fatal("search should be unavailable before index is ready")
+	}
+	idx.SetReady(true)
+
+	result, ok := idx.Search(ctx, nil, base, base.Add(24*time.Hour), "进度")
+	if !ok {
+		t.Fatal("search failed")
+	}
+	if len(result["a@chatroom"]) != 1 || len(result["wxid_b"]) != 1 {
+		t.Errorf("unexpected result: %v", result)
+	}
+
+	result, _ = idx.Search(ctx, []string{"a@chatroom"}, base, base.Add(24*time.Hour), "ploy")
+	if len(result["a@chatroom"]) != 1 || result["a@chatroom"][0] != 2 {
+		t.Errorf("unexpected result: %v", result)
+	}
+
+	result, _ = idx.Search(ctx, nil, base.Add(90*time.Minute), base.Add(24*time.Hour), "进度")
+	if len(result) != 1 || len(result["wxid_b"]) != 1 {
+		t.Errorf("unexpected result: %v", result)
+	}
+
+	progress, err := idx.Progress(ctx, "message_0.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress["Msg_a"] != 10 {
+		t.Errorf("unexpected progress: %v", progress)
+	}
+}
@@ -0,0 +1,101 @@
+package fts
+
+import (
+	"regexp/syntax"
+	"strings"
+	"unicode"
+)
+
+// Tokenize 将文本切分为索引使用的 n-gram 词元
+// 连续的字母、数字（包括中日韩文字）视为一段，每段按二元组切分，并在末尾补充最后一个字符，
+// 以便单字查询可以通过前缀匹配命中任意位置
+// 例如 "你好吗" => "你好 好吗 吗"
+func Tokenize(text string) string {
+	buf := strings.Builder{}
+	for _, run := range splitRuns(text) {
+		for i := 0; i < len(run); i++ {
+			if buf.Len() > 0 {
+				buf.WriteByte(' ')
+			}
+			if i+1 < len(run) {
+				buf.WriteString(string(run[i : i+2]))
+			} else {
+				buf.WriteString(string(run[i]))
+			}
+		}
+	}
+	return buf.String()
+}
+
+// MatchQuery 将关键词转换为 FTS MATCH 查询语句
+// 仅支持字面量及字面量的"|"组合，其余正则表达式返回 false，由调用方回退到逐行匹配
+func MatchQuery(keyword string) (string, bool) {
+	re, err := syntax.Parse(keyword, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+
+	switch re.Op {
+	case syntax.OpLiteral:
+		return literalQuery(string(re.Rune))
+	case syntax.OpAlternate:
+		parts := make([]string, 0, len(re.Sub))
+		for _, sub := range re.Sub {
+			if sub.Op != syntax.OpLiteral {
+				return "", false
+			}
+			q, ok := literalQuery(string(sub.Rune))
+			if !ok {
+				return "", false
+			}
+			parts = append(parts, "("+q+")")
+		}
+		return strings.Join(parts, " OR "), true
+	}
+
+	return "", false
+}
+
+// literalQuery 构建字面量的查询语句
+// 每一段连续文本转换为二元组短语，单字使用前缀查询，多段之间为 AND 关系
+func literalQuery(literal string) (string, bool) {
+	runs := splitRuns(literal)
+	if len(runs) == 0 {
+		return "", false
+	}
+
+	parts := make([]string, 0, len(runs))
+	for _, run := range runs {
+		if len(run) == 1 {
+			parts = append(parts, string(run)+"*")
+			continue
+		}
+		grams := make([]string, 0, len(run)-1)
+		for i := 0; i+1 < len(run); i++ {
+			grams = append(grams, string(run[i:i+2]))
+		}
+		parts = append(parts, `"`+strings.Join(grams, " ")+`"`)
+	}
+	return strings.Join(parts, " AND "), true
+}
+
+// splitRuns 按非字母数字字符切分文本，并统一转换为小写
+func splitRuns(text string) [][]rune {
+	runs := make([][]rune, 0)
+	var cur []rune
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			cur = append(cur, r)
+			continue
+		}
+		if len(cur) > 0 {
+			runs = append(runs, cur)
+			cur = nil
+		}
+	}
+	if len(cur) > 0 {
+		runs = append(runs, cur)
+	}
+	return runs
+}
@@ -100,7 +100,7 @@ func (r *Repository) GetChatRooms(ctx context.Context, key string, limit, offset
 
 	ret := make([]*model.ChatRoom, 0)
 	if key != "" {
-		ret = r.findChatRooms(key)
+		ret = r.filterChatRooms(ctx, r.findChatRooms(key))
 		if len(ret) == 0 {
 			return []*model.ChatRoom{}, nil
 		}
@@ -116,7 +116,7 @@ func (r *Repository) GetChatRooms(ctx context.Context, key string, limit, offset
 			return ret[offset:end], nil
 		}
 	} else {
-		list := r.chatRoomList
+		list := r.filterNames(ctx, r.chatRoomList)
 		if limit > 0 {
 			end := offset + limit
 			if end > len(list) {
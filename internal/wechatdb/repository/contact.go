@@ -24,6 +24,7 @@ func (r *Repository) initContactCache(ctx context.Context) error {
 	aliasList := make([]string, 0)
 	remarkList := make([]string, 0)
 	nickNameList := make([]string, 0)
+	md5Map := make(map[string]string)
 
 	// 加载所有联系人到缓存
 	// 暂时忽略获取不到联系人的错误
@@ -35,6 +36,7 @@ func (r *Repository) initContactCache(ctx context.Context) error {
 	for _, contact := range contacts {
 		contactMap[contact.UserName] = contact
 		contactList = append(contactList, contact.UserName)
+		md5Map[userNameMD5(contact.UserName)] = contact.UserName
 
 		// 建立快速查找索引
 		if contact.Alias != "" {
@@ -90,6 +92,7 @@ func (r *Repository) initContactCache(ctx context.Context) error {
 	r.aliasList = aliasList
 	r.remarkList = remarkList
 	r.nickNameList = nickNameList
+	r.md5ToUserName = md5Map
 	return nil
 }
 
@@ -105,7 +108,7 @@ func (r *Repository) GetContact(ctx context.Context, key string) (*model.Contact
 func (r *Repository) GetContacts(ctx context.Context, key string, limit, offset int) ([]*model.Contact, error) {
 	ret := make([]*model.Contact, 0)
 	if key != "" {
-		ret = r.findContacts(key)
+		ret = r.filterContacts(ctx, r.findContacts(key))
 		if len(ret) == 0 {
 			return []*model.Contact{}, nil
 		}
@@ -120,7 +123,7 @@ func (r *Repository) GetContacts(ctx context.Context, key string, limit, offset
 			return ret[offset:end], nil
 		}
 	} else {
-		list := r.contactList
+		list := r.filterNames(ctx, r.contactList)
 		if limit > 0 {
 			end := offset + limit
 			if end > len(list) {
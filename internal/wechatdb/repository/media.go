@@ -3,9 +3,17 @@ package repository
 import (
 	"context"
 
+	"github.com/sjzar/chatlog/internal/errors"
 	"github.com/sjzar/chatlog/internal/model"
 )
 
 func (r *Repository) GetMedia(ctx context.Context, _type string, key string) (*model.Media, error) {
-	return r.ds.GetMedia(ctx, _type, key)
+	media, err := r.ds.GetMedia(ctx, _type, key)
+	if err != nil {
+		return nil, err
+	}
+	if !r.AllowedMediaPath(ctx, media.Path) {
+		return nil, errors.ErrMediaNotFound
+	}
+	return media, nil
 }
@@ -2,20 +2,34 @@ package repository
 
 import (
 	"context"
+	"iter"
 	"strings"
 	"time"
 
+	"github.com/sjzar/chatlog/internal/errors"
 	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
+	"github.com/sjzar/chatlog/pkg/metrics"
 	"github.com/sjzar/chatlog/pkg/util"
 
 	"github.com/rs/zerolog/log"
 )
 
+// messageRows 每次查询从数据源扫描的消息行数（过滤和分页前）
+var messageRows = metrics.NewHistogram("chatlog_message_rows", "Message rows scanned by the data source per query, before filtering.",
+	[]float64{0, 1, 10, 50, 100, 500, 1000, 5000, 10000, 50000}, "method")
+
 // GetMessages 实现 Repository 接口的 GetMessages 方法
 func (r *Repository) GetMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
 
 	talker, sender = r.parseTalkerAndSender(ctx, talker, sender)
+	talker, err := r.filterTalkers(ctx, talker)
+	if err != nil {
+		return nil, err
+	}
+	ctx, scanned := dbm.WithRowCounter(ctx)
 	messages, err := r.ds.GetMessages(ctx, startTime, endTime, talker, sender, keyword, limit, offset)
+	messageRows.With("GetMessages").Observe(float64(scanned.Load()))
 	if err != nil {
 		return nil, err
 	}
@@ -28,6 +42,119 @@ func (r *Repository) GetMessages(ctx context.Context, startTime, endTime time.Ti
 	return messages, nil
 }
 
+// IterMessages 流式获取消息，逐条补充消息信息
+func (r *Repository) IterMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string) (iter.Seq2[*model.Message, error], error) {
+
+	talker, sender = r.parseTalkerAndSender(ctx, talker, sender)
+	talker, err := r.filterTalkers(ctx, talker)
+	if err != nil {
+		return nil, err
+	}
+	ctx, scanned := dbm.WithRowCounter(ctx)
+	seq, err := r.ds.IterMessages(ctx, startTime, endTime, talker, sender, keyword)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(yield func(*model.Message, error) bool) {
+		// 遍历结束或中止时记录扫描行数
+		defer func() { messageRows.With("IterMessages").Observe(float64(scanned.Load())) }()
+		for msg, err := range seq {
+			if err == nil {
+				r.enrichMessage(msg)
+			}
+			if !yield(msg, err) || err != nil {
+				return
+			}
+		}
+	}, nil
+}
+
+// CountMessages 统计消息数量，Talker 为实际查询的会话
+func (r *Repository) CountMessages(ctx context.Context, startTime, endTime time.Time, talker string) (*model.MessageCounts, error) {
+
+	talker, _ = r.parseTalkerAndSender(ctx, talker, "")
+	talker, err := r.filterTalkers(ctx, talker)
+	if err != nil {
+		return nil, err
+	}
+	ctx, scanned := dbm.WithRowCounter(ctx)
+	counts, err := r.ds.CountMessages(ctx, startTime, endTime, talker)
+	messageRows.With("CountMessages").Observe(float64(scanned.Load()))
+	if err != nil {
+		return nil, err
+	}
+	counts.Talker = talker
+
+	return counts, nil
+}
+
+// GetMessagesByCursor 按游标分页获取消息
+func (r *Repository) GetMessagesByCursor(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string, cursor *model.Cursor, limit int) ([]*model.Message, error) {
+
+	talker, sender = r.parseTalkerAndSender(ctx, talker, sender)
+	talker, err := r.filterTalkers(ctx, talker)
+	if err != nil {
+		return nil, err
+	}
+	ctx, scanned := dbm.WithRowCounter(ctx)
+	messages, err := r.ds.GetMessagesByCursor(ctx, startTime, endTime, talker, sender, keyword, cursor, limit)
+	messageRows.With("GetMessagesByCursor").Observe(float64(scanned.Load()))
+	if err != nil {
+		return nil, err
+	}
+
+	// 补充消息信息
+	if err := r.EnrichMessages(ctx, messages); err != nil {
+		log.Debug().Msgf("EnrichMessages failed: %v", err)
+	}
+
+	return messages, nil
+}
+
+// GetMessageContext 获取会话中指定序号的消息及其前后各 before、after 条消息，不受时间间隔限制
+func (r *Repository) GetMessageContext(ctx context.Context, talker string, seq int64, before, after int) ([]*model.Message, error) {
+	if talker == "" {
+		return nil, errors.ErrTalkerEmpty
+	}
+	talker, _ = r.parseTalkerAndSender(ctx, talker, "")
+	if strings.Contains(talker, ",") {
+		return nil, errors.InvalidArg("talker")
+	}
+	talker, err := r.filterTalkers(ctx, talker)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, _ := util.TimeRangeOf("all")
+
+	messages := make([]*model.Message, 0, before+after+1)
+	if before > 0 {
+		prev, err := r.ds.GetMessagesByCursor(ctx, start, end, talker, "", "", &model.Cursor{Seq: seq, Talker: talker, Prev: true}, before)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, prev...)
+	}
+
+	// 游标 Talker 为空时，查询条件为 Seq >= seq，结果包含指定消息本身
+	next, err := r.ds.GetMessagesByCursor(ctx, start, end, talker, "", "", &model.Cursor{Seq: seq}, after+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(next) == 0 || next[0].Seq != seq {
+		return nil, errors.ErrMessageNotFound
+	}
+	messages = append(messages, next...)
+
+	// 补充消息信息
+	if err := r.EnrichMessages(ctx, messages); err != nil {
+		log.Debug().Msgf("EnrichMessages failed: %v", err)
+	}
+
+	return messages, nil
+}
+
 // EnrichMessages 补充消息的额外信息
 func (r *Repository) EnrichMessages(ctx context.Context, messages []*model.Message) error {
 	for _, msg := range messages {
@@ -109,3 +236,30 @@ func (r *Repository) parseTalkerAndSender(ctx context.Context, talker, sender st
 
 	return talker, sender
 }
+
+// SearchMessages 跨会话流式搜索消息，talker 为空时搜索所有会话
+func (r *Repository) SearchMessages(ctx context.Context, startTime, endTime time.Time, talker string, sender string, keyword string) (iter.Seq2[*model.Message, error], error) {
+	if keyword == "" {
+		return nil, errors.ErrKeywordEmpty
+	}
+
+	if talker == "" {
+		sessions, err := r.GetSessions(ctx, "", 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		talkers := make([]string, 0, len(sessions))
+		for _, session := range sessions {
+			if session.UserName == "" {
+				continue
+			}
+			talkers = append(talkers, session.UserName)
+		}
+		if len(talkers) == 0 {
+			return model.MessageSeq(nil), nil
+		}
+		talker = strings.Join(talkers, ",")
+	}
+
+	return r.IterMessages(ctx, startTime, endTime, talker, sender, keyword)
+}
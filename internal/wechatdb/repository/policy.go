@@ -0,0 +1,180 @@
+package repository
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sjzar/chatlog/internal/errors"
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+// LabelPrefix 按联系人标签匹配会话的规则前缀，如 "label:家人"
+const LabelPrefix = "label:"
+
+// Policy 限制可访问的会话
+// 规则可以是联系人 ID、群聊 ID 或 "label:标签名"，Allow 为空时允许除 Deny 以外的所有会话，同时匹配时 Deny 优先
+// 数据源不支持联系人标签时服务启动会拒绝标签规则，这里仍按 Deny 中的标签规则匹配所有会话，Allow 中的标签规则不匹配任何会话处理
+type Policy struct {
+	Allow []string
+	Deny  []string
+}
+
+type policyKey struct{}
+
+// WithPolicy 返回携带访问策略的 context，Repository 的查询方法会按策略过滤会话
+func WithPolicy(ctx context.Context, policy *Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, policy)
+}
+
+// PolicyFrom 获取 context 中的访问策略，未设置或没有规则时返回 nil
+func PolicyFrom(ctx context.Context) *Policy {
+	policy, _ := ctx.Value(policyKey{}).(*Policy)
+	if policy == nil || (len(policy.Allow) == 0 && len(policy.Deny) == 0) {
+		return nil
+	}
+	return policy
+}
+
+// AllowedTalker 判断会话是否可以访问
+func (r *Repository) AllowedTalker(ctx context.Context, userName string) bool {
+	return r.allowed(ctx, userName)
+}
+
+// allowed 判断会话是否可以访问
+func (r *Repository) allowed(ctx context.Context, userName string) bool {
+	policy := PolicyFrom(ctx)
+	if policy == nil {
+		return true
+	}
+	if r.matchRules(policy.Deny, userName, true) {
+		return false
+	}
+	return len(policy.Allow) == 0 || r.matchRules(policy.Allow, userName, false)
+}
+
+// matchRules 判断会话是否匹配规则，无法解析的标签规则按 unresolved 处理
+func (r *Repository) matchRules(rules []string, userName string, unresolved bool) bool {
+	for _, rule := range rules {
+		if label, ok := strings.CutPrefix(rule, LabelPrefix); ok {
+			if !r.labels {
+				if unresolved {
+					return true
+				}
+				continue
+			}
+			if contact, ok := r.contactCache[userName]; ok && slices.Contains(contact.Labels, label) {
+				return true
+			}
+			continue
+		}
+		if rule == userName {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTalkers 移除不允许访问的会话，指定的会话都不允许访问时返回错误
+func (r *Repository) filterTalkers(ctx context.Context, talker string) (string, error) {
+	if PolicyFrom(ctx) == nil {
+		return talker, nil
+	}
+	if talker == "" {
+		return "", errors.ErrTalkerEmpty
+	}
+
+	talkers := strings.Split(talker, ",")
+	allowed := make([]string, 0, len(talkers))
+	for _, t := range talkers {
+		if r.allowed(ctx, t) {
+			allowed = append(allowed, t)
+		}
+	}
+	if len(allowed) == 0 {
+		return "", errors.TalkerNotAllowed(talker)
+	}
+	return strings.Join(allowed, ","), nil
+}
+
+// mediaTalkerDirs 媒体文件路径中，以会话 ID 的 MD5 命名的目录的上级目录
+var mediaTalkerDirs = []string{"MsgAttach", "attach", "MessageTemp"}
+
+// AllowedMediaPath 根据媒体文件路径中的会话目录判断是否可以访问
+// 无法确定所属会话的文件（如视频、文件、语音）在设置了访问策略时不允许访问
+func (r *Repository) AllowedMediaPath(ctx context.Context, path string) bool {
+	policy := PolicyFrom(ctx)
+	if policy == nil {
+		return true
+	}
+
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if !slices.Contains(mediaTalkerDirs, parts[i]) {
+			continue
+		}
+		if userName, ok := r.talkerOfMD5(parts[i+1]); ok {
+			return r.allowed(ctx, userName)
+		}
+	}
+	return false
+}
+
+func (r *Repository) talkerOfMD5(hash string) (string, bool) {
+	if userName, ok := r.md5ToUserName[hash]; ok {
+		return userName, true
+	}
+	for _, name := range r.chatRoomList {
+		if userNameMD5(name) == hash {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func userNameMD5(userName string) string {
+	h := md5.Sum([]byte(userName))
+	return hex.EncodeToString(h[:])
+}
+
+func (r *Repository) filterContacts(ctx context.Context, contacts []*model.Contact) []*model.Contact {
+	if PolicyFrom(ctx) == nil {
+		return contacts
+	}
+	ret := make([]*model.Contact, 0, len(contacts))
+	for _, contact := range contacts {
+		if r.allowed(ctx, contact.UserName) {
+			ret = append(ret, contact)
+		}
+	}
+	return ret
+}
+
+func (r *Repository) filterChatRooms(ctx context.Context, chatRooms []*model.ChatRoom) []*model.ChatRoom {
+	if PolicyFrom(ctx) == nil {
+		return chatRooms
+	}
+	ret := make([]*model.ChatRoom, 0, len(chatRooms))
+	for _, chatRoom := range chatRooms {
+		if r.allowed(ctx, chatRoom.Name) {
+			ret = append(ret, chatRoom)
+		}
+	}
+	return ret
+}
+
+func (r *Repository) filterNames(ctx context.Context, names []string) []string {
+	if PolicyFrom(ctx) == nil {
+		return names
+	}
+	ret := make([]string, 0, len(names))
+	for _, name := range names {
+		if r.allowed(ctx, name) {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
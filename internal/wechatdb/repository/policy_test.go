@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+func TestPolicy(t *testing.T) {
+	r := &Repository{
+		labels: true,
+		contactCache: map[string]*model.Contact{
+			"wxid_family": {UserName: "wxid_family", Labels: []string{"家人"}},
+			"wxid_friend": {UserName: "wxid_friend"},
+		},
+		md5ToUserName: map[string]string{userNameMD5("wxid_family"): "wxid_family"},
+		chatRoomList:  []string{"work@chatroom", "hr@chatroom"},
+	}
+
+	ctx := WithPolicy(context.Background(), &Policy{Deny: []string{"label:家人", "hr@chatroom"}})
+	for talker, want := range map[string]bool{
+		"wxid_family":   false,
+		"wxid_friend":   true,
+		"hr@chatroom":   false,
+		"work@chatroom": true,
+	} {
+		if got := r.AllowedTalker(ctx, talker); got != want {
+			t.Errorf("deny policy: %s allowed = %v, want %v", talker, got, want)
+		}
+	}
+
+	talker, err := r.filterTalkers(ctx, "wxid_friend,hr@chatroom")
+	if err != nil || talker != "wxid_friend" {
+		t.Errorf("filterTalkers = %q, %v", talker, err)
+	}
+	if _, err := r.filterTalkers(ctx, "hr@chatroom"); err == nil {
+		t.Error("expected error when all talkers are denied")
+	}
+
+	if r.AllowedMediaPath(ctx, "msg/attach/"+userNameMD5("wxid_family")+"/2024-01/Img/a.dat") {
+		t.Error("media of denied talker should not be allowed")
+	}
+	if !r.AllowedMediaPath(ctx, "FileStorage/MsgAttach/"+userNameMD5("work@chatroom")+"/Image/a.dat") {
+		t.Error("media of allowed chat room should be allowed")
+	}
+	if r.AllowedMediaPath(ctx, "msg/file/2024-01/a.pdf") || r.AllowedMediaPath(ctx, "") {
+		t.Error("media of unknown talker should not be allowed with deny rules")
+	}
+
+	ctx = WithPolicy(context.Background(), &Policy{Allow: []string{"work@chatroom"}})
+	if r.AllowedTalker(ctx, "wxid_friend") || !r.AllowedTalker(ctx, "work@chatroom") {
+		t.Error("allow policy should only allow listed talkers")
+	}
+	if r.AllowedMediaPath(ctx, "msg/file/2024-01/a.pdf") {
+		t.Error("media of unknown talker should not be allowed with allow rules")
+	}
+
+	if !r.AllowedTalker(context.Background(), "hr@chatroom") {
+		t.Error("no policy should allow all talkers")
+	}
+
+	// 数据源不支持标签时，标签规则按拒绝处理
+	r.labels = false
+	ctx = WithPolicy(context.Background(), &Policy{Deny: []string{"label:家人"}})
+	if r.AllowedTalker(ctx, "wxid_friend") || r.AllowedTalker(ctx, "work@chatroom") {
+		t.Error("unresolvable deny label should deny all talkers")
+	}
+	ctx = WithPolicy(context.Background(), &Policy{Allow: []string{"label:家人", "work@chatroom"}})
+	if r.AllowedTalker(ctx, "wxid_family") || !r.AllowedTalker(ctx, "work@chatroom") {
+		t.Error("unresolvable allow label should match no talkers")
+	}
+}
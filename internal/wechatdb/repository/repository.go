@@ -13,7 +13,8 @@ import (
 
 // Repository 实现了 repository.Repository 接口
 type Repository struct {
-	ds datasource.DataSource
+	ds     datasource.DataSource
+	labels bool // 数据源是否支持联系人标签
 
 	// Cache for contact
 	contactCache      map[string]*model.Contact
@@ -25,6 +26,7 @@ type Repository struct {
 	aliasList         []string
 	remarkList        []string
 	nickNameList      []string
+	md5ToUserName     map[string]string // 媒体文件目录使用会话 ID 的 MD5 命名
 
 	// Cache for chat room
 	chatRoomCache      map[string]*model.ChatRoom
@@ -42,7 +44,9 @@ type Repository struct {
 func New(ds datasource.DataSource) (*Repository, error) {
 	r := &Repository{
 		ds:                 ds,
+		labels:             ds.SupportsLabels(),
 		contactCache:       make(map[string]*model.Contact),
+		md5ToUserName:      make(map[string]string),
 		aliasToContact:     make(map[string][]*model.Contact),
 		remarkToContact:    make(map[string][]*model.Contact),
 		nickNameToContact:  make(map[string][]*model.Contact),
@@ -7,5 +7,26 @@ import (
 )
 
 func (r *Repository) GetSessions(ctx context.Context, key string, limit, offset int) ([]*model.Session, error) {
-	return r.ds.GetSessions(ctx, key, limit, offset)
+	if PolicyFrom(ctx) == nil {
+		return r.ds.GetSessions(ctx, key, limit, offset)
+	}
+
+	// 按访问策略过滤后再分页
+	sessions, err := r.ds.GetSessions(ctx, key, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*model.Session, 0, len(sessions))
+	for _, session := range sessions {
+		if r.allowed(ctx, session.UserName) {
+			ret = append(ret, session)
+		}
+	}
+	if limit > 0 {
+		if offset >= len(ret) {
+			return []*model.Session{}, nil
+		}
+		ret = ret[offset:min(offset+limit, len(ret))]
+	}
+	return ret, nil
 }
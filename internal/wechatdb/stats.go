@@ -0,0 +1,254 @@
+package wechatdb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+// MessageStats 会话消息统计
+type MessageStats struct {
+	Talker     string         `json:"talker"`
+	TalkerName string         `json:"talkerName"`
+	IsChatRoom bool           `json:"isChatRoom"`
+	Total      int            `json:"total"`
+	FirstTime  time.Time      `json:"firstTime"`
+	LastTime   time.Time      `json:"lastTime"`
+	Senders    []*SenderStat  `json:"senders"` // 按消息数量倒序
+	Types      []*TypeStat    `json:"types"`   // 按消息数量倒序
+	Hours      [24]int        `json:"hours"`   // 按小时（0-23）统计
+	Days       []*DayStat     `json:"days"`    // 按日期升序
+	Media      map[string]int `json:"media"`   // 媒体消息数量：image, video, voice, file, emoji
+}
+
+type SenderStat struct {
+	Sender     string `json:"sender"`
+	SenderName string `json:"senderName"`
+	IsSelf     bool   `json:"isSelf"`
+	Count      int    `json:"count"`
+}
+
+type TypeStat struct {
+	Type    int64  `json:"type"`
+	SubType int64  `json:"subType"`
+	Name    string `json:"name"`
+	Count   int    `json:"count"`
+}
+
+type DayStat struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+// GetMessageStats 统计会话在时间范围内的消息
+// 由数据源按发送者、类型和时间分组计数，不读取完整的消息
+func (w *DB) GetMessageStats(ctx context.Context, start, end time.Time, talker string) (*MessageStats, error) {
+	counts, err := w.repo.CountMessages(ctx, start, end, talker)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := newMessageStats(counts)
+
+	// 通过消息补充会话和发送者的显示名称
+	if stats.Total > 0 && !strings.Contains(counts.Talker, ",") {
+		msg := &model.Message{Talker: stats.Talker, IsChatRoom: stats.IsChatRoom, IsSelf: true}
+		w.repo.EnrichMessages(ctx, []*model.Message{msg})
+		stats.TalkerName = msg.TalkerName
+	}
+	senders := make(map[string]*SenderStat, len(stats.Senders))
+	for _, sender := range stats.Senders {
+		senders[sender.Sender] = sender
+	}
+	keys := make([]model.SenderKey, 0, len(counts.Senders))
+	for key := range counts.Senders {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Talker != keys[j].Talker {
+			return keys[i].Talker < keys[j].Talker
+		}
+		return keys[i].Sender < keys[j].Sender
+	})
+	for _, key := range keys {
+		sender := senders[key.Sender]
+		if sender.SenderName != "" {
+			continue
+		}
+		msg := &model.Message{Talker: key.Talker, IsChatRoom: strings.HasSuffix(key.Talker, "@chatroom"), Sender: key.Sender, IsSelf: key.IsSelf}
+		w.repo.EnrichMessages(ctx, []*model.Message{msg})
+		sender.SenderName = msg.SenderName
+	}
+
+	return stats, nil
+}
+
+// newMessageStats 根据分组计数生成统计结果，不包含显示名称
+func newMessageStats(counts *model.MessageCounts) *MessageStats {
+	stats := &MessageStats{
+		Talker:  counts.Talker,
+		Total:   counts.Total,
+		Senders: make([]*SenderStat, 0),
+		Types:   make([]*TypeStat, 0),
+		Days:    make([]*DayStat, 0),
+		Media:   make(map[string]int),
+	}
+	if counts.Total == 0 {
+		return stats
+	}
+	if !strings.Contains(counts.Talker, ",") {
+		stats.IsChatRoom = strings.HasSuffix(counts.Talker, "@chatroom")
+	}
+	stats.FirstTime = time.Unix(counts.FirstTime, 0)
+	stats.LastTime = time.Unix(counts.LastTime, 0)
+
+	// 同一发送者在多个会话中的消息合并计数
+	senders := make(map[string]*SenderStat)
+	for key, count := range counts.Senders {
+		sender, ok := senders[key.Sender]
+		if !ok {
+			sender = &SenderStat{Sender: key.Sender, IsSelf: key.IsSelf}
+			senders[key.Sender] = sender
+			stats.Senders = append(stats.Senders, sender)
+		}
+		sender.IsSelf = sender.IsSelf || key.IsSelf
+		sender.Count += count
+	}
+
+	types := make(map[[2]int64]*TypeStat)
+	for key, count := range counts.Types {
+		if key[0] != model.MessageTypeShare {
+			key[1] = 0
+		}
+		typ, ok := types[key]
+		if !ok {
+			typ = &TypeStat{Type: key[0], SubType: key[1], Name: model.MessageTypeName(key[0], key[1])}
+			types[key] = typ
+			stats.Types = append(stats.Types, typ)
+		}
+		typ.Count += count
+
+		if media := mediaType(key[0], key[1]); media != "" {
+			stats.Media[media] += count
+		}
+	}
+
+	days := make(map[string]*DayStat)
+	for bucket, count := range counts.Buckets {
+		t := time.Unix(bucket*model.CountBucket, 0)
+		stats.Hours[t.Hour()] += count
+
+		date := t.Format("2006-01-02")
+		day, ok := days[date]
+		if !ok {
+			day = &DayStat{Date: date}
+			days[date] = day
+			stats.Days = append(stats.Days, day)
+		}
+		day.Count += count
+	}
+
+	// 计数相同时按 ID 排序，保证结果稳定
+	sort.Slice(stats.Senders, func(i, j int) bool {
+		if stats.Senders[i].Count != stats.Senders[j].Count {
+			return stats.Senders[i].Count > stats.Senders[j].Count
+		}
+		return stats.Senders[i].Sender < stats.Senders[j].Sender
+	})
+	sort.Slice(stats.Types, func(i, j int) bool {
+		if stats.Types[i].Count != stats.Types[j].Count {
+			return stats.Types[i].Count > stats.Types[j].Count
+		}
+		if stats.Types[i].Type != stats.Types[j].Type {
+			return stats.Types[i].Type < stats.Types[j].Type
+		}
+		return stats.Types[i].SubType < stats.Types[j].SubType
+	})
+	sort.Slice(stats.Days, func(i, j int) bool {
+		return stats.Days[i].Date < stats.Days[j].Date
+	})
+
+	return stats
+}
+
+func mediaType(typ, subType int64) string {
+	switch typ {
+	case model.MessageTypeImage:
+		return "image"
+	case model.MessageTypeVideo:
+		return "video"
+	case model.MessageTypeVoice:
+		return "voice"
+	case model.MessageTypeAnimation:
+		return "emoji"
+	case model.MessageTypeShare:
+		switch subType {
+		case model.MessageSubTypeFile:
+			return "file"
+		case model.MessageSubTypeGIF:
+			return "emoji"
+		}
+	}
+	return ""
+}
+
+// PlainText 以文本形式输出统计结果
+func (s *MessageStats) PlainText() string {
+	buf := strings.Builder{}
+
+	name := s.Talker
+	if s.TalkerName != "" {
+		name = fmt.Sprintf("%s(%s)", s.TalkerName, s.Talker)
+	}
+	buf.WriteString(fmt.Sprintf("会话: %s\n", name))
+	buf.WriteString(fmt.Sprintf("消息总数: %d\n", s.Total))
+	if s.Total == 0 {
+		return buf.String()
+	}
+	buf.WriteString(fmt.Sprintf("时间范围: %s ~ %s\n", s.FirstTime.Format("2006-01-02 15:04:05"), s.LastTime.Format("2006-01-02 15:04:05")))
+
+	buf.WriteString("\n## 发送者\n")
+	for _, sender := range s.Senders {
+		id := sender.Sender
+		if sender.IsSelf {
+			id = "我"
+		}
+		if sender.SenderName != "" {
+			id = fmt.Sprintf("%s(%s)", sender.SenderName, id)
+		}
+		buf.WriteString(fmt.Sprintf("%s: %d\n", id, sender.Count))
+	}
+
+	buf.WriteString("\n## 消息类型\n")
+	for _, typ := range s.Types {
+		buf.WriteString(fmt.Sprintf("%s: %d\n", typ.Name, typ.Count))
+	}
+
+	if len(s.Media) > 0 {
+		buf.WriteString("\n## 媒体\n")
+		for _, media := range []string{"image", "video", "voice", "file", "emoji"} {
+			if count, ok := s.Media[media]; ok {
+				buf.WriteString(fmt.Sprintf("%s: %d\n", media, count))
+			}
+		}
+	}
+
+	buf.WriteString("\n## 时段分布\n")
+	for hour, count := range s.Hours {
+		if count == 0 {
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("%02d:00-%02d:59: %d\n", hour, hour, count))
+	}
+
+	buf.WriteString("\n## 每日消息\n")
+	for _, day := range s.Days {
+		buf.WriteString(fmt.Sprintf("%s: %d\n", day.Date, day.Count))
+	}
+
+	return buf.String()
+}
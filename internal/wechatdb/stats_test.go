@@ -0,0 +1,54 @@
+package wechatdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sjzar/chatlog/internal/model"
+)
+
+func TestNewMessageStats(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+8", 8*3600)
+	defer func() { time.Local = local }()
+
+	// 2024-01-01 23:30 +08:00 与 2024-01-02 00:15 +08:00
+	first := time.Date(2024, 1, 1, 23, 30, 0, 0, time.Local).Unix()
+	last := time.Date(2024, 1, 2, 0, 15, 0, 0, time.Local).Unix()
+
+	counts := model.NewMessageCounts()
+	counts.Talker = "123@chatroom"
+	counts.AddTime(first/model.CountBucket, 3, first, first+60)
+	counts.AddTime(last/model.CountBucket, 2, last, last)
+	counts.AddType(model.MessageTypeText, 0, 2)
+	counts.AddType(model.MessageTypeImage, 0, 1)
+	counts.AddType(model.MessageTypeShare, model.MessageSubTypeFile, 1)
+	counts.AddType(model.MessageTypeSystem, 0, 1)
+	counts.AddSender("123@chatroom", "a", false, 1)
+	counts.AddSender("123@chatroom", "b", false, 2)
+	counts.AddSender("123@chatroom", "me", true, 1)
+
+	stats := newMessageStats(counts)
+
+	if stats.Total != 5 || !stats.IsChatRoom {
+		t.Fatalf("total = %d, isChatRoom = %v", stats.Total, stats.IsChatRoom)
+	}
+	if stats.FirstTime.Unix() != first || stats.LastTime.Unix() != last {
+		t.Errorf("time range = %v ~ %v", stats.FirstTime, stats.LastTime)
+	}
+	if stats.Hours[23] != 3 || stats.Hours[0] != 2 {
+		t.Errorf("hours = %v", stats.Hours)
+	}
+	if len(stats.Days) != 2 || stats.Days[0].Date != "2024-01-01" || stats.Days[0].Count != 3 || stats.Days[1].Count != 2 {
+		t.Errorf("days = %+v", stats.Days)
+	}
+	if len(stats.Senders) != 3 || stats.Senders[0].Sender != "b" || stats.Senders[1].Sender != "a" || !stats.Senders[2].IsSelf {
+		t.Errorf("senders = %+v", stats.Senders)
+	}
+	if len(stats.Types) != 4 || stats.Types[0].Type != model.MessageTypeText || stats.Types[0].Count != 2 {
+		t.Errorf("types = %+v", stats.Types)
+	}
+	if stats.Media["image"] != 1 || stats.Media["file"] != 1 {
+		t.Errorf("media = %v", stats.Media)
+	}
+}
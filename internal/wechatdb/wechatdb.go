@@ -1,31 +1,66 @@
 package wechatdb
 
 import (
+	"container/heap"
 	"context"
+	"fmt"
+	"iter"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	_ "github.com/mattn/go-sqlite3"
 
+	"github.com/sjzar/chatlog/internal/errors"
 	"github.com/sjzar/chatlog/internal/model"
+	"github.com/sjzar/chatlog/internal/wechat/decrypt"
 	"github.com/sjzar/chatlog/internal/wechatdb/datasource"
+	"github.com/sjzar/chatlog/internal/wechatdb/datasource/dbm"
 	"github.com/sjzar/chatlog/internal/wechatdb/repository"
+	"github.com/sjzar/chatlog/pkg/util"
 )
 
+// Policy 限制可访问的会话，通过 WithPolicy 设置到查询使用的 context 中
+type Policy = repository.Policy
+
+// LabelPrefix 按联系人标签匹配会话的规则前缀
+const LabelPrefix = repository.LabelPrefix
+
+// WithPolicy 返回携带访问策略的 context
+func WithPolicy(ctx context.Context, policy *Policy) context.Context {
+	return repository.WithPolicy(ctx, policy)
+}
+
+// SupportsLabels 判断平台和版本对应的数据源是否支持联系人标签，不支持时不能使用标签规则
+func SupportsLabels(platform string, version int) bool {
+	return datasource.SupportsLabels(platform, version)
+}
+
 type DB struct {
 	path     string
 	platform string
 	version  int
+	cipher   *decrypt.WorkDirCipher
+	workers  int
 	ds       datasource.DataSource
 	repo     *repository.Repository
 }
 
-func New(path string, platform string, version int) (*DB, error) {
+// New 打开工作目录中的数据库，workDirKey 不为空时数据库使用该口令加密保存，打开时使用 workers 个并发解密
+func New(path string, platform string, version int, workDirKey string, workers int) (*DB, error) {
+	cipher, err := decrypt.NewWorkDirCipher(platform, version, workDirKey)
+	if err != nil {
+		return nil, err
+	}
 
 	w := &DB{
 		path:     path,
 		platform: platform,
 		version:  version,
+		cipher:   cipher,
+		workers:  workers,
 	}
 
 	// 初始化，加载数据库文件信息
@@ -45,7 +80,15 @@ func (w *DB) Close() error {
 
 func (w *DB) Initialize() error {
 	var err error
-	w.ds, err = datasource.New(w.path, w.platform, w.version)
+	var decrypter dbm.Decrypter
+	if w.cipher != nil {
+		// 同时打开的数据库共享并发限制
+		ctx := decrypt.WithWorkers(context.Background(), w.workers)
+		decrypter = func(path string) ([]byte, error) {
+			return w.cipher.Decrypt(ctx, path)
+		}
+	}
+	w.ds, err = datasource.New(w.path, w.platform, w.version, decrypter)
 	if err != nil {
 		return err
 	}
@@ -58,9 +101,7 @@ func (w *DB) Initialize() error {
 	return nil
 }
 
-func (w *DB) GetMessages(start, end time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
-	ctx := context.Background()
-
+func (w *DB) GetMessages(ctx context.Context, start, end time.Time, talker string, sender string, keyword string, limit, offset int) ([]*model.Message, error) {
 	// 使用 repository 获取消息
 	messages, err := w.repo.GetMessages(ctx, start, end, talker, sender, keyword, limit, offset)
 	if err != nil {
@@ -70,13 +111,228 @@ func (w *DB) GetMessages(start, end time.Time, talker string, sender string, key
 	return messages, nil
 }
 
+// IterMessages 流式获取消息，结果按 Seq 升序排列
+func (w *DB) IterMessages(ctx context.Context, start, end time.Time, talker string, sender string, keyword string) (iter.Seq2[*model.Message, error], error) {
+	return w.repo.IterMessages(ctx, start, end, talker, sender, keyword)
+}
+
+type GetMessagesPageResp struct {
+	Items      []*model.Message `json:"items"`
+	NextCursor string           `json:"nextCursor"`
+	PrevCursor string           `json:"prevCursor"`
+	HasMore    bool             `json:"hasMore"`
+}
+
+// GetMessagesByCursor 按游标分页获取消息，结果按 Seq 升序排列
+// 没有新消息时 NextCursor 保持不变，客户端可以使用同一游标轮询
+func (w *DB) GetMessagesByCursor(ctx context.Context, start, end time.Time, talker string, sender string, keyword string, cursor *model.Cursor, limit int) (*GetMessagesPageResp, error) {
+	// 多取一条用于判断是否还有更多消息
+	messages, err := w.repo.GetMessagesByCursor(ctx, start, end, talker, sender, keyword, cursor, limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		if cursor.Prev {
+			messages = messages[1:]
+		} else {
+			messages = messages[:limit]
+		}
+	}
+
+	resp := &GetMessagesPageResp{
+		Items:      messages,
+		NextCursor: (&model.Cursor{Seq: cursor.Seq, Talker: cursor.Talker}).String(),
+		PrevCursor: (&model.Cursor{Seq: cursor.Seq, Talker: cursor.Talker, Prev: true}).String(),
+		HasMore:    hasMore,
+	}
+	if len(messages) > 0 {
+		resp.NextCursor = model.NewCursor(messages[len(messages)-1], false).String()
+		resp.PrevCursor = model.NewCursor(messages[0], true).String()
+	}
+
+	return resp, nil
+}
+
+// GetMessageContext 获取指定消息前后的上下文消息，结果按 Seq 升序排列
+func (w *DB) GetMessageContext(ctx context.Context, talker string, seq int64, before, after int) ([]*model.Message, error) {
+	messages, err := w.repo.GetMessageContext(ctx, talker, seq, before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// SnippetRadius 搜索结果片段中，命中内容前后保留的字符数
+const SnippetRadius = 30
+
+type SearchMessagesResp struct {
+	Keyword string                `json:"keyword"`
+	Total   int                   `json:"total"`
+	Items   []*SearchMessageGroup `json:"items"`
+}
+
+// SearchMessageGroup 按会话分组的搜索结果
+type SearchMessageGroup struct {
+	Talker     string              `json:"talker"`
+	TalkerName string              `json:"talkerName"`
+	IsChatRoom bool                `json:"isChatRoom"`
+	Count      int                 `json:"count"` // 该会话的命中总数
+	Hits       []*SearchMessageHit `json:"hits"`
+}
+
+type SearchMessageHit struct {
+	Seq        int64     `json:"seq"`
+	Time       time.Time `json:"time"`
+	Sender     string    `json:"sender"`
+	SenderName string    `json:"senderName"`
+	IsSelf     bool      `json:"isSelf"`
+	Snippet    string    `json:"snippet"`
+}
+
+// SearchMessages 跨会话搜索消息，结果按时间倒序分页后按会话分组，命中内容使用 <em></em> 标记
+// prepare 不为空时，在生成片段前处理当前页的每条消息，如脱敏
+func (w *DB) SearchMessages(ctx context.Context, start, end time.Time, talker string, sender string, keyword string, limit, offset int, prepare func(m *model.Message)) (*SearchMessagesResp, error) {
+	regex, err := regexp.Compile(keyword)
+	if err != nil {
+		return nil, errors.QueryFailed("invalid regex pattern", err)
+	}
+
+	seq, err := w.repo.SearchMessages(ctx, start, end, talker, sender, keyword)
+	if err != nil {
+		return nil, err
+	}
+
+	// 遍历全部命中消息计数，只保留最新的 offset+limit 条
+	total := 0
+	counts := make(map[string]int)
+	hits := make(hitHeap, 0)
+	for m, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		total++
+		counts[m.Talker]++
+		switch {
+		case limit <= 0 || len(hits) < offset+limit:
+			heap.Push(&hits, m)
+		case newerHit(m, hits[0]):
+			hits[0] = m
+			heap.Fix(&hits, 0)
+		}
+	}
+
+	messages := []*model.Message(hits)
+	sort.SliceStable(messages, func(i, j int) bool {
+		return newerHit(messages[i], messages[j])
+	})
+
+	resp := &SearchMessagesResp{
+		Keyword: keyword,
+		Total:   total,
+		Items:   make([]*SearchMessageGroup, 0),
+	}
+
+	// 处理分页
+	if offset >= len(messages) {
+		return resp, nil
+	}
+	messages = messages[offset:]
+
+	groups := make(map[string]*SearchMessageGroup)
+	for _, m := range messages {
+		// prepare 可能替换会话对象，按原始 talker 分组
+		talker := m.Talker
+		if prepare != nil {
+			prepare(m)
+		}
+		group, ok := groups[talker]
+		if !ok {
+			group = &SearchMessageGroup{
+				Talker:     m.Talker,
+				TalkerName: m.TalkerName,
+				IsChatRoom: m.IsChatRoom,
+				Count:      counts[talker],
+				Hits:       make([]*SearchMessageHit, 0),
+			}
+			groups[talker] = group
+			resp.Items = append(resp.Items, group)
+		}
+		group.Hits = append(group.Hits, &SearchMessageHit{
+			Seq:        m.Seq,
+			Time:       m.Time,
+			Sender:     m.Sender,
+			SenderName: m.SenderName,
+			IsSelf:     m.IsSelf,
+			Snippet:    util.Snippet(m.PlainTextContent(), regex, SnippetRadius, "<em>", "</em>"),
+		})
+	}
+
+	return resp, nil
+}
+
+// newerHit 搜索结果按时间倒序排列，时间相同时按 Seq 倒序
+func newerHit(a, b *model.Message) bool {
+	if !a.Time.Equal(b.Time) {
+		return a.Time.After(b.Time)
+	}
+	return a.Seq > b.Seq
+}
+
+// hitHeap 以最早的命中消息为堆顶，用于保留最新的若干条搜索结果
+type hitHeap []*model.Message
+
+func (h hitHeap) Len() int           { return len(h) }
+func (h hitHeap) Less(i, j int) bool { return newerHit(h[j], h[i]) }
+func (h hitHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *hitHeap) Push(x any)        { *h = append(*h, x.(*model.Message)) }
+func (h *hitHeap) Pop() any {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
+
+// PlainText 以文本形式输出搜索结果
+func (r *SearchMessagesResp) PlainText(timeFormat string) string {
+	if timeFormat == "" {
+		timeFormat = "01-02 15:04:05"
+	}
+
+	buf := strings.Builder{}
+	buf.WriteString(fmt.Sprintf("共 %d 条结果\n", r.Total))
+	for _, group := range r.Items {
+		buf.WriteString("\n")
+		if group.TalkerName != "" {
+			buf.WriteString(fmt.Sprintf("## %s(%s) 共 %d 条\n", group.TalkerName, group.Talker, group.Count))
+		} else {
+			buf.WriteString(fmt.Sprintf("## %s 共 %d 条\n", group.Talker, group.Count))
+		}
+		for _, hit := range group.Hits {
+			sender := hit.Sender
+			if hit.IsSelf {
+				sender = "我"
+			}
+			if hit.SenderName != "" {
+				buf.WriteString(fmt.Sprintf("%s(%s)", hit.SenderName, sender))
+			} else {
+				buf.WriteString(sender)
+			}
+			buf.WriteString(fmt.Sprintf(" %s [seq:%d]\n", hit.Time.Format(timeFormat), hit.Seq))
+			buf.WriteString(hit.Snippet)
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
+
 type GetContactsResp struct {
 	Items []*model.Contact `json:"items"`
 }
 
-func (w *DB) GetContacts(key string, limit, offset int) (*GetContactsResp, error) {
-	ctx := context.Background()
-
+func (w *DB) GetContacts(ctx context.Context, key string, limit, offset int) (*GetContactsResp, error) {
 	contacts, err := w.repo.GetContacts(ctx, key, limit, offset)
 	if err != nil {
 		return nil, err
@@ -91,9 +347,7 @@ type GetChatRoomsResp struct {
 	Items []*model.ChatRoom `json:"items"`
 }
 
-func (w *DB) GetChatRooms(key string, limit, offset int) (*GetChatRoomsResp, error) {
-	ctx := context.Background()
-
+func (w *DB) GetChatRooms(ctx context.Context, key string, limit, offset int) (*GetChatRoomsResp, error) {
 	chatRooms, err := w.repo.GetChatRooms(ctx, key, limit, offset)
 	if err != nil {
 		return nil, err
@@ -108,9 +362,7 @@ type GetSessionsResp struct {
 	Items []*model.Session `json:"items"`
 }
 
-func (w *DB) GetSessions(key string, limit, offset int) (*GetSessionsResp, error) {
-	ctx := context.Background()
-
+func (w *DB) GetSessions(ctx context.Context, key string, limit, offset int) (*GetSessionsResp, error) {
 	// 使用 repository 获取会话列表
 	sessions, err := w.repo.GetSessions(ctx, key, limit, offset)
 	if err != nil {
@@ -122,8 +374,23 @@ func (w *DB) GetSessions(key string, limit, offset int) (*GetSessionsResp, error
 	}, nil
 }
 
-func (w *DB) GetMedia(_type string, key string) (*model.Media, error) {
-	return w.repo.GetMedia(context.Background(), _type, key)
+func (w *DB) GetMedia(ctx context.Context, _type string, key string) (*model.Media, error) {
+	return w.repo.GetMedia(ctx, _type, key)
+}
+
+// AllowedTalker 判断会话是否符合 ctx 中的访问策略
+func (w *DB) AllowedTalker(ctx context.Context, talker string) bool {
+	return w.repo.AllowedTalker(ctx, talker)
+}
+
+// AllowedMediaPath 判断数据目录中的媒体文件是否符合 ctx 中的访问策略
+func (w *DB) AllowedMediaPath(ctx context.Context, path string) bool {
+	return w.repo.AllowedMediaPath(ctx, path)
+}
+
+// Notify 通知数据库文件已在原位置修改，数据库连接、缓存和回调与文件被替换时一样重新加载
+func (w *DB) Notify(path string) {
+	w.ds.Notify(path)
 }
 
 func (w *DB) SetCallback(group string, callback func(event fsnotify.Event) error) error {
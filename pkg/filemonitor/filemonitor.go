@@ -10,6 +10,13 @@ import (
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog/log"
+
+	"github.com/sjzar/chatlog/pkg/metrics"
+)
+
+var (
+	events        = metrics.NewCounter("chatlog_fsnotify_events_total", "File system events received by the file monitor.", "op")
+	watcherErrors = metrics.NewCounter("chatlog_fsnotify_errors_total", "Errors reported by the file system watcher.")
 )
 
 // FileMonitor manages multiple file groups
@@ -360,6 +367,7 @@ func (fm *FileMonitor) watchLoop() {
 				// Channel closed, exit loop
 				return
 			}
+			events.With(eventOp(event.Op)).Inc()
 
 			// Handle directory creation events to add new watches
 			info, err := os.Stat(event.Name)
@@ -408,11 +416,35 @@ func (fm *FileMonitor) watchLoop() {
 				// Channel closed, exit loop
 				return
 			}
+			watcherErrors.With().Inc()
 			log.Error().Err(err).Msg("Watcher error")
 		}
 	}
 }
 
+// eventOp returns the name of the most significant operation of an event
+func eventOp(op fsnotify.Op) string {
+	switch {
+	case op.Has(fsnotify.Create):
+		return "create"
+	case op.Has(fsnotify.Write):
+		return "write"
+	case op.Has(fsnotify.Remove):
+		return "remove"
+	case op.Has(fsnotify.Rename):
+		return "rename"
+	case op.Has(fsnotify.Chmod):
+		return "chmod"
+	}
+	return "unknown"
+}
+
+// Notify forwards an event to matching groups, for changes that produce no
+// file system event of the expected kind
+func (fm *FileMonitor) Notify(event fsnotify.Event) {
+	fm.forwardEventToGroups(event)
+}
+
 // forwardEventToGroups forwards file events to matching groups
 func (fm *FileMonitor) forwardEventToGroups(event fsnotify.Event) {
 	// Get a copy of groups to avoid holding lock during processing
@@ -0,0 +1,397 @@
+// Package metrics implements counters, gauges and histograms exposed in the
+// Prometheus text exposition format (version 0.0.4).
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the content type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the default histogram buckets in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry used by the package level constructors
+var Default = NewRegistry()
+
+type collector interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry holds registered metrics
+type Registry struct {
+	mutex      sync.RWMutex
+	collectors map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+func (r *Registry) register(c collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.collectors[c.name()]; ok {
+		panic("metrics: duplicate metric " + c.name())
+	}
+	r.collectors[c.name()] = c
+}
+
+// WriteTo writes all metrics sorted by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]collector, 0, len(names))
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.mutex.RUnlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler returns an http.Handler serving the registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.WriteTo(w)
+	})
+}
+
+// Handler returns an http.Handler serving the default registry
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// desc is the common part of all metric families
+type desc struct {
+	fqName string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) name() string { return d.fqName }
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.fqName, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.fqName, d.typ)
+}
+
+// vec stores one series per combination of label values
+type vec[T any] struct {
+	desc
+	mutex  sync.RWMutex
+	series map[string]*labeled[T]
+	newT   func() *T
+}
+
+type labeled[T any] struct {
+	values []string
+	metric *T
+}
+
+func (v *vec[T]) with(values ...string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.fqName, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mutex.RLock()
+	s, ok := v.series[key]
+	v.mutex.RUnlock()
+	if ok {
+		return s.metric
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if s, ok := v.series[key]; ok {
+		return s.metric
+	}
+	s = &labeled[T]{values: append([]string(nil), values...), metric: v.newT()}
+	v.series[key] = s
+	return s.metric
+}
+
+// each calls fn for every series sorted by label values
+func (v *vec[T]) each(fn func(values []string, metric *T)) {
+	v.mutex.RLock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := make([]*labeled[T], 0, len(keys))
+	for _, key := range keys {
+		list = append(list, v.series[key])
+	}
+	v.mutex.RUnlock()
+
+	for _, s := range list {
+		fn(s.values, s.metric)
+	}
+}
+
+func newVec[T any](name, help, typ string, labels []string, newT func() *T) *vec[T] {
+	return &vec[T]{
+		desc:   desc{fqName: name, help: help, typ: typ, labels: labels},
+		series: make(map[string]*labeled[T]),
+		newT:   newT,
+	}
+}
+
+// value is a float64 updated atomically
+type value struct {
+	bits uint64
+}
+
+func (v *value) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (v *value) Set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v value
+}
+
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Add increases the counter, negative values are ignored
+func (c *Counter) Add(delta float64) {
+	if delta > 0 {
+		c.v.Add(delta)
+	}
+}
+
+func (c *Counter) Value() float64 { return c.v.Value() }
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	*vec[Counter]
+}
+
+// NewCounter creates a counter registered in the default registry
+func NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	Default.register(c)
+	return c
+}
+
+// With returns the counter for the given label values
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.with(values...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.header(w)
+	c.each(func(values []string, m *Counter) {
+		writeSample(w, c.fqName, c.labels, values, "", "", m.Value())
+	})
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	v value
+}
+
+func (g *Gauge) Set(f float64)     { g.v.Set(f) }
+func (g *Gauge) Add(delta float64) { g.v.Add(delta) }
+func (g *Gauge) Inc()              { g.v.Add(1) }
+func (g *Gauge) Dec()              { g.v.Add(-1) }
+func (g *Gauge) Value() float64    { return g.v.Value() }
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	*vec[Gauge]
+}
+
+// NewGauge creates a gauge registered in the default registry
+func NewGauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	Default.register(g)
+	return g
+}
+
+// With returns the gauge for the given label values
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.with(values...)
+}
+
+func (g *GaugeVec) write(w *bufio.Writer) {
+	g.header(w)
+	g.each(func(values []string, m *Gauge) {
+		writeSample(w, g.fqName, g.labels, values, "", "", m.Value())
+	})
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	*vec[Histogram]
+	buckets []float64
+}
+
+// NewHistogram creates a histogram registered in the default registry,
+// DefBuckets is used when buckets is empty
+func NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{buckets: buckets}
+	h.vec = newVec(name, help, "histogram", labels, func() *Histogram {
+		return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	})
+	Default.register(h)
+	return h
+}
+
+// With returns the histogram for the given label values
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(values...)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.header(w)
+	h.each(func(values []string, m *Histogram) {
+		m.mutex.Lock()
+		counts := append([]uint64(nil), m.counts...)
+		count, sum := m.count, m.sum
+		m.mutex.Unlock()
+
+		for i, upper := range m.buckets {
+			writeSample(w, h.fqName+"_bucket", h.labels, values, "le", formatFloat(upper), float64(counts[i]))
+		}
+		writeSample(w, h.fqName+"_bucket", h.labels, values, "le", "+Inf", float64(count))
+		writeSample(w, h.fqName+"_sum", h.labels, values, "", "", sum)
+		writeSample(w, h.fqName+"_count", h.labels, values, "", "", float64(count))
+	})
+}
+
+// GaugeFunc is a gauge whose value is read when metrics are collected
+type GaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+// NewGaugeFunc creates a gauge func registered in the default registry
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{fqName: name, help: help, typ: "gauge"}, fn: fn}
+	Default.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.header(w)
+	writeSample(w, g.fqName, nil, nil, "", "", g.fn())
+}
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, escapeLabel(values[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpReplacer.Replace(s) }
+func escapeLabel(s string) string { return labelReplacer.Replace(s) }
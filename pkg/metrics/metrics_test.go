@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	Default = NewRegistry()
+	defer func() { Default = NewRegistry() }()
+
+	requests := NewCounter("test_requests_total", "Requests.", "path", "code")
+	requests.With("/api", "200").Inc()
+	requests.With("/api", "200").Add(2)
+	requests.With(`/a"b`, "500").Inc()
+	requests.With("/api", "200").Add(-1)
+
+	state := NewGauge("test_state", "State.")
+	state.With().Set(3)
+
+	latency := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	latency.With().Observe(0.05)
+	latency.With().Observe(0.5)
+	latency.With().Observe(5)
+
+	NewGaugeFunc("test_open", "Open\nhandles.", func() float64 { return 7 })
+
+	buf := &strings.Builder{}
+	if _, err := Default.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.55
+test_latency_seconds_count 3
+# HELP test_open Open\nhandles.
+# TYPE test_open gauge
+test_open 7
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{path="/a\"b",code="500"} 1
+test_requests_total{path="/api",code="200"} 3
+# HELP test_state State.
+# TYPE test_state gauge
+test_state 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -133,3 +133,15 @@ func PrepareDir(path string) error {
 	}
 	return nil
 }
+
+// RemoveSQLite removes a SQLite database file together with its -wal, -shm and -journal files.
+// Missing files are ignored.
+func RemoveSQLite(path string) error {
+	var first error
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) && first == nil {
+			first = err
+		}
+	}
+	return first
+}
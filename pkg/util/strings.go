@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"unicode"
@@ -69,3 +70,59 @@ func Str2List(str string, sep string) []string {
 
 	return list
 }
+
+// Snippet 截取文本中首个匹配附近的片段，前后各保留 radius 个字符，并使用 pre/post 包裹片段内的所有匹配
+// 没有匹配时返回文本开头的片段
+func Snippet(text string, re *regexp.Regexp, radius int, pre, post string) string {
+	var locs [][]int
+	if re != nil {
+		for _, loc := range re.FindAllStringIndex(text, -1) {
+			// 忽略空匹配
+			if loc[1] > loc[0] {
+				locs = append(locs, loc)
+			}
+		}
+	}
+
+	start, end := 0, len(text)
+	if len(locs) > 0 {
+		start, end = locs[0][0], locs[0][1]
+	}
+	for i := 0; i < radius && start > 0; i++ {
+		_, size := utf8.DecodeLastRuneInString(text[:start])
+		start -= size
+	}
+	if len(locs) == 0 {
+		end = 0
+		radius *= 2
+	}
+	for i := 0; i < radius && end < len(text); i++ {
+		_, size := utf8.DecodeRuneInString(text[end:])
+		end += size
+	}
+
+	buf := strings.Builder{}
+	if start > 0 {
+		buf.WriteString("...")
+	}
+	cur := start
+	for _, loc := range locs {
+		if loc[0] < cur {
+			continue
+		}
+		if loc[1] > end {
+			break
+		}
+		buf.WriteString(text[cur:loc[0]])
+		buf.WriteString(pre)
+		buf.WriteString(text[loc[0]:loc[1]])
+		buf.WriteString(post)
+		cur = loc[1]
+	}
+	buf.WriteString(text[cur:end])
+	if end < len(text) {
+		buf.WriteString("...")
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestSnippet(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		regex  string
+		radius int
+		want   string
+	}{
+		{
+			name:   "match in middle",
+			text:   "今天下午讨论一下项目进度和排期",
+			regex:  "项目进度",
+			radius: 3,
+			want:   "...论一下<em>项目进度</em>和排期",
+		},
+		{
+			name:   "multiple matches",
+			text:   "进度a进度",
+			regex:  "进度",
+			radius: 10,
+			want:   "<em>进度</em>a<em>进度</em>",
+		},
+		{
+			name:   "match outside window",
+			text:   "abc进度defghij进度",
+			regex:  "进度",
+			radius: 2,
+			want:   "...bc<em>进度</em>de...",
+		},
+		{
+			name:   "no match",
+			text:   "hello world",
+			regex:  "xyz",
+			radius: 2,
+			want:   "hell...",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Snippet(tt.text, regexp.MustCompile(tt.regex), tt.radius, "<em>", "</em>")
+			if got != tt.want {
+				t.Errorf("Snippet() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
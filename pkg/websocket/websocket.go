@@ -0,0 +1,302 @@
+// Package websocket implements the server side of the WebSocket protocol (RFC 6455)
+// needed to push messages to clients: handshake, text/binary frames, ping/pong and close.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opcodes defined in RFC 6455 section 5.2
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// Close status codes defined in RFC 6455 section 7.4.1
+const (
+	CloseNormal        = 1000
+	CloseGoingAway     = 1001
+	CloseProtocolError = 1002
+	CloseTooLarge      = 1009
+)
+
+// MaxMessageSize is the maximum size of a message read from the client
+const MaxMessageSize = 1 << 20
+
+// WriteTimeout bounds each frame write, so a client that stops reading
+// fails the write instead of blocking the sender forever
+var WriteTimeout = 10 * time.Second
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	ErrNotWebSocket    = errors.New("not a websocket handshake")
+	ErrMessageTooLarge = errors.New("websocket message too large")
+	ErrProtocol        = errors.New("websocket protocol error")
+)
+
+// Conn is a server side WebSocket connection.
+// Writes are safe for concurrent use, reads must be done from a single goroutine.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	mutex  sync.Mutex
+	closed bool
+}
+
+// SameOrigin reports whether the request has no Origin header, as sent by
+// non-browser clients, or its Origin host matches the Host header
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// IsWebSocketUpgrade reports whether the request asks for a WebSocket upgrade
+func IsWebSocketUpgrade(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+// Upgrade performs the WebSocket handshake and takes over the underlying connection
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet || !IsWebSocketUpgrade(r) {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrNotWebSocket
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, ErrNotWebSocket
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("hijack connection: %w", err)
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// clear any deadline set by the HTTP server
+	conn.SetDeadline(time.Time{})
+
+	return &Conn{conn: conn, br: rw.Reader}, nil
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept header value for a client key
+func AcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// WriteText sends a text message
+func (c *Conn) WriteText(data []byte) error {
+	return c.WriteMessage(OpText, data)
+}
+
+// WritePing sends a ping control frame
+func (c *Conn) WritePing() error {
+	return c.WriteMessage(OpPing, nil)
+}
+
+// WriteMessage sends a single unfragmented frame
+func (c *Conn) WriteMessage(op byte, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	}
+	_, err := c.conn.Write(AppendFrame(nil, op, data))
+	return err
+}
+
+// ReadMessage reads the next data message, answering pings and close frames.
+// It returns io.EOF once the client closes the connection.
+func (c *Conn) ReadMessage() (byte, []byte, error) {
+	var op byte
+	var message []byte
+	for {
+		fin, frameOp, payload, err := readFrame(c.br)
+		if err != nil {
+			if errors.Is(err, ErrMessageTooLarge) {
+				c.CloseWithCode(CloseTooLarge)
+			} else if errors.Is(err, ErrProtocol) {
+				c.CloseWithCode(CloseProtocolError)
+			}
+			return 0, nil, err
+		}
+
+		switch frameOp {
+		case OpPing:
+			if err := c.WriteMessage(OpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			c.CloseWithCode(CloseNormal)
+			return 0, nil, io.EOF
+		case OpContinuation:
+			if message == nil {
+				c.CloseWithCode(CloseProtocolError)
+				return 0, nil, ErrProtocol
+			}
+		default:
+			if message != nil {
+				c.CloseWithCode(CloseProtocolError)
+				return 0, nil, ErrProtocol
+			}
+			op = frameOp
+			message = make([]byte, 0, len(payload))
+		}
+
+		if len(message)+len(payload) > MaxMessageSize {
+			c.CloseWithCode(CloseTooLarge)
+			return 0, nil, ErrMessageTooLarge
+		}
+		message = append(message, payload...)
+		if fin {
+			return op, message, nil
+		}
+	}
+}
+
+// CloseWithCode sends a close frame with the status code and closes the connection
+func (c *Conn) CloseWithCode(code int) error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	c.WriteMessage(OpClose, payload)
+	return c.Close()
+}
+
+// Close closes the underlying connection without sending a close frame
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
+
+// AppendFrame appends an unmasked frame, as sent by servers, to buf
+func AppendFrame(buf []byte, op byte, data []byte) []byte {
+	buf = append(buf, 0x80|op)
+	switch n := len(data); {
+	case n < 126:
+		buf = append(buf, byte(n))
+	case n <= 0xFFFF:
+		buf = append(buf, 126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	return append(buf, data...)
+}
+
+// readFrame reads a single frame; client frames must be masked
+func readFrame(r io.Reader) (fin bool, op byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	op = header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, ErrProtocol
+	}
+	masked := header[1]&0x80 != 0
+	if !masked {
+		return false, 0, nil, ErrProtocol
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	// control frames must not be fragmented and carry at most 125 bytes
+	if op >= OpClose && (!fin || length > 125) {
+		return false, 0, nil, ErrProtocol
+	}
+	if length > MaxMessageSize {
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// RFC 6455 section 1.3
+	if got := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("AcceptKey() = %s", got)
+	}
+}
+
+func TestAppendFrame(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 65535, 65536} {
+		frame := AppendFrame(nil, OpText, bytes.Repeat([]byte("a"), n))
+		fin, op, payload, err := readFrame(bytes.NewReader(mask(frame)))
+		if err != nil {
+			t.Fatalf("size %d: %v", n, err)
+		}
+		if !fin || op != OpText || len(payload) != n {
+			t.Errorf("size %d: fin=%v op=%d len=%d", n, fin, op, len(payload))
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			op, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(op, data)
+		}
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected handshake response: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// pings are answered with pongs, fragmented text is reassembled and echoed
+	conn.Write(mask(AppendFrame(nil, OpPing, []byte("p"))))
+	first := AppendFrame(nil, OpText, []byte("hello "))
+	first[0] &^= 0x80
+	conn.Write(mask(first))
+	conn.Write(mask(AppendFrame(nil, OpContinuation, []byte("world"))))
+
+	for _, want := range []struct {
+		op   byte
+		data string
+	}{{OpPong, "p"}, {OpText, "hello world"}} {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(br, header); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, header[1])
+		io.ReadFull(br, data)
+		if header[0] != 0x80|want.op || string(data) != want.data {
+			t.Errorf("got op %x data %q, want op %x data %q", header[0], data, want.op, want.data)
+		}
+	}
+
+	conn.Write(mask(AppendFrame(nil, OpClose, nil)))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil || header[0] != 0x80|OpClose {
+		t.Errorf("expected close frame, got %x %v", header, err)
+	}
+}
+
+// mask converts a server frame into a masked client frame
+func mask(frame []byte) []byte {
+	key := []byte{1, 2, 3, 4}
+	offset := 2
+	switch frame[1] {
+	case 126:
+		offset = 4
+	case 127:
+		offset = 10
+	}
+	out := append([]byte{}, frame[:offset]...)
+	out[1] |= 0x80
+	out = append(out, key...)
+	for i, b := range frame[offset:] {
+		out = append(out, b^key[i%4])
+	}
+	return out
+}
+
+func TestSameOrigin(t *testing.T) {
+	for origin, want := range map[string]bool{
+		"":                        true,
+		"http://localhost:5030":   true,
+		"https://LOCALHOST:5030":  true,
+		"http://evil.example.com": false,
+		"http://localhost:5031":   false,
+		"null":                    false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost:5030/api/v1/stream/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := SameOrigin(r); got != want {
+			t.Errorf("SameOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}